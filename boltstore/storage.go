@@ -0,0 +1,435 @@
+package boltstore
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	runsBucket          = []byte("DataflowRuns")
+	flowsBucket         = []byte("Flows")
+	runFlowsBucket      = []byte("RunFlows")   // has a bucket per run, keyed by flow ID
+	runOutputsBucket    = []byte("RunOutputs") // has a bucket per run, keyed by step ID and output key
+	flowSplitsBucket    = []byte("FlowSplits")
+	runSplitsBucket     = []byte("RunSplits") // has a bucket per run, keyed by flow split ID
+	countersBucket      = []byte("Counters")
+	errorCountersBucket = []byte("ErrorCounters")
+)
+
+// lockTimeout is how long to wait for another process to release the
+// database file
+const lockTimeout = 5 * time.Second
+
+// BoltStorage is a durable storage service on an embedded bbolt
+// database. Each method runs in its own transaction; since bbolt
+// serializes write transactions, counters are incremented atomically
+// across concurrent workers. Errors are logged and returned where the
+// Storage interface allows it.
+type BoltStorage struct {
+	Logger stepflow.Logger
+	DB     *bolt.DB
+}
+
+// NewBoltStorage opens the bbolt database in the given file, creating it
+// if needed. The database is locked by the process until Close is called.
+func NewBoltStorage(logger stepflow.Logger, path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("Database %s could not be opened: %s", path, err.Error())
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{runsBucket, flowsBucket, runFlowsBucket, runOutputsBucket, flowSplitsBucket, runSplitsBucket, countersBucket, errorCountersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Database %s could not be initialized: %s", path, err.Error())
+	}
+
+	return &BoltStorage{Logger: logger, DB: db}, nil
+}
+
+// Close closes the database
+func (bs *BoltStorage) Close() error {
+	return bs.DB.Close()
+}
+
+func (bs *BoltStorage) StoreDataflowRun(ctx context.Context, run *stepflow.DataflowRun) error {
+	outputs := make(map[string][]byte)
+	for stepID, stepOutputs := range run.Outputs {
+		for key, output := range stepOutputs {
+			value, err := stepflow.MarshalFlowOutput(output)
+			if err != nil {
+				return fmt.Errorf("Output of step %s could not be serialized: %s", stepID, err.Error())
+			}
+			outputs[outputKey(stepID, key)] = value
+		}
+	}
+
+	// the outputs are stored apart from the run
+	runNoOutputs := *run
+	runNoOutputs.Outputs = nil
+	value, err := stepflow.MarshalDataflowRun(&runNoOutputs)
+	if err != nil {
+		return err
+	}
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		if len(outputs) > 0 {
+			runOutputs, err := tx.Bucket(runOutputsBucket).CreateBucketIfNotExists([]byte(run.ID))
+			if err != nil {
+				return err
+			}
+			for key, value := range outputs {
+				// outputs already stored are kept
+				if runOutputs.Get([]byte(key)) == nil {
+					if err = runOutputs.Put([]byte(key), value); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return tx.Bucket(runsBucket).Put([]byte(run.ID), value)
+	})
+}
+
+func (bs *BoltStorage) StoreFlowOutput(ctx context.Context, runID stepflow.DataflowRunID, stepID string, key string, output *stepflow.FlowOutput) error {
+	value, err := stepflow.MarshalFlowOutput(output)
+	if err != nil {
+		return fmt.Errorf("Output of step %s could not be serialized: %s", stepID, err.Error())
+	}
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(runsBucket).Get([]byte(runID)) == nil {
+			return fmt.Errorf("Dataflow run %s not found", runID)
+		}
+		runOutputs, err := tx.Bucket(runOutputsBucket).CreateBucketIfNotExists([]byte(runID))
+		if err != nil {
+			return err
+		}
+		return runOutputs.Put([]byte(outputKey(stepID, key)), value)
+	})
+}
+
+func (bs *BoltStorage) RetrieveDataflowRuns(ctx context.Context, keys []stepflow.DataflowRunID) map[stepflow.DataflowRunID]*stepflow.DataflowRun {
+	runs := make(map[stepflow.DataflowRunID]*stepflow.DataflowRun)
+	err := bs.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(runsBucket)
+		for _, key := range keys {
+			runs[key] = nil
+			if value := bucket.Get([]byte(key)); value != nil {
+				run, err := stepflow.UnmarshalDataflowRun(value)
+				if err != nil {
+					return fmt.Errorf("Dataflow run %s could not be read: %s", key, err.Error())
+				}
+				if err = retrieveOutputs(tx, run); err != nil {
+					return fmt.Errorf("Outputs of dataflow run %s could not be read: %s", key, err.Error())
+				}
+				runs[key] = run
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bs.Logger.Errorf(ctx, "Error retrieving dataflow runs: %s", err.Error())
+	}
+	return runs
+}
+
+// retrieveOutputs sets the outputs of the run, stored apart from it
+func retrieveOutputs(tx *bolt.Tx, run *stepflow.DataflowRun) error {
+	run.Outputs = nil
+	runOutputs := tx.Bucket(runOutputsBucket).Bucket([]byte(run.ID))
+	if runOutputs == nil {
+		return nil
+	}
+	return runOutputs.ForEach(func(field, value []byte) error {
+		var stepKey []string
+		if err := json.Unmarshal(field, &stepKey); err != nil || len(stepKey) != 2 {
+			return fmt.Errorf("Invalid output key %s", field)
+		}
+		output, err := stepflow.UnmarshalFlowOutput(value)
+		if err != nil {
+			return err
+		}
+		if run.Outputs == nil {
+			run.Outputs = make(map[string]map[string]*stepflow.FlowOutput)
+		}
+		if run.Outputs[stepKey[0]] == nil {
+			run.Outputs[stepKey[0]] = make(map[string]*stepflow.FlowOutput)
+		}
+		run.Outputs[stepKey[0]][stepKey[1]] = output
+		return nil
+	})
+}
+
+func (bs *BoltStorage) DeleteDataflowRun(ctx context.Context, key stepflow.DataflowRunID) error {
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(runOutputsBucket)
+		if index.Bucket([]byte(key)) != nil {
+			if err := index.DeleteBucket([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(runsBucket).Delete([]byte(key))
+	})
+}
+
+func (bs *BoltStorage) ListDataflowRuns(ctx context.Context) []stepflow.DataflowRunID {
+	runIDs := []stepflow.DataflowRunID{}
+	err := bs.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(runsBucket).ForEach(func(key, value []byte) error {
+			runIDs = append(runIDs, stepflow.DataflowRunID(key))
+			return nil
+		})
+	})
+	if err != nil {
+		bs.Logger.Errorf(ctx, "Error listing dataflow runs: %s", err.Error())
+	}
+	return runIDs
+}
+
+func (bs *BoltStorage) StoreFlow(ctx context.Context, flow *stepflow.Flow) error {
+	value, err := stepflow.MarshalFlow(flow)
+	if err != nil {
+		return err
+	}
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		runFlows, err := tx.Bucket(runFlowsBucket).CreateBucketIfNotExists([]byte(flow.DataflowRunID))
+		if err != nil {
+			return err
+		}
+		if err = runFlows.Put([]byte(flow.ID), []byte{}); err != nil {
+			return err
+		}
+		return tx.Bucket(flowsBucket).Put([]byte(flow.ID), value)
+	})
+}
+
+func (bs *BoltStorage) RetrieveFlows(ctx context.Context, keys []stepflow.FlowID) map[stepflow.FlowID]*stepflow.Flow {
+	flows := make(map[stepflow.FlowID]*stepflow.Flow)
+	err := bs.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(flowsBucket)
+		for _, key := range keys {
+			if value := bucket.Get([]byte(key)); value != nil {
+				flow, err := stepflow.UnmarshalFlow(value)
+				if err != nil {
+					return fmt.Errorf("Flow %s could not be read: %s", key, err.Error())
+				}
+				flows[key] = flow
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bs.Logger.Errorf(ctx, "Error retrieving flows: %s", err.Error())
+	}
+	return flows
+}
+
+func (bs *BoltStorage) DeleteFlow(ctx context.Context, key stepflow.FlowID) error {
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(flowsBucket)
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+
+		// only the run ID is needed to remove the flow from the run index
+		var flow stepflow.FlowNoData
+		if err := json.Unmarshal(value, &flow); err != nil {
+			return fmt.Errorf("Flow %s could not be read: %s", key, err.Error())
+		}
+		index := tx.Bucket(runFlowsBucket)
+		if runFlows := index.Bucket([]byte(flow.DataflowRunID)); runFlows != nil {
+			if err := runFlows.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if isEmpty(runFlows) {
+				if err := index.DeleteBucket([]byte(flow.DataflowRunID)); err != nil {
+					return err
+				}
+			}
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (bs *BoltStorage) ListFlows(ctx context.Context, runID stepflow.DataflowRunID) []stepflow.FlowID {
+	flowIDs := []stepflow.FlowID{}
+	err := bs.DB.View(func(tx *bolt.Tx) error {
+		runFlows := tx.Bucket(runFlowsBucket).Bucket([]byte(runID))
+		if runFlows == nil {
+			return nil
+		}
+		return runFlows.ForEach(func(key, value []byte) error {
+			flowIDs = append(flowIDs, stepflow.FlowID(key))
+			return nil
+		})
+	})
+	if err != nil {
+		bs.Logger.Errorf(ctx, "Error listing flows of run %s: %s", runID, err.Error())
+	}
+	return flowIDs
+}
+
+func (bs *BoltStorage) StoreFlowSplit(ctx context.Context, flowSplit *stepflow.FlowSplit) error {
+	value, err := json.Marshal(flowSplit)
+	if err != nil {
+		return err
+	}
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		runSplits, err := tx.Bucket(runSplitsBucket).CreateBucketIfNotExists([]byte(flowSplit.DataflowRunID))
+		if err != nil {
+			return err
+		}
+		if err = runSplits.Put([]byte(flowSplit.ID), []byte{}); err != nil {
+			return err
+		}
+		return tx.Bucket(flowSplitsBucket).Put([]byte(flowSplit.ID), value)
+	})
+}
+
+func (bs *BoltStorage) RetrieveFlowSplits(ctx context.Context, keys []stepflow.FlowSplitID) map[stepflow.FlowSplitID]*stepflow.FlowSplit {
+	flowSplits := make(map[stepflow.FlowSplitID]*stepflow.FlowSplit)
+	err := bs.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(flowSplitsBucket)
+		for _, key := range keys {
+			if value := bucket.Get([]byte(key)); value != nil {
+				flowSplit := &stepflow.FlowSplit{}
+				if err := json.Unmarshal(value, flowSplit); err != nil {
+					return fmt.Errorf("Flow split %s could not be read: %s", key, err.Error())
+				}
+				flowSplits[key] = flowSplit
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bs.Logger.Errorf(ctx, "Error retrieving flow splits: %s", err.Error())
+	}
+	return flowSplits
+}
+
+func (bs *BoltStorage) DeleteFlowSplit(ctx context.Context, key stepflow.FlowSplitID) error {
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(flowSplitsBucket)
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+
+		// the run ID is needed to remove the split from the run index
+		var flowSplit stepflow.FlowSplit
+		if err := json.Unmarshal(value, &flowSplit); err != nil {
+			return fmt.Errorf("Flow split %s could not be read: %s", key, err.Error())
+		}
+		index := tx.Bucket(runSplitsBucket)
+		if runSplits := index.Bucket([]byte(flowSplit.DataflowRunID)); runSplits != nil {
+			if err := runSplits.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if isEmpty(runSplits) {
+				if err := index.DeleteBucket([]byte(flowSplit.DataflowRunID)); err != nil {
+					return err
+				}
+			}
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (bs *BoltStorage) ListFlowSplits(ctx context.Context, runID stepflow.DataflowRunID) []stepflow.FlowSplitID {
+	flowSplitIDs := []stepflow.FlowSplitID{}
+	err := bs.DB.View(func(tx *bolt.Tx) error {
+		runSplits := tx.Bucket(runSplitsBucket).Bucket([]byte(runID))
+		if runSplits == nil {
+			return nil
+		}
+		return runSplits.ForEach(func(key, value []byte) error {
+			flowSplitIDs = append(flowSplitIDs, stepflow.FlowSplitID(key))
+			return nil
+		})
+	})
+	if err != nil {
+		bs.Logger.Errorf(ctx, "Error listing flow splits of run %s: %s", runID, err.Error())
+	}
+	return flowSplitIDs
+}
+
+// Increment sets the counter to the initial value the first time it is
+// called for a key, and increments it on later calls
+func (bs *BoltStorage) Increment(ctx context.Context, key string, initialValue int64, increment int64) (int64, error) {
+	var value int64
+	err := bs.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(countersBucket)
+		if current := bucket.Get([]byte(key)); current != nil {
+			value = decodeInt(current) + increment
+		} else {
+			value = initialValue
+		}
+		return bucket.Put([]byte(key), encodeInt(value))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Counter %s could not be incremented: %s", key, err.Error())
+	}
+	return value, nil
+}
+
+// IncrementWithError increments both the count and the error count of
+// the key, starting from zero, in a single transaction
+func (bs *BoltStorage) IncrementWithError(ctx context.Context, key string, increment int64, errIncrement int64) (count int64, errCount int64, err error) {
+	err = bs.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(errorCountersBucket)
+		if current := bucket.Get([]byte(key)); current != nil {
+			count, errCount = decodeInt(current[:8]), decodeInt(current[8:])
+		}
+		count += increment
+		errCount += errIncrement
+		return bucket.Put([]byte(key), append(encodeInt(count), encodeInt(errCount)...))
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("Counter %s could not be incremented: %s", key, err.Error())
+	}
+	return count, errCount, nil
+}
+
+func (bs *BoltStorage) DeleteCounter(ctx context.Context, key string) error {
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(countersBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		return tx.Bucket(errorCountersBucket).Delete([]byte(key))
+	})
+}
+
+// outputKey is the key of an output in the outputs bucket of a run
+func outputKey(stepID string, key string) string {
+	field, _ := json.Marshal([]string{stepID, key})
+	return string(field)
+}
+
+func encodeInt(value int64) []byte {
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, uint64(value))
+	return bytes
+}
+
+func decodeInt(bytes []byte) int64 {
+	return int64(binary.BigEndian.Uint64(bytes))
+}
+
+func isEmpty(bucket *bolt.Bucket) bool {
+	key, _ := bucket.Cursor().First()
+	return key == nil
+}
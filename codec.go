@@ -0,0 +1,205 @@
+package stepflow
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// flowDataKind records the Go type of flow data, so it is restored as
+// the same type after being serialized
+type flowDataKind string
+
+const (
+	dataKindJSON  flowDataKind = "json"  // json.RawMessage
+	dataKindText  flowDataKind = "text"  // string
+	dataKindBytes flowDataKind = "bytes" // []byte
+	dataKindValue flowDataKind = "value" // decoded JSON, e.g. joined flow data
+
+	dataKindInvalidJSON flowDataKind = "invalid-json" // json.RawMessage that does not parse
+)
+
+// storedData is the serialized form of flow data
+type storedData struct {
+	DataKind flowDataKind    `json:",omitempty"`
+	Data     json.RawMessage `json:",omitempty"`
+}
+
+// storedFlow is the serialized form of a flow
+type storedFlow struct {
+	FlowNoData
+	storedData
+}
+
+// storedOutput is the serialized form of a flow output
+type storedOutput struct {
+	ContentType string
+	storedData
+}
+
+// runAlias avoids recursing into the serialization of DataflowRun
+type runAlias DataflowRun
+
+// storedRun is the serialized form of a run. The dataflow is serialized
+// with the run, since the run may outlive the process that started it.
+type storedRun struct {
+	*runAlias
+	Outputs map[string]map[string]*storedOutput
+}
+
+func encodeData(data interface{}) (storedData, error) {
+	var err error
+	stored := storedData{}
+	switch d := data.(type) {
+	case nil:
+	case json.RawMessage:
+		stored.DataKind = dataKindJSON
+		stored.Data = d
+		if !json.Valid(d) {
+			// e.g. a web method response that is not JSON despite its
+			// content type. it cannot be embedded, so it is kept as bytes
+			stored.DataKind = dataKindInvalidJSON
+			stored.Data, err = json.Marshal([]byte(d))
+		}
+	case string:
+		stored.DataKind = dataKindText
+		stored.Data, err = json.Marshal(d)
+	case []byte:
+		stored.DataKind = dataKindBytes
+		stored.Data, err = json.Marshal(d)
+	default:
+		stored.DataKind = dataKindValue
+		stored.Data, err = json.Marshal(d)
+	}
+	return stored, err
+}
+
+func decodeData(stored storedData) (interface{}, error) {
+	switch stored.DataKind {
+	case "":
+		return nil, nil
+	case dataKindJSON:
+		return json.RawMessage(stored.Data), nil
+	case dataKindInvalidJSON:
+		var bytes []byte
+		err := json.Unmarshal(stored.Data, &bytes)
+		return json.RawMessage(bytes), err
+	case dataKindText:
+		var text string
+		err := json.Unmarshal(stored.Data, &text)
+		return text, err
+	case dataKindBytes:
+		var bytes []byte
+		err := json.Unmarshal(stored.Data, &bytes)
+		return bytes, err
+	case dataKindValue:
+		var value interface{}
+		err := json.Unmarshal(stored.Data, &value)
+		return value, err
+	}
+	return nil, fmt.Errorf("Unknown flow data kind %s", stored.DataKind)
+}
+
+// MarshalFlow serializes a flow for durable storage. Unlike plain JSON
+// encoding, the type of the flow data (raw JSON, text, bytes or decoded
+// values) is kept, so UnmarshalFlow restores the flow as it was stored.
+func MarshalFlow(flow *Flow) ([]byte, error) {
+	data, err := encodeData(flow.Data)
+	if err != nil {
+		return nil, fmt.Errorf("Data of flow %s could not be serialized: %s", flow.ID, err.Error())
+	}
+	return json.Marshal(&storedFlow{FlowNoData: flow.FlowNoData, storedData: data})
+}
+
+// UnmarshalFlow deserializes a flow serialized with MarshalFlow
+func UnmarshalFlow(bytes []byte) (*Flow, error) {
+	var stored storedFlow
+	if err := json.Unmarshal(bytes, &stored); err != nil {
+		return nil, err
+	}
+	data, err := decodeData(stored.storedData)
+	if err != nil {
+		return nil, err
+	}
+	return &Flow{FlowNoData: stored.FlowNoData, Data: data}, nil
+}
+
+// MarshalDataflowRun serializes a run, including its dataflow and
+// outputs, for durable storage
+func MarshalDataflowRun(run *DataflowRun) ([]byte, error) {
+	stored := storedRun{runAlias: (*runAlias)(run)}
+	if run.Outputs != nil {
+		stored.Outputs = make(map[string]map[string]*storedOutput)
+	}
+	for stepID, stepOutputs := range run.Outputs {
+		stored.Outputs[stepID] = make(map[string]*storedOutput)
+		for key, output := range stepOutputs {
+			storedOutput, err := encodeOutput(output)
+			if err != nil {
+				return nil, fmt.Errorf("Output of step %s could not be serialized: %s", stepID, err.Error())
+			}
+			stored.Outputs[stepID][key] = storedOutput
+		}
+	}
+	return json.Marshal(&stored)
+}
+
+// UnmarshalDataflowRun deserializes a run serialized with MarshalDataflowRun
+func UnmarshalDataflowRun(bytes []byte) (*DataflowRun, error) {
+	run := &DataflowRun{}
+	stored := storedRun{runAlias: (*runAlias)(run)}
+	if err := json.Unmarshal(bytes, &stored); err != nil {
+		return nil, err
+	}
+
+	run.Outputs = nil
+	if stored.Outputs != nil {
+		run.Outputs = make(map[string]map[string]*FlowOutput)
+	}
+	for stepID, stepOutputs := range stored.Outputs {
+		run.Outputs[stepID] = make(map[string]*FlowOutput)
+		for key, output := range stepOutputs {
+			flowOutput, err := decodeOutput(output)
+			if err != nil {
+				return nil, err
+			}
+			run.Outputs[stepID][key] = flowOutput
+		}
+	}
+	return run, nil
+}
+
+// MarshalFlowOutput serializes a run output, for storage services that
+// keep outputs apart from the run
+func MarshalFlowOutput(output *FlowOutput) ([]byte, error) {
+	stored, err := encodeOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(stored)
+}
+
+// UnmarshalFlowOutput deserializes a run output serialized with
+// MarshalFlowOutput
+func UnmarshalFlowOutput(bytes []byte) (*FlowOutput, error) {
+	var stored storedOutput
+	if err := json.Unmarshal(bytes, &stored); err != nil {
+		return nil, err
+	}
+	return decodeOutput(&stored)
+}
+
+func encodeOutput(output *FlowOutput) (*storedOutput, error) {
+	data, err := encodeData(output.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &storedOutput{ContentType: output.ContentType, storedData: data}, nil
+}
+
+func decodeOutput(stored *storedOutput) (*FlowOutput, error) {
+	data, err := decodeData(stored.storedData)
+	if err != nil {
+		return nil, err
+	}
+	return &FlowOutput{ContentType: stored.ContentType, Data: data}, nil
+}
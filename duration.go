@@ -0,0 +1,33 @@
+package stepflow
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration serialized as a string, e.g. "1m30s"
+type Duration time.Duration
+
+// MarshalJSON implements Marshaller for Duration
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements Unmarshaller for Duration
+func (d *Duration) UnmarshalJSON(bytes []byte) error {
+	var str string
+	if err := json.Unmarshal(bytes, &str); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
@@ -2,8 +2,12 @@ package stepflow
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -13,18 +17,65 @@ type executor struct {
 	Logger            Logger
 	Storage           Storage
 	FlowQueue         FlowQueue
+
+	dataflows map[string]*Dataflow
+	functions map[string]Function
+
+	mu          sync.Mutex
+	cancelFuncs map[DataflowRunID]map[FlowID]context.CancelFunc
+
+	// held by Recover, so dequeued flows are not handled until it returns
+	recovering sync.RWMutex
+}
+
+// ExecutorOption configures optional executor features
+type ExecutorOption func(e *executor)
+
+// WithDataflows registers dataflows that subflow steps can reference by ID.
+// Since options cannot return errors, registering two dataflows with the
+// same ID panics, as registering two handlers for the same pattern does
+// in net/http.
+func WithDataflows(dataflows ...*Dataflow) ExecutorOption {
+	return func(e *executor) {
+		for _, dataflow := range dataflows {
+			if _, ok := e.dataflows[dataflow.ID]; ok {
+				panic(fmt.Sprintf("Dataflow ID registered more than once: %s", dataflow.ID))
+			}
+			dataflow.prepare()
+			e.dataflows[dataflow.ID] = dataflow
+		}
+	}
 }
 
-// NewExecutor creates an instance of the execution engine
-func NewExecutor(httpClientFactory HTTPClientFactory, logger Logger, storage Storage, flowQueue FlowQueue) Executor {
+// WithFunctions registers the Go functions that function steps call by name
+func WithFunctions(functions map[string]Function) ExecutorOption {
+	return func(e *executor) {
+		for name, function := range functions {
+			e.functions[name] = function
+		}
+	}
+}
+
+// NewExecutor creates an instance of the execution engine. The flow queue
+// can be nil for an executor that only validates dataflows.
+func NewExecutor(httpClientFactory HTTPClientFactory, logger Logger, storage Storage, flowQueue FlowQueue, options ...ExecutorOption) Executor {
 	e := &executor{
 		Logger:            logger,
 		Storage:           storage,
 		FlowQueue:         flowQueue,
 		HTTPClientFactory: httpClientFactory,
+		dataflows:         make(map[string]*Dataflow),
+		functions:         make(map[string]Function),
+		cancelFuncs:       make(map[DataflowRunID]map[FlowID]context.CancelFunc),
 	}
 
-	flowQueue.SetDequeueCb(e.handleFlow)
+	for _, option := range options {
+		option(e)
+	}
+
+	if flowQueue != nil {
+		flowQueue.SetDequeueCb(e.handleFlow)
+	}
 
 	return e
 }
@@ -38,14 +89,196 @@ func (e *executor) Validate(ctx context.Context, workflow *Dataflow) []error {
 		if len(steps) == 0 {
 			errs = append(errs, errors.New("Dataflow has no steps"))
 		}
+		if workflow.Timeout < 0 {
+			errs = append(errs, errors.New("Dataflow timeout cannot be negative"))
+		}
 		for _, step := range steps {
 			errs = append(errs, step.Validate()...)
+			if validator, ok := step.(ExecutorValidatorStep); ok {
+				errs = append(errs, validator.ValidateWithExecutor(ctx, e)...)
+			}
+		}
+		errs = append(errs, ValidateGraph(workflow)...)
+		if ctx.Value(subflowValidationKey{}) == nil {
+			errs = append(errs, e.findSubflowCycles(workflow)...)
+		}
+	}
+	return errs
+}
+
+// subflowValidationKey marks the context validating an inline subflow,
+// whose subflow cycles are found with those of its parent
+type subflowValidationKey struct{}
+
+// findSubflowCycles does a depth-first search of the dataflows started by
+// subflow steps, for dataflows that start themselves directly or through
+// other dataflows
+func (e *executor) findSubflowCycles(workflow *Dataflow) []error {
+	errs := []error{}
+	visiting := make(map[*Dataflow]bool)
+	visited := make(map[*Dataflow]bool)
+
+	var visit func(dataflow *Dataflow)
+	visit = func(dataflow *Dataflow) {
+		visiting[dataflow] = true
+		for _, step := range dataflow.Steps {
+			subflow, ok := step.(*SubflowStep)
+			if !ok {
+				continue
+			}
+			child := subflow.Dataflow
+			if child == nil {
+				child = e.GetDataflow(subflow.DataflowID)
+			}
+			if child == nil || visited[child] {
+				continue
+			}
+			if visiting[child] {
+				errs = append(errs, fmt.Errorf("Subflow step %s of dataflow %s creates a cycle through dataflow %s", subflow.ID, dataflow.ID, child.ID))
+				continue
+			}
+			visit(child)
 		}
+		visiting[dataflow] = false
+		visited[dataflow] = true
 	}
+
+	visit(workflow)
 	return errs
 }
 
 func (e *executor) Start(ctx context.Context, workflow *Dataflow) (*DataflowRun, []error) {
+	return e.StartWithInput(ctx, workflow, nil, "")
+}
+
+// StartWithInput starts a run whose initial flow has the given data and
+// content type
+func (e *executor) StartWithInput(ctx context.Context, workflow *Dataflow, data interface{}, contentType string) (*DataflowRun, []error) {
+	return e.startRun(ctx, workflow, data, contentType, nil)
+}
+
+// StartSubflow starts a child run with the data of the parent flow, and
+// sets the parent flow waiting for the child run to finish
+func (e *executor) StartSubflow(ctx context.Context, workflow *Dataflow, parent *Flow) (*DataflowRun, []error) {
+	wr, errs := e.startRun(ctx, workflow, parent.Data, parent.ContentType, parent)
+	if len(errs) == 0 {
+		parent.State = FlowStateWaiting
+		parent.ChildRunID = wr.ID
+	}
+	return wr, errs
+}
+
+// ErrSignalNotFound is returned by Signal when no flow is waiting for a
+// signal with the token, e.g. because it was already resumed
+var ErrSignalNotFound = errors.New("No flow waiting for signal")
+
+// Signal resumes the flow waiting for a signal with the given token. The
+// flow continues with the given data and content type.
+func (e *executor) Signal(ctx context.Context, token string, data interface{}, contentType string) error {
+	flowID := FlowID(strings.SplitN(token, ":", 2)[0])
+	flow, ok := e.Storage.RetrieveFlows(ctx, []FlowID{flowID})[flowID]
+	if !ok || flow.State != FlowStateWaiting || flow.SignalToken != token {
+		return fmt.Errorf("%w with token %s", ErrSignalNotFound, token)
+	}
+	// only one of the signal or the timeout resumes the flow
+	if claimed, err := e.claimSignal(ctx, flow); err != nil {
+		return err
+	} else if !claimed {
+		return fmt.Errorf("Signal with token %s already received or timed out", token)
+	}
+
+	run := e.retrieveRun(ctx, flow.DataflowRunID)
+	if run == nil {
+		e.deleteCounter(ctx, token)
+		return fmt.Errorf("Dataflow run %s not found", flow.DataflowRunID)
+	}
+	waitFlow := *flow
+	flow.SignalToken = ""
+	if run.IsFinished() {
+		e.interruptFlow(ctx, flow)
+		e.deleteCounter(ctx, token)
+		return fmt.Errorf("Dataflow run %s already finished with state %s", run.ID, run.State)
+	}
+
+	e.Logger.Infof(ctx, "Received signal with token %s", token)
+	flow.State = FlowStateActive
+	flow.NotBefore = time.Time{}
+	flow.Data = data
+	flow.ContentType = contentType
+	if err := e.advanceFlow(ctx, run, flow, run.Dataflow.GetStep(flow.NextStepID)); err != nil {
+		// the flow is deleted if it cannot be enqueued, so it is stored
+		// again waiting for the signal, which can then be sent again
+		if _, ok := e.Storage.RetrieveFlows(ctx, []FlowID{flow.ID})[flow.ID]; !ok {
+			if storeErr := e.Storage.StoreFlow(ctx, &waitFlow); storeErr != nil {
+				e.Logger.Errorf(ctx, "Error storing flow %s waiting for signal: %s", flow.ID, storeErr.Error())
+			}
+			e.deleteCounter(ctx, token)
+		}
+		return err
+	}
+	e.deleteCounter(ctx, token)
+	return nil
+}
+
+// claimSignal increments the counter of the signal token of the waiting
+// flow, so only one of the signal or the timeout resumes it. Returns false
+// if the other one did. Since the counter is deleted once the flow has
+// resumed, the flow is read again to check it is still waiting.
+func (e *executor) claimSignal(ctx context.Context, flow *Flow) (bool, error) {
+	if count, err := e.Storage.Increment(ctx, flow.SignalToken, 1, 1); err != nil || count != 1 {
+		return false, err
+	}
+	current, ok := e.Storage.RetrieveFlows(ctx, []FlowID{flow.ID})[flow.ID]
+	if !ok || current.State != FlowStateWaiting || current.SignalToken != flow.SignalToken {
+		e.deleteCounter(ctx, flow.SignalToken)
+		return false, nil
+	}
+	return true, nil
+}
+
+// queueSignalTimeout enqueues a copy of the waiting flow to be dequeued
+// when the wait times out
+func (e *executor) queueSignalTimeout(ctx context.Context, flow *Flow) error {
+	waitFlow := *flow
+	return e.queueFlow(ctx, &waitFlow)
+}
+
+// timeoutSignal fails the flow waiting for a signal, if it has not
+// been resumed yet
+func (e *executor) timeoutSignal(ctx context.Context, run *DataflowRun, waitFlow *Flow, step Step) error {
+	flow, ok := e.Storage.RetrieveFlows(ctx, []FlowID{waitFlow.ID})[waitFlow.ID]
+	if !ok || flow.State != FlowStateWaiting || flow.SignalToken != waitFlow.SignalToken {
+		return nil
+	}
+	if claimed, err := e.claimSignal(ctx, flow); err != nil || !claimed {
+		return err
+	}
+
+	token := flow.SignalToken
+	flow.State = FlowStateActive
+	flow.SignalToken = ""
+	flow.NotBefore = time.Time{}
+	err := e.handleStepError(ctx, run, flow, step, fmt.Errorf("Timed out waiting for signal after %s", step.GetTimeout()))
+	e.deleteCounter(ctx, token)
+	return err
+}
+
+// GetDataflow returns the registered dataflow with the given ID, or nil
+func (e *executor) GetDataflow(ID string) *Dataflow {
+	return e.dataflows[ID]
+}
+
+// GetFunction returns the registered function with the given name, or nil
+func (e *executor) GetFunction(name string) Function {
+	return e.functions[name]
+}
+
+func (e *executor) startRun(ctx context.Context, workflow *Dataflow, data interface{}, contentType string, parent *Flow) (*DataflowRun, []error) {
+	if workflow != nil {
+		// before the steps are read, since runs of the dataflow may be
+		// starting concurrently
+		workflow.prepare()
+	}
 	errs := e.Validate(ctx, workflow)
 	if len(errs) > 0 {
 		return nil, errs
@@ -53,7 +286,17 @@ func (e *executor) Start(ctx context.Context, workflow *Dataflow) (*DataflowRun,
 
 	e.Logger.Debugf(ctx, "Dataflow %v started", *workflow)
 
+	// the run is active from the start, so its state is only stored
+	// again when it finishes, see finishRun
 	wr := NewDataflowRun(workflow)
+	wr.State = RunStateActive
+	if parent != nil {
+		wr.ParentRunID = parent.DataflowRunID
+		wr.ParentFlowID = parent.ID
+	}
+	if workflow.Timeout > 0 {
+		wr.Deadline = time.Now().Add(time.Duration(workflow.Timeout))
+	}
 
 	err := e.Storage.StoreDataflowRun(ctx, wr)
 	if err != nil {
@@ -68,22 +311,167 @@ func (e *executor) Start(ctx context.Context, workflow *Dataflow) (*DataflowRun,
 			DataflowRunID: (*wr).ID,
 			NextStepID:    (*workflow).StartAt.GetID(),
 			State:         FlowStateActive,
+			ContentType:   contentType,
 		},
+		Data: data,
 	}
 
 	err = e.enqueueFlow(ctx, &flow)
 	if err != nil {
+		// the flow is not kept when it cannot be enqueued (e.g. the queue
+		// is full), so neither is the run
+		if err := e.Storage.DeleteDataflowRun(ctx, wr.ID); err != nil {
+			e.Logger.Errorf(ctx, "Error deleting dataflow run %s: %s", wr.ID, err.Error())
+		}
 		errs = append(errs, err)
 		return nil, errs
 	}
 
+	if workflow.Timeout > 0 {
+		runID := wr.ID
+		time.AfterFunc(time.Duration(workflow.Timeout), func() {
+			e.timeoutRun(context.Background(), runID)
+		})
+	}
+
 	return wr, errs
 }
 
 // Interrupt marks the workflow run as interrupted so that future flows
-// being dequeued will result in no action
+// being dequeued will result in no action. Flows currently executing a
+// step have their context cancelled.
 func (e *executor) Interrupt(ctx context.Context, run *DataflowRun) {
+	e.Logger.Infof(ctx, "Interrupting dataflow run %s", run.ID)
+	if e.stopRun(ctx, run, RunStateInterrupted, "Dataflow run interrupted") {
+		run.State = RunStateInterrupted
+	}
+}
+
+// timeoutRun stops the run with an error if it is past its deadline
+func (e *executor) timeoutRun(ctx context.Context, runID DataflowRunID) {
+	run := e.retrieveRun(ctx, runID)
+	if run == nil || run.IsFinished() || !run.isPastDeadline() {
+		return
+	}
+
+	e.Logger.Warnf(ctx, "Dataflow run %s timed out", run.ID)
+	e.stopRun(ctx, run, RunStateError, fmt.Sprintf("Dataflow timed out after %s", run.Dataflow.Timeout))
+}
+
+// stopRun sets the final state of a run that has not finished, interrupts
+// its waiting flows and cancels the flows currently executing a step.
+// Returns false if the run was already finished.
+func (e *executor) stopRun(ctx context.Context, run *DataflowRun, state DataflowRunState, message string) bool {
+	finished, err := e.finishRun(ctx, run.ID, state, message)
+	if err != nil {
+		e.Logger.Errorf(ctx, "Error storing dataflow run %s: %s", run.ID, err.Error())
+		return false
+	} else if finished == nil {
+		e.Logger.Warnf(ctx, "Dataflow run %s already finished", run.ID)
+		return false
+	}
+	run = finished
+
+	// waiting flows are not dequeued again (e.g. a signal without a
+	// timeout), so they are interrupted here, after stopping the subflow
+	// runs they are waiting for
+	for _, flow := range e.Storage.RetrieveFlows(ctx, e.Storage.ListFlows(ctx, run.ID)) {
+		if flow.State != FlowStateWaiting {
+			continue
+		}
+		if flow.ChildRunID != "" {
+			if child := e.retrieveRun(ctx, flow.ChildRunID); child != nil {
+				e.stopRun(ctx, child, state, message)
+			}
+		}
+		if err := e.interruptFlow(ctx, flow); err != nil {
+			e.Logger.Errorf(ctx, "Error interrupting flow %s: %s", flow.ID, err.Error())
+		}
+	}
+	e.deleteSplits(ctx, run)
+	if err := e.notifyParentRun(ctx, run); err != nil {
+		e.Logger.Errorf(ctx, "Error resuming parent of dataflow run %s: %s", run.ID, err.Error())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, cancel := range e.cancelFuncs[run.ID] {
+		cancel()
+	}
+	return true
+}
+
+// Recover resumes the runs that were active when a previous executor
+// process stopped, e.g. due to a crash. Active flows are enqueued again,
+// unless the queue is durable and still has them, and the state is
+// updated for finished flows that may not have been accounted for. Flows
+// that were executing a step will execute it again. The queue may already
+// be dequeuing flows: Recover waits for the flows being handled, and flows
+// dequeued meanwhile are handled once it returns.
+func (e *executor) Recover(ctx context.Context) []error {
+	e.recovering.Lock()
+	defer e.recovering.Unlock()
 
+	durable, ok := e.FlowQueue.(DurableFlowQueue)
+	keepsFlows := ok && durable.IsDurable()
+
+	errs := []error{}
+	for _, runID := range e.Storage.ListDataflowRuns(ctx) {
+		run := e.retrieveRun(ctx, runID)
+		if run == nil || run.IsFinished() {
+			continue
+		}
+
+		if run.isPastDeadline() {
+			e.timeoutRun(ctx, runID)
+			continue
+		} else if !run.Deadline.IsZero() {
+			time.AfterFunc(time.Until(run.Deadline), func() {
+				e.timeoutRun(context.Background(), runID)
+			})
+		}
+
+		e.Logger.Infof(ctx, "Recovering dataflow run %s", runID)
+		flows := e.Storage.RetrieveFlows(ctx, e.Storage.ListFlows(ctx, runID))
+		for _, flow := range flows {
+			var err error
+			step := run.Dataflow.GetStep(flow.NextStepID)
+			_, isJoiner := step.(JoinerStep)
+			if _, isSplitter := step.(SplitterStep); isSplitter {
+				// the flow was split, so it did not finish at a step
+				step = nil
+			}
+			switch {
+			case flow.State == FlowStateWaiting && flow.SignalToken != "":
+				if !flow.NotBefore.IsZero() && !keepsFlows {
+					e.Logger.Debugf(ctx, "Recovering timeout of flow %s waiting for signal", flow)
+					err = e.queueSignalTimeout(ctx, flow)
+				}
+			case flow.State == FlowStateWaiting:
+				if child := e.retrieveRun(ctx, flow.ChildRunID); child != nil && child.IsFinished() {
+					e.Logger.Debugf(ctx, "Recovering flow %s waiting for finished subflow", flow)
+					if err = e.resumeFromSubflow(ctx, child); err == nil {
+						e.deleteCounter(ctx, string(child.ID)+":subflow")
+					}
+				}
+			case flow.State == FlowStateActive,
+				isJoiner && (flow.State == FlowStateError || flow.State == FlowStateInterrupted):
+				if !keepsFlows {
+					e.Logger.Debugf(ctx, "Recovering flow %s", flow)
+					err = e.queueFlow(ctx, flow)
+				}
+			case flow.State == FlowStateCompleted, flow.State == FlowStateError, flow.State == FlowStateInterrupted:
+				e.Logger.Debugf(ctx, "Recovering finished flow %s", flow)
+				if err = e.updateDataflowState(ctx, run, flow, step); err == nil && flow.State == FlowStateCompleted {
+					err = e.Storage.DeleteFlow(ctx, flow.ID)
+				}
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Error recovering flow %s: %s", flow.ID, err.Error()))
+			}
+		}
+	}
+	return errs
 }
 
 func (e *executor) GetLogger() Logger {
@@ -98,36 +486,75 @@ func (e *executor) GetHTTPClientFactory() HTTPClientFactory {
 	return e.HTTPClientFactory
 }
 
+// handleFlow is the dequeue callback. Step failures are handled as part of
+// the dataflow, so an error is only returned if the flow could not be
+// handled, e.g. because of a storage or queue failure. Queues that
+// redeliver flows can then retry it.
 func (e *executor) handleFlow(ctx context.Context, flow *Flow) error {
+	e.recovering.RLock()
+	defer e.recovering.RUnlock()
+
 	var err error
 	var dfctx = context.WithValue(ctx, FlowContextKey, flow.ID)
 	dfctx = context.WithValue(dfctx, DataflowRunContextKey, flow.DataflowRunID)
 	e.Logger.Infof(dfctx, "Executor received flow %s", flow)
-	if run, ok := e.Storage.RetrieveDataflowRuns(dfctx, []DataflowRunID{flow.DataflowRunID})[flow.DataflowRunID]; ok {
+	if run := e.retrieveRun(dfctx, flow.DataflowRunID); run != nil {
 		dfctx = context.WithValue(dfctx, StepContextKey, flow.NextStepID)
 		step := run.Dataflow.GetStep(flow.NextStepID)
-		if step == nil {
-			err = fmt.Errorf("step not found in workflow")
+		if run.IsFinished() || run.isPastDeadline() {
+			e.Logger.Infof(dfctx, "Dataflow run is stopped or timed out, dropping flow")
+			e.timeoutRun(ctx, run.ID)
+			return e.interruptFlow(ctx, flow)
+		} else if step == nil {
+			flow.Message = fmt.Sprintf("Step %s not found in workflow", flow.NextStepID)
+			e.Logger.Errorf(dfctx, flow.Message)
+			err = e.failFlow(dfctx, run, flow, nil)
+		} else if flow.State == FlowStateWaiting {
+			e.Logger.Debugf(dfctx, "Wait for signal timed out")
+			err = e.timeoutSignal(dfctx, run, flow, step)
 		} else {
-			if run.State != RunStateActive {
-				run.State = RunStateActive
-				e.Storage.StoreDataflowRun(dfctx, run)
+			// the flow was delayed until now, e.g. by a wait step or a retry,
+			// so the delay does not carry over to the next steps
+			flow.NotBefore = time.Time{}
+
+			// the step context is cancelled if the run is interrupted, and has
+			// the step timeout and the run deadline
+			stepCtx, cancel := e.trackFlow(dfctx, flow)
+			defer cancel()
+			if timeout := step.GetTimeout(); timeout > 0 {
+				stepCtx, cancel = context.WithTimeout(stepCtx, time.Duration(timeout))
+				defer cancel()
+			}
+			if !run.Deadline.IsZero() {
+				stepCtx, cancel = context.WithDeadline(stepCtx, run.Deadline)
+				defer cancel()
 			}
 			switch s := step.(type) {
+			case RouterStep:
+				e.Logger.Debugf(dfctx, "Executor calling Route")
+				var nextID string
+				if nextID, err = s.Route(stepCtx, e, flow); err == nil {
+					err = e.advanceFlowTo(ctx, run, flow, step, nextID)
+				} else {
+					err = e.handleDoError(dfctx, stepCtx, run, flow, step, err)
+				}
 			case DoerStep:
 				e.Logger.Debugf(dfctx, "Executor calling Do")
-				if err = s.Do(dfctx, e, flow); err == nil {
+				if err = s.Do(stepCtx, e, flow); err == nil {
 					err = e.advanceFlow(ctx, run, flow, step)
 				} else {
-					e.Logger.Errorf(dfctx, "Error doing step: %s", err.Error())
-					e.failFlow(dfctx, run, flow, step)
+					err = e.handleDoError(dfctx, stepCtx, run, flow, step, err)
 				}
 			case SplitterStep:
 				e.Logger.Debugf(dfctx, "Executor calling Split")
-				if flows, split, err := s.Split(dfctx, e, flow); err == nil {
-					e.Storage.StoreFlowSplit(ctx, split)
+				if flows, split, splitErr := s.Split(stepCtx, e, flow); splitErr == nil {
+					if err = e.Storage.StoreFlowSplit(ctx, split); err != nil {
+						break
+					}
 					flow.State = FlowStateSplit
-					e.Storage.StoreFlow(ctx, flow)
+					if err = e.Storage.StoreFlow(ctx, flow); err != nil {
+						break
+					}
 					e.GetLogger().Infof(ctx, "Flow %s split into %v", flow.ID, split)
 					for _, f := range flows {
 						// splitter steps are expected to set the next step id of
@@ -138,68 +565,134 @@ func (e *executor) handleFlow(ctx context.Context, flow *Flow) error {
 						}
 					}
 				} else {
-					e.Logger.Errorf(dfctx, "Error splitting step: %s", err.Error())
-					e.failFlow(dfctx, run, flow, step)
+					e.Logger.Errorf(dfctx, "Error splitting step: %s", splitErr.Error())
+					err = e.handleStepError(dfctx, run, flow, step, splitErr)
 				}
 			case JoinerStep:
 				e.Logger.Debugf(dfctx, "Executor calling Join")
-				if joinedFlow, err := s.Join(dfctx, e, flow); joinedFlow != nil {
-					// flows are joined, so clean up
-					if siblings, _, err := flow.getSiblingFlows(ctx, e); err == nil {
-						for _, sibling := range siblings {
-							if sibling.State != FlowStateError {
-								e.Storage.DeleteFlow(ctx, sibling.ID)
-							}
+				if joinedFlow, joinErr := s.Join(stepCtx, e, flow); joinedFlow != nil {
+					// the siblings are read before the joined flow advances,
+					// since the split is deleted if that finishes the run
+					siblings, _, siblingsErr := flow.getSiblingFlows(ctx, e)
+					if joinErr == nil {
+						if joinedFlow.State == FlowStateSplit {
+							joinedFlow.State = FlowStateActive
 						}
-					}
-					if err == nil {
 						err = e.advanceFlow(ctx, run, joinedFlow, step)
 					} else {
 						// join had one or more input flow errors
-						e.Logger.Errorf(dfctx, "Error doing step: %s", err.Error())
-						e.failFlow(dfctx, run, joinedFlow, step)
+						e.Logger.Errorf(dfctx, "Error doing step: %s", joinErr.Error())
+						err = e.handleStepError(dfctx, run, joinedFlow, step, joinErr)
+					}
+					// flows are joined, so clean up
+					if siblingsErr != nil {
+						e.Logger.Errorf(dfctx, "Error retrieving joined flows: %s", siblingsErr.Error())
+					}
+					for _, sibling := range siblings {
+						if sibling.State != FlowStateError {
+							if deleteErr := e.Storage.DeleteFlow(ctx, sibling.ID); deleteErr != nil {
+								e.Logger.Errorf(dfctx, "Error deleting flow %s: %s", sibling.ID, deleteErr.Error())
+							}
+						}
 					}
+				} else if joinErr != nil {
+					err = joinErr
 				}
 			default:
-				err = fmt.Errorf("Step does not support execution")
+				flow.Message = fmt.Sprintf("Step %s does not support execution", step.GetID())
+				e.Logger.Errorf(dfctx, flow.Message)
+				err = e.failFlow(dfctx, run, flow, step)
 			}
 		}
 		if err != nil {
 			e.Logger.Errorf(dfctx, "Step failed: %s", err.Error())
 		}
 	} else {
-		err = fmt.Errorf("Dataflow run not found")
-		e.Logger.Errorf(dfctx, err.Error())
+		// there is nothing to update, so the flow is dropped
+		e.Logger.Errorf(dfctx, "Dataflow run not found, dropping flow")
 	}
 
 	return err
 }
 
+// handleDoError handles the error of a doer or router step: the flow is
+// interrupted if the step was cancelled, retried if the step has a retry
+// policy, or else sent to the step error handling
+func (e *executor) handleDoError(ctx context.Context, stepCtx context.Context, run *DataflowRun, flow *Flow, step Step, stepErr error) error {
+	if stepCtx.Err() == context.Canceled || run.isPastDeadline() {
+		e.Logger.Infof(ctx, "Step cancelled: %s", stepErr.Error())
+		e.timeoutRun(ctx, run.ID)
+		return e.interruptFlow(ctx, flow)
+	}
+	if e.retryFlow(ctx, flow, step, stepErr) {
+		return nil
+	}
+	e.Logger.Errorf(ctx, "Error doing step: %s", stepErr.Error())
+	return e.handleStepError(ctx, run, flow, step, stepErr)
+}
+
+// findJoiner returns the joining step a flow leaving the given step
+// would reach, if any. Splitting steps are not followed since their
+// flows are joined by a different step.
+func findJoiner(workflow *Dataflow, step Step) Step {
+	visited := make(map[string]bool)
+	var find func(step Step) Step
+	find = func(step Step) Step {
+		ids := []string{}
+		if step.GetNextID() != "" {
+			ids = append(ids, step.GetNextID())
+		}
+		if branching, ok := step.(BranchingStep); ok {
+			ids = append(ids, branching.GetBranchIDs()...)
+		}
+		for _, id := range ids {
+			next := workflow.GetStep(id)
+			if next == nil || visited[id] {
+				continue
+			}
+			visited[id] = true
+			if _, ok := next.(JoinerStep); ok {
+				return next
+			} else if _, ok := next.(SplitterStep); !ok {
+				if joiner := find(next); joiner != nil {
+					return joiner
+				}
+			}
+		}
+		return nil
+	}
+
+	if step == nil {
+		return nil
+	}
+	if _, ok := step.(SplitterStep); ok {
+		return nil
+	}
+	return find(step)
+}
+
 // when a flow finishes (completes or errors) this method calculates the
 // new workflow state. If the flow is the root, the workflow is finished.
 // Otherwise recursively calculates the state of the ancestor flows by
 // getting the siblings state, updating the parent flow and repeating if needed.
-// Flows are deleted on normal completion, so siblings are finished if
-// not found, or if all in error.
+// Flows are deleted on normal completion, once the state is updated.
+// Finished flows are counted at most once, so the state can be updated
+// again for flows being recovered.
 func (e *executor) updateDataflowState(ctx context.Context, run *DataflowRun, flow *Flow, step Step) error {
 	currFlow := flow
-	isDataflowError := false
+	isDataflowError := flow.State == FlowStateError
+	var completed []FlowID
 
 	// if the current (finished) flow will reach a joining step, do not handle it here
 	// since the joining step needs to see the flow (e.g. to determine when all
 	// children flows are done)
-	nextID := step.GetNextID()
-	for ; nextID != ""; nextID = step.GetNextID() {
-		step = run.Dataflow.GetStep(nextID)
-		if _, ok := step.(JoinerStep); ok {
-			e.Logger.Debugf(ctx, "Flow advanced to step %s", step.GetID())
-			flow.NextStepID = step.GetID()
-			if err := e.Storage.StoreFlow(ctx, flow); err != nil {
-				return err
-			}
-			err := e.enqueueFlow(ctx, flow)
+	if joiner := findJoiner(run.Dataflow, step); joiner != nil {
+		e.Logger.Debugf(ctx, "Flow advanced to step %s", joiner.GetID())
+		flow.NextStepID = joiner.GetID()
+		if err := e.Storage.StoreFlow(ctx, flow); err != nil {
 			return err
 		}
+		return e.enqueueFlow(ctx, flow)
 	}
 
 	// while current flow is not the root
@@ -209,14 +702,14 @@ func (e *executor) updateDataflowState(ctx context.Context, run *DataflowRun, fl
 			return err
 		}
 
-		var errIncr int64
-		if flow.State == FlowStateError {
-			errIncr = 1
+		// the flow is only counted once, in case it is being recovered
+		_, totalFinish, totalError, err := currFlow.countFinished(ctx, e, split)
+		if err != nil {
+			return err
 		}
-		totalFinish, totalError := e.GetStorage().IncrementWithError(ctx, string(split.ID), 1, errIncr)
 
 		if totalFinish < int64(len(split.FlowIDs)) {
-			return nil // not all siblings are finished
+			return e.deleteFlows(ctx, completed) // not all siblings are finished
 		}
 
 		e.GetLogger().Infof(ctx, "All children flows of %s are finished (%d with error)", split.ParentFlowID, totalError)
@@ -239,27 +732,188 @@ func (e *executor) updateDataflowState(ctx context.Context, run *DataflowRun, fl
 				return err
 			}
 		} else {
+			// completed flows are kept until the state is updated, so they
+			// can be recovered
 			e.GetLogger().Infof(ctx, "Setting %s state to completed", split.ParentFlowID)
 			currFlow.State = FlowStateCompleted
-			if err = e.Storage.DeleteFlow(ctx, currFlow.ID); err != nil {
+			if err = e.Storage.StoreFlow(ctx, currFlow); err != nil {
 				return err
 			}
+			completed = append(completed, currFlow.ID)
 		}
+
+		// splits not joined are only counted here, so their counters are
+		// not needed once all their flows are accounted for
+		e.deleteSplitCounters(ctx, run, split)
+	}
+
+	// if we got this far the workflow is finished, unless it was
+	// interrupted in the meantime
+	state, message := RunStateCompleted, ""
+	if isDataflowError {
+		state, message = RunStateError, "One or more flows finished with errors"
 	}
+	finished, err := e.finishRun(ctx, run.ID, state, message)
+	if err != nil {
+		return err
+	} else if finished == nil {
+		e.GetLogger().Infof(ctx, "Dataflow %s already finished", run.ID)
+		return e.deleteFlows(ctx, completed)
+	}
+	run = finished
 
-	// if we got this far the workflow is finished
 	if isDataflowError {
 		e.GetLogger().Warnf(ctx, "Dataflow %s completed with error", run.ID)
-		run.State = RunStateError
 	} else {
 		e.GetLogger().Infof(ctx, "Dataflow %s completed successfully", run.ID)
-		run.State = RunStateCompleted
 	}
+	e.deleteSplits(ctx, run)
+	if err := e.notifyParentRun(ctx, run); err != nil {
+		return err
+	}
+	return e.deleteFlows(ctx, completed)
+}
+
+// finishRun stores the final state of the run, unless it is already
+// finished, and returns the finished run or nil if it was. Since the run
+// is read before it is stored, concurrent callers (e.g. the last flow of
+// the run and Interrupt) increment a counter so only one of them reads and
+// stores it. The counter is deleted once the run is stored, so the run is
+// read again after incrementing it.
+func (e *executor) finishRun(ctx context.Context, runID DataflowRunID, state DataflowRunState, message string) (*DataflowRun, error) {
+	key := string(runID) + ":finish"
+	if count, err := e.Storage.Increment(ctx, key, 1, 1); err != nil || count != 1 {
+		return nil, err
+	}
+	defer e.deleteCounter(ctx, key)
 
-	return e.Storage.StoreDataflowRun(ctx, run)
+	run := e.retrieveRun(ctx, runID)
+	if run == nil || run.IsFinished() {
+		return nil, nil
+	}
+	run.State = state
+	run.Message = message
+	if err := e.Storage.StoreDataflowRun(ctx, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// notifyParentRun is called when a run started by a subflow step finishes,
+// and resumes the waiting parent flow if it has already been stored. The
+// parent flow and the child run both increment a counter when they are
+// ready, so only the second one resumes the parent.
+func (e *executor) notifyParentRun(ctx context.Context, run *DataflowRun) error {
+	if run.ParentRunID == "" {
+		return nil
+	}
+	return e.rendezvousSubflow(ctx, run.ID)
+}
+
+func (e *executor) rendezvousSubflow(ctx context.Context, childRunID DataflowRunID) error {
+	key := string(childRunID) + ":subflow"
+	if count, err := e.Storage.Increment(ctx, key, 1, 1); err != nil || count != 2 {
+		return err
+	}
+	child := e.retrieveRun(ctx, childRunID)
+	if child == nil {
+		return fmt.Errorf("Subflow run %s not found", childRunID)
+	}
+	if err := e.resumeFromSubflow(ctx, child); err != nil {
+		return err
+	}
+	// both the parent flow and the child run are accounted for
+	e.deleteCounter(ctx, key)
+	return nil
+}
+
+// resumeFromSubflow continues the parent flow of the finished child run
+// with the child's result, or fails it if the child did not complete
+func (e *executor) resumeFromSubflow(ctx context.Context, child *DataflowRun) error {
+	run := e.retrieveRun(ctx, child.ParentRunID)
+	if run == nil {
+		return fmt.Errorf("Dataflow run %s not found", child.ParentRunID)
+	}
+	flow, ok := e.Storage.RetrieveFlows(ctx, []FlowID{child.ParentFlowID})[child.ParentFlowID]
+	if !ok {
+		return fmt.Errorf("Flow with ID %s not found", child.ParentFlowID)
+	}
+	if flow.State != FlowStateWaiting || flow.ChildRunID != child.ID {
+		return nil
+	}
+
+	e.Logger.Infof(ctx, "Subflow run %s finished with state %s, resuming flow %s", child.ID, child.State, flow.ID)
+	flow.ChildRunID = ""
+	if run.IsFinished() {
+		return e.interruptFlow(ctx, flow)
+	}
+
+	flow.State = FlowStateActive
+	step := run.Dataflow.GetStep(flow.NextStepID)
+	if child.State != RunStateCompleted {
+		stepErr := fmt.Errorf("Subflow run %s finished with state %s: %s", child.ID, child.State, child.Message)
+		return e.handleStepError(ctx, run, flow, step, stepErr)
+	}
+	flow.Data, flow.ContentType = child.GetResult()
+	return e.advanceFlow(ctx, run, flow, step)
+}
+
+// deleteSplits deletes the splits of a finished run and their counters
+func (e *executor) deleteSplits(ctx context.Context, run *DataflowRun) {
+	splitIDs := e.Storage.ListFlowSplits(ctx, run.ID)
+	for _, split := range e.Storage.RetrieveFlowSplits(ctx, splitIDs) {
+		e.deleteSplitCounters(ctx, run, split)
+		if err := e.Storage.DeleteFlowSplit(ctx, split.ID); err != nil {
+			e.Logger.Errorf(ctx, "Error deleting flow split %s: %s", split.ID, err.Error())
+		}
+	}
+}
+
+// deleteSplitCounters deletes the counters of the flows finished within
+// the split, including those of the race steps
+func (e *executor) deleteSplitCounters(ctx context.Context, run *DataflowRun, split *FlowSplit) {
+	keys := []string{string(split.ID)}
+	for _, flowID := range split.FlowIDs {
+		keys = append(keys, string(split.ID)+":"+string(flowID))
+	}
+	for _, step := range run.Dataflow.Steps {
+		if _, ok := step.(*RaceStep); ok {
+			keys = append(keys, step.GetID()+":"+string(split.ID))
+		}
+	}
+	for _, key := range keys {
+		e.deleteCounter(ctx, key)
+	}
+}
+
+// deleteCounter deletes a counter that is no longer needed, logging errors
+// since the counter is only left behind
+func (e *executor) deleteCounter(ctx context.Context, key string) {
+	if err := e.Storage.DeleteCounter(ctx, key); err != nil {
+		e.Logger.Errorf(ctx, "Error deleting counter %s: %s", key, err.Error())
+	}
+}
+
+func (e *executor) deleteFlows(ctx context.Context, flowIDs []FlowID) error {
+	for _, flowID := range flowIDs {
+		if err := e.Storage.DeleteFlow(ctx, flowID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (e *executor) advanceFlow(ctx context.Context, run *DataflowRun, flow *Flow, step Step) (err error) {
+	var nextID string
+	if step != nil {
+		nextID = step.GetNextID()
+	}
+	return e.advanceFlowTo(ctx, run, flow, step, nextID)
+}
+
+// advanceFlowTo is like advanceFlow but sends the flow to the given step
+// instead of the next step
+func (e *executor) advanceFlowTo(ctx context.Context, run *DataflowRun, flow *Flow, step Step, nextID string) (err error) {
 	if flow.State == FlowStateInterrupted {
 		// flow can be interrupted e.g. by a conditional. in that case
 		// we don't need to advance it, but we need to update workflow state
@@ -271,28 +925,72 @@ func (e *executor) advanceFlow(ctx context.Context, run *DataflowRun, flow *Flow
 		return err
 	}
 
+	if flow.State == FlowStateWaiting {
+		// the flow stays at the step until it is resumed. NotBefore of a
+		// flow waiting for a signal is the signal deadline, so it is only
+		// set if the step has a timeout.
+		if flow.SignalToken != "" {
+			flow.NotBefore = time.Time{}
+			if timeout := step.GetTimeout(); timeout > 0 {
+				flow.NotBefore = time.Now().Add(time.Duration(timeout))
+			}
+		}
+		if err = e.Storage.StoreFlow(ctx, flow); err != nil {
+			return err
+		}
+		if flow.ChildRunID != "" {
+			return e.rendezvousSubflow(ctx, flow.ChildRunID)
+		} else if !flow.NotBefore.IsZero() {
+			return e.queueSignalTimeout(ctx, flow)
+		}
+		return nil
+	}
+
 	if step != nil {
 		flow.PreviousStepID = step.GetID()
-		flow.NextStepID = step.GetNextID()
+		flow.NextStepID = nextID
+		flow.Attempts = 0
+		if step.GetKeepOutput() {
+			e.keepOutput(ctx, run, flow, step.GetID())
+		}
 	} // else the flow is already setup for next step
 
 	if flow.NextStepID != "" {
 		err = e.enqueueFlow(ctx, flow)
 	} else {
+		if step == nil || !step.GetKeepOutput() {
+			e.keepOutput(ctx, run, flow, flow.PreviousStepID)
+		}
 		flow.State = FlowStateCompleted
-		if err = e.Storage.DeleteFlow(ctx, flow.ID); err != nil {
+		if err = e.Storage.StoreFlow(ctx, flow); err != nil {
 			return err
 		}
-		err = e.updateDataflowState(ctx, run, flow, step)
+		if err = e.updateDataflowState(ctx, run, flow, step); err == nil {
+			err = e.Storage.DeleteFlow(ctx, flow.ID)
+		}
 	}
 
 	return err
 }
 
+// keepOutput copies the flow data to the run outputs
+func (e *executor) keepOutput(ctx context.Context, run *DataflowRun, flow *Flow, stepID string) {
+	if stepID == "" {
+		return
+	}
+	key := flow.getOutputKey(ctx, e)
+
+	e.Logger.Debugf(ctx, "Kept output of step %s with key '%s'", stepID, key)
+	output := &FlowOutput{ContentType: flow.ContentType, Data: flow.Data}
+	if err := e.Storage.StoreFlowOutput(ctx, run.ID, stepID, key, output); err != nil {
+		e.Logger.Errorf(ctx, "Error storing output of step %s: %s", stepID, err.Error())
+	}
+}
+
 func (e *executor) enqueueFlow(ctx context.Context, flow *Flow) error {
 	err := e.Storage.StoreFlow(ctx, flow)
 	if err == nil {
-		err = e.FlowQueue.Enqueue(ctx, flow)
+		err = e.queueFlow(ctx, flow)
 		if err != nil {
 			e.Logger.Errorf(ctx, "Error enqueuing flow %s: %s", flow, err.Error())
 			e.Storage.DeleteFlow(ctx, flow.ID)
@@ -302,6 +1000,76 @@ func (e *executor) enqueueFlow(ctx context.Context, flow *Flow) error {
 	return err
 }
 
+// queueFlow enqueues a stored flow, delayed until its NotBefore time if set
+func (e *executor) queueFlow(ctx context.Context, flow *Flow) error {
+	if delay := time.Until(flow.NotBefore); delay > 0 {
+		return e.FlowQueue.EnqueueAfter(ctx, flow, delay)
+	}
+	return e.FlowQueue.Enqueue(ctx, flow)
+}
+
+// retryFlow re-enqueues the flow after a delay if the step has a retry
+// policy that applies to the error, and there are attempts left. Returns
+// true if the flow will be retried.
+func (e *executor) retryFlow(ctx context.Context, flow *Flow, step Step, stepErr error) bool {
+	policy := step.GetRetry()
+	if policy == nil || !policy.isRetryable(stepErr) {
+		return false
+	}
+
+	flow.Attempts++
+	if flow.Attempts >= policy.MaxAttempts {
+		e.Logger.Warnf(ctx, "Attempt %d of %d failed: %s. No attempts left", flow.Attempts, policy.MaxAttempts, stepErr.Error())
+		return false
+	}
+
+	delay := policy.getInterval(flow.Attempts)
+	e.Logger.Warnf(ctx, "Attempt %d of %d failed: %s. Retrying in %s", flow.Attempts, policy.MaxAttempts, stepErr.Error(), delay)
+	flow.NotBefore = time.Now().Add(delay)
+	if err := e.enqueueFlow(ctx, flow); err != nil {
+		e.Logger.Errorf(ctx, "Error enqueuing flow for retry: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// handleStepError sends the flow to the step's error handler if it has
+// one, otherwise it fails the flow
+func (e *executor) handleStepError(ctx context.Context, run *DataflowRun, flow *Flow, step Step, stepErr error) error {
+	onErrorID := step.GetOnErrorID()
+	handleErrorAs := step.GetHandleErrorAs()
+	if onErrorID == "" && handleErrorAs == nil {
+		flow.Message = stepErr.Error()
+		return e.failFlow(ctx, run, flow, step)
+	}
+
+	if handleErrorAs != nil {
+		flow.Data = handleErrorAs
+	} else {
+		stepError := StepError{StepID: step.GetID(), Message: stepErr.Error()}
+		var httpErr *HTTPError
+		if errors.As(stepErr, &httpErr) {
+			stepError.StatusCode = httpErr.StatusCode
+		}
+		errorJSON, err := json.Marshal(stepError)
+		if err != nil {
+			return err
+		}
+		flow.Data = json.RawMessage(errorJSON)
+	}
+	flow.ContentType = "application/json"
+	flow.State = FlowStateActive
+	flow.Attempts = 0
+	flow.PreviousStepID = step.GetID()
+	flow.NextStepID = onErrorID
+	if onErrorID == "" {
+		flow.NextStepID = step.GetNextID()
+	}
+
+	e.Logger.Warnf(ctx, "Step %s error handled, flow continues at '%s'", step.GetID(), flow.NextStepID)
+	return e.advanceFlow(ctx, run, flow, nil)
+}
+
 func (e *executor) failFlow(ctx context.Context, run *DataflowRun, flow *Flow, step Step) error {
 	var err error
 	flow.State = FlowStateError
@@ -311,3 +1079,47 @@ func (e *executor) failFlow(ctx context.Context, run *DataflowRun, flow *Flow, s
 
 	return e.updateDataflowState(ctx, run, flow, step)
 }
+
+// interruptFlow marks the flow of a stopped run as interrupted
+func (e *executor) interruptFlow(ctx context.Context, flow *Flow) error {
+	flow.State = FlowStateInterrupted
+	if err := e.Storage.StoreFlow(ctx, flow); err != nil {
+		return err
+	}
+	// the run is stopped, so the flow is not needed to update its state
+	return e.Storage.DeleteFlow(ctx, flow.ID)
+}
+
+// retrieveRun returns the run with the given ID, or nil if not found
+func (e *executor) retrieveRun(ctx context.Context, runID DataflowRunID) *DataflowRun {
+	if run, ok := e.Storage.RetrieveDataflowRuns(ctx, []DataflowRunID{runID})[runID]; ok {
+		return run
+	}
+	return nil
+}
+
+// trackFlow returns a cancellable context for the flow, which is cancelled if
+// the flow's run is interrupted. The returned cancel function must be called
+// when the flow is done executing its step.
+func (e *executor) trackFlow(ctx context.Context, flow *Flow) (context.Context, context.CancelFunc) {
+	flowCtx, cancel := context.WithCancel(ctx)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	flows, ok := e.cancelFuncs[flow.DataflowRunID]
+	if !ok {
+		flows = make(map[FlowID]context.CancelFunc)
+		e.cancelFuncs[flow.DataflowRunID] = flows
+	}
+	flows[flow.ID] = cancel
+
+	return flowCtx, func() {
+		cancel()
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(flows, flow.ID)
+		if len(flows) == 0 {
+			delete(e.cancelFuncs, flow.DataflowRunID)
+		}
+	}
+}
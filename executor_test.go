@@ -0,0 +1,927 @@
+package stepflow_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+	"github.com/jcalvarado1965/go-stepflow/inprocess"
+)
+
+// testExecutor is an executor with memory storage and queue
+type testExecutor struct {
+	stepflow.Executor
+	storage stepflow.Storage
+	queue   *inprocess.MemoryQueue
+}
+
+var testLogger = inprocess.NewLeveledConsoleLogger(inprocess.LevelWarn, ioutil.Discard)
+
+func newTestExecutor(t *testing.T, options ...stepflow.ExecutorOption) *testExecutor {
+	return newTestExecutorWithStorage(t, inprocess.NewMemoryStorage(testLogger), 4, options...)
+}
+
+// newTestExecutorWithStorage creates an executor on the given storage,
+// e.g. to recover the runs of another executor
+func newTestExecutorWithStorage(t *testing.T, storage stepflow.Storage, numWorkers int, options ...stepflow.ExecutorOption) *testExecutor {
+	queue := inprocess.NewMemoryQueue(testLogger, numWorkers).(*inprocess.MemoryQueue)
+	t.Cleanup(func() { queue.Stop(context.Background()) })
+	exec := stepflow.NewExecutor(inprocess.NewHTTPClientFactory(), testLogger, storage, queue, options...)
+	return &testExecutor{Executor: exec, storage: storage, queue: queue}
+}
+
+// drain stops the queue once the flows queued have been handled
+func (te *testExecutor) drain(t *testing.T) {
+	wg, err := te.queue.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("Queue could not be stopped: %s", err.Error())
+	}
+	wg.Wait()
+}
+
+// waitForRun waits until the run is finished, and returns it
+func (te *testExecutor) waitForRun(t *testing.T, runID stepflow.DataflowRunID) *stepflow.DataflowRun {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		run := te.storage.RetrieveDataflowRuns(context.Background(), []stepflow.DataflowRunID{runID})[runID]
+		if run != nil && run.IsFinished() {
+			return run
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Run %s did not finish, last read %v", runID, run)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (te *testExecutor) start(t *testing.T, dataflow *stepflow.Dataflow) *stepflow.DataflowRun {
+	run, errs := te.Start(context.Background(), dataflow)
+	if len(errs) > 0 {
+		t.Fatalf("Run could not be started: %v", errs)
+	}
+	return run
+}
+
+// waitForFlow waits until the run has a flow in the given state, and
+// returns it
+func (te *testExecutor) waitForFlow(t *testing.T, runID stepflow.DataflowRunID, state stepflow.FlowState) *stepflow.Flow {
+	ctx := context.Background()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, flow := range te.storage.RetrieveFlows(ctx, te.storage.ListFlows(ctx, runID)) {
+			if flow.State == state {
+				return flow
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Run %s has no flow in state %s", runID, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// isCounterDeleted returns true if the counter with the given key does
+// not exist, i.e. it starts again from its initial value
+func (te *testExecutor) isCounterDeleted(key string) bool {
+	ctx := context.Background()
+	value, _ := te.storage.Increment(ctx, key, 1000, 1)
+	isDeleted := value == 1000
+	te.storage.DeleteCounter(ctx, key)
+	return isDeleted
+}
+
+func readDataflow(t *testing.T, dataflowJSON string) *stepflow.Dataflow {
+	var df stepflow.Dataflow
+	if err := json.Unmarshal([]byte(dataflowJSON), &df); err != nil {
+		t.Fatalf("Dataflow could not be read: %s", err.Error())
+	}
+	return &df
+}
+
+// resultJSON returns the result of the run marshalled as compact JSON
+func resultJSON(t *testing.T, run *stepflow.DataflowRun) string {
+	data, _ := run.GetResult()
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("Result could not be marshalled: %s", err.Error())
+	}
+	return string(bytes)
+}
+
+func TestDistributeJoinDeletesFlows(t *testing.T) {
+	values := make([]int, 200)
+	for i := range values {
+		values[i] = i
+	}
+	valuesJSON, _ := json.Marshal(values)
+
+	te := newTestExecutor(t, stepflow.WithFunctions(map[string]stepflow.Function{
+		"double": stepflow.JSONFunction(func(ctx context.Context, data interface{}) (interface{}, error) {
+			return data.(float64) * 2, nil
+		}),
+	}))
+	df := readDataflow(t, fmt.Sprintf(`{
+		"id": "DistributeJoin",
+		"startAt": "values",
+		"steps": [
+			{"id": "values", "type": "constant", "next": "distribute", "value": %s},
+			{"id": "distribute", "type": "distribute", "next": "double"},
+			{"id": "double", "type": "function", "function": "double", "next": "join"},
+			{"id": "join", "type": "join"}
+		]
+	}`, valuesJSON))
+
+	run := te.waitForRun(t, te.start(t, df).ID)
+	te.drain(t)
+	if run.State != stepflow.RunStateCompleted {
+		t.Fatalf("Expected completed run, got %s: %s", run.State, run.Message)
+	}
+	var result []int
+	if err := json.Unmarshal([]byte(resultJSON(t, run)), &result); err != nil || len(result) != len(values) || result[len(values)-1] != 2*values[len(values)-1] {
+		t.Errorf("Expected doubled values, got %s", resultJSON(t, run))
+	}
+
+	ctx := context.Background()
+	if flowIDs := te.storage.ListFlows(ctx, run.ID); len(flowIDs) != 0 {
+		t.Errorf("Expected no flows left, got %d", len(flowIDs))
+	}
+	if splitIDs := te.storage.ListFlowSplits(ctx, run.ID); len(splitIDs) != 0 {
+		t.Errorf("Expected no splits left, got %v", splitIDs)
+	}
+}
+
+func TestBroadcastBuiltInCode(t *testing.T) {
+	te := newTestExecutor(t)
+	run := te.waitForRun(t, te.start(t, newBroadcastDataflow()).ID)
+	if run.State != stepflow.RunStateCompleted {
+		t.Fatalf("Expected completed run, got %s: %s", run.State, run.Message)
+	}
+	if result := resultJSON(t, run); result != `{"left":"left","right":"right"}` {
+		t.Errorf("Expected the broadcast outputs keyed by step, got %s", result)
+	}
+}
+
+const signalDataflow = `{
+	"id": "Signal",
+	"startAt": "wait",
+	"steps": [
+		{"id": "wait", "type": "wait-for-signal", "next": "echo"},
+		{"id": "echo", "type": "function", "function": "echo"}
+	]
+}`
+
+var echoFunctions = stepflow.WithFunctions(map[string]stepflow.Function{
+	"echo": func(ctx context.Context, flow *stepflow.Flow) error { return nil },
+})
+
+func TestSignal(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t, echoFunctions)
+	run := te.start(t, readDataflow(t, signalDataflow))
+	token := te.waitForFlow(t, run.ID, stepflow.FlowStateWaiting).SignalToken
+
+	if err := te.Signal(ctx, token, "approved", "text/plain"); err != nil {
+		t.Fatalf("Signal could not be sent: %s", err.Error())
+	}
+	run = te.waitForRun(t, run.ID)
+	if data, _ := run.GetResult(); run.State != stepflow.RunStateCompleted || data != "approved" {
+		t.Errorf("Expected run completed with the signal data, got %s run with %v", run.State, data)
+	}
+	if err := te.Signal(ctx, token, "again", "text/plain"); err == nil {
+		t.Errorf("Expected an error sending the signal twice")
+	}
+	if !te.isCounterDeleted(token) {
+		t.Errorf("Expected the counter of token %s deleted", token)
+	}
+}
+
+func TestSignalNotEnqueued(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t, echoFunctions)
+	run := te.start(t, readDataflow(t, signalDataflow))
+	token := te.waitForFlow(t, run.ID, stepflow.FlowStateWaiting).SignalToken
+
+	// the flow cannot be enqueued once the queue is stopped
+	te.drain(t)
+	if err := te.Signal(ctx, token, "approved", "text/plain"); err == nil {
+		t.Fatalf("Expected an error signalling with a stopped queue")
+	}
+	flow := te.waitForFlow(t, run.ID, stepflow.FlowStateWaiting)
+	if flow.SignalToken != token || flow.Data != nil {
+		t.Errorf("Expected the flow still waiting for token %s, got %v", token, flow)
+	}
+	if !te.isCounterDeleted(token) {
+		t.Errorf("Expected the counter of token %s deleted, so the signal can be sent again", token)
+	}
+}
+
+func TestSubflow(t *testing.T) {
+	ctx := context.Background()
+	child := readDataflow(t, `{
+		"id": "Child",
+		"startAt": "constant",
+		"steps": [{"id": "constant", "type": "constant", "value": {"from": "child"}}]
+	}`)
+	te := newTestExecutor(t, stepflow.WithDataflows(child))
+	run := te.start(t, readDataflow(t, `{
+		"id": "Parent",
+		"startAt": "subflow",
+		"steps": [{"id": "subflow", "type": "subflow", "dataflowId": "Child"}]
+	}`))
+
+	run = te.waitForRun(t, run.ID)
+	if result := resultJSON(t, run); run.State != stepflow.RunStateCompleted || result != `{"from":"child"}` {
+		t.Errorf("Expected run completed with the child result, got %s run with %s", run.State, result)
+	}
+	for _, childRun := range te.storage.RetrieveDataflowRuns(ctx, te.storage.ListDataflowRuns(ctx)) {
+		if childRun.ParentRunID == run.ID && !te.isCounterDeleted(string(childRun.ID)+":subflow") {
+			t.Errorf("Expected the counter of subflow run %s deleted", childRun.ID)
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan bool)
+	cancelled := make(chan bool, 1)
+	te := newTestExecutor(t, stepflow.WithFunctions(map[string]stepflow.Function{
+		"block": func(ctx context.Context, flow *stepflow.Flow) error {
+			close(started)
+			<-ctx.Done()
+			cancelled <- true
+			return ctx.Err()
+		},
+	}))
+	run := te.start(t, readDataflow(t, `{
+		"id": "Block",
+		"startAt": "block",
+		"steps": [
+			{"id": "block", "type": "function", "function": "block", "next": "constant"},
+			{"id": "constant", "type": "constant", "value": 1}
+		]
+	}`))
+	if run.State != stepflow.RunStateActive {
+		t.Errorf("Expected the started run active, got %s", run.State)
+	}
+
+	<-started
+	te.Interrupt(ctx, run)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Step not cancelled by the interrupt")
+	}
+	te.drain(t)
+
+	run = te.waitForRun(t, run.ID)
+	if run.State != stepflow.RunStateInterrupted {
+		t.Errorf("Expected interrupted run, got %s", run.State)
+	}
+	if _, ok := run.Outputs["constant"]; ok {
+		t.Errorf("Expected no output of the step after the interrupt, got %v", run.Outputs)
+	}
+	if flowIDs := te.storage.ListFlows(ctx, run.ID); len(flowIDs) != 0 {
+		t.Errorf("Expected the interrupted flows deleted, got %v", flowIDs)
+	}
+	if !te.isCounterDeleted(string(run.ID) + ":finish") {
+		t.Errorf("Expected the counter finishing the run deleted")
+	}
+}
+
+func TestChoice(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t)
+	df := readDataflow(t, `{
+		"id": "Choice",
+		"startAt": "choice",
+		"steps": [
+			{"id": "choice", "type": "choice", "default": "other",
+				"choices": [{"condition": "[$.age] > 30", "next": "older"}]},
+			{"id": "older", "type": "constant", "value": "older"},
+			{"id": "other", "type": "constant", "value": "other"}
+		]
+	}`)
+	for input, expected := range map[string]string{`{"age": 40}`: `"older"`, `{"age": 20}`: `"other"`} {
+		run, errs := te.StartWithInput(ctx, df, json.RawMessage(input), "application/json")
+		if len(errs) > 0 {
+			t.Fatalf("Run could not be started: %v", errs)
+		}
+		run = te.waitForRun(t, run.ID)
+		if result := resultJSON(t, run); result != expected {
+			t.Errorf("Expected %s for input %s, got %s", expected, input, result)
+		}
+	}
+}
+
+func TestChoiceBuiltInCode(t *testing.T) {
+	older := &stepflow.ConstantStep{BaseStep: stepflow.BaseStep{ID: "older"}, Value: json.RawMessage(`"older"`)}
+	other := &stepflow.ConstantStep{BaseStep: stepflow.BaseStep{ID: "other"}, Value: json.RawMessage(`"other"`)}
+	choice := &stepflow.ChoiceStep{
+		BaseStep: stepflow.BaseStep{ID: "choice"},
+		Choices:  []*stepflow.ChoiceRule{{Condition: "[$.age] > 30", Next: older}},
+		Default:  other,
+	}
+	te := newTestExecutor(t)
+	run, errs := te.StartWithInput(context.Background(), &stepflow.Dataflow{
+		ID:      "Choice",
+		StartAt: choice,
+		Steps:   []stepflow.Step{choice, older, other},
+	}, json.RawMessage(`{"age": 20}`), "application/json")
+	if len(errs) > 0 {
+		t.Fatalf("Run could not be started: %v", errs)
+	}
+	run = te.waitForRun(t, run.ID)
+	if result := resultJSON(t, run); run.State != stepflow.RunStateCompleted || result != `"other"` {
+		t.Errorf("Expected run completed with the default step output, got %s run with %s", run.State, result)
+	}
+}
+
+func TestChoiceWithoutNext(t *testing.T) {
+	te := newTestExecutor(t)
+	df := readDataflow(t, `{
+		"id": "Choice",
+		"startAt": "choice",
+		"steps": [{"id": "choice", "type": "choice", "choices": [{"condition": "[$.age] > 30"}]}]
+	}`)
+	errs := te.Validate(context.Background(), df)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "has no next step") {
+		t.Errorf("Expected the choice without next step reported, got %v", errs)
+	}
+}
+
+func TestChoiceWithoutChoices(t *testing.T) {
+	te := newTestExecutor(t)
+	df := readDataflow(t, `{
+		"id": "Choice",
+		"startAt": "choice",
+		"steps": [
+			{"id": "choice", "type": "choice", "default": "other"},
+			{"id": "other", "type": "constant", "value": "other"}
+		]
+	}`)
+	errs := te.Validate(context.Background(), df)
+	if len(errs) != 1 || errs[0].Error() != "Choice step choice has no choices" {
+		t.Errorf("Expected the choice step without choices reported, got %v", errs)
+	}
+}
+
+func TestSubflowCycles(t *testing.T) {
+	subflowTo := func(id string, childIDs ...string) string {
+		steps := []string{}
+		for i, childID := range childIDs {
+			next := ""
+			if i < len(childIDs)-1 {
+				next = fmt.Sprintf(`, "next": "subflow%d"`, i+1)
+			}
+			steps = append(steps, fmt.Sprintf(`{"id": "subflow%d", "type": "subflow", "dataflowId": "%s"%s}`, i, childID, next))
+		}
+		return fmt.Sprintf(`{"id": "%s", "startAt": "subflow0", "steps": [%s]}`, id, strings.Join(steps, ", "))
+	}
+	constant := `{"id": "Constant", "startAt": "constant", "steps": [{"id": "constant", "type": "constant", "value": 1}]}`
+
+	tests := []struct {
+		name      string
+		dataflows []string
+		cycles    int
+	}{
+		{"itself", []string{subflowTo("Self", "Self")}, 1},
+		{"through another", []string{subflowTo("Start", "Other"), subflowTo("Other", "Start")}, 1},
+		{"inline", []string{`{"id": "Start", "startAt": "inline", "steps": [
+			{"id": "inline", "type": "subflow", "dataflow": ` + subflowTo("Inline", "Start") + `}
+		]}`}, 1},
+		{"same child twice", []string{subflowTo("Start", "Constant", "Constant"), constant}, 0},
+	}
+
+	for _, test := range tests {
+		dataflows := []*stepflow.Dataflow{}
+		for _, dataflowJSON := range test.dataflows {
+			dataflows = append(dataflows, readDataflow(t, dataflowJSON))
+		}
+		te := newTestExecutor(t, stepflow.WithDataflows(dataflows...))
+		cycles := 0
+		for _, err := range te.Validate(context.Background(), dataflows[0]) {
+			if strings.Contains(err.Error(), "creates a cycle") {
+				cycles++
+			} else {
+				t.Errorf("%s: unexpected validation error %s", test.name, err.Error())
+			}
+		}
+		if cycles != test.cycles {
+			t.Errorf("%s: expected %d subflow cycles, got %d", test.name, test.cycles, cycles)
+		}
+	}
+}
+
+func TestStartWithInput(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t, stepflow.WithFunctions(map[string]stepflow.Function{
+		"describe": func(ctx context.Context, flow *stepflow.Flow) error {
+			flow.Data = fmt.Sprintf("%s %v", flow.ContentType, flow.Data)
+			flow.ContentType = "text/plain"
+			return nil
+		},
+	}))
+	df := readDataflow(t, `{
+		"id": "Input",
+		"startAt": "describe",
+		"steps": [{"id": "describe", "type": "function", "function": "describe"}]
+	}`)
+
+	tests := []struct {
+		data        interface{}
+		contentType string
+		expected    string
+	}{
+		{"hello", "text/plain", "text/plain hello"},
+		{json.RawMessage(`{"a":1}`), "application/json", `application/json {"a":1}`},
+		{nil, "", " <nil>"},
+	}
+	for _, test := range tests {
+		run, errs := te.StartWithInput(ctx, df, test.data, test.contentType)
+		if len(errs) > 0 {
+			t.Fatalf("Run could not be started: %v", errs)
+		}
+		run = te.waitForRun(t, run.ID)
+		if data, _ := run.GetResult(); data != test.expected {
+			t.Errorf("Expected the step to get %q, got %q", test.expected, data)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		retry    string
+		failures int
+		state    stepflow.DataflowRunState
+		calls    int32
+	}{
+		{"succeeds on retry", `{"maxAttempts": 3, "initialInterval": "1ms", "backoffMultiplier": 2}`, 2, stepflow.RunStateCompleted, 3},
+		{"no attempts left", `{"maxAttempts": 2, "initialInterval": "1ms"}`, 5, stepflow.RunStateError, 2},
+		{"error not retried", `{"maxAttempts": 3, "initialInterval": "1ms", "retryOnError": ["temporary"]}`, 1, stepflow.RunStateError, 1},
+	}
+
+	for _, test := range tests {
+		var calls int32
+		te := newTestExecutor(t, stepflow.WithFunctions(map[string]stepflow.Function{
+			"flaky": func(ctx context.Context, flow *stepflow.Flow) error {
+				atomic.AddInt32(&calls, 1)
+				if flow.Attempts < test.failures {
+					return fmt.Errorf("permanent failure %d", flow.Attempts)
+				}
+				return nil
+			},
+		}))
+		run := te.waitForRun(t, te.start(t, readDataflow(t, `{
+			"id": "Retry",
+			"startAt": "flaky",
+			"steps": [{"id": "flaky", "type": "function", "function": "flaky", "retry": `+test.retry+`}]
+		}`)).ID)
+
+		if run.State != test.state {
+			t.Errorf("%s: expected %s run, got %s: %s", test.name, test.state, run.State, run.Message)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != test.calls {
+			t.Errorf("%s: expected %d calls, got %d", test.name, test.calls, calls)
+		}
+	}
+}
+
+var failFunctions = stepflow.WithFunctions(map[string]stepflow.Function{
+	"fail": func(ctx context.Context, flow *stepflow.Flow) error { return errors.New("Step failed") },
+})
+
+func TestOnError(t *testing.T) {
+	te := newTestExecutor(t, failFunctions, echoFunctions)
+	run := te.waitForRun(t, te.start(t, readDataflow(t, `{
+		"id": "OnError",
+		"startAt": "fail",
+		"steps": [
+			{"id": "fail", "type": "function", "function": "fail", "next": "unreached", "onError": "handler"},
+			{"id": "unreached", "type": "constant", "value": "unreached"},
+			{"id": "handler", "type": "function", "function": "echo", "keepOutput": true}
+		]
+	}`)).ID)
+
+	if run.State != stepflow.RunStateCompleted {
+		t.Fatalf("Expected the handled error to complete the run, got %s: %s", run.State, run.Message)
+	}
+	if result := resultJSON(t, run); result != `{"stepId":"fail","message":"Step failed"}` {
+		t.Errorf("Expected the step error passed to the handler, got %s", result)
+	}
+}
+
+func TestHandleErrorAs(t *testing.T) {
+	tests := []struct {
+		name    string
+		onError string
+		stepID  string
+	}{
+		{"with onError", `, "onError": "handler"`, "handler"},
+		{"without onError", ``, "next"},
+	}
+	handler := `{"id": "handler", "type": "function", "function": "echo", "keepOutput": true}`
+
+	for _, test := range tests {
+		steps := ""
+		if test.onError != "" {
+			steps = ", " + handler
+		}
+		te := newTestExecutor(t, failFunctions, echoFunctions)
+		run := te.waitForRun(t, te.start(t, readDataflow(t, `{
+			"id": "HandleErrorAs",
+			"startAt": "fail",
+			"steps": [
+				{"id": "fail", "type": "function", "function": "fail", "next": "next", "handleErrorAs": {"fallback": true}`+test.onError+`},
+				{"id": "next", "type": "function", "function": "echo", "keepOutput": true}`+steps+`
+			]
+		}`)).ID)
+
+		if run.State != stepflow.RunStateCompleted {
+			t.Fatalf("%s: expected completed run, got %s: %s", test.name, run.State, run.Message)
+		}
+		if _, ok := run.Outputs[test.stepID]; !ok || len(run.Outputs) != 1 {
+			t.Errorf("%s: expected only the output of step %s, got %v", test.name, test.stepID, run.Outputs)
+		}
+		if result := resultJSON(t, run); result != `{"fallback":true}` {
+			t.Errorf("%s: expected the handleErrorAs data, got %s", test.name, result)
+		}
+	}
+}
+
+var blockFunctions = stepflow.WithFunctions(map[string]stepflow.Function{
+	"block": func(ctx context.Context, flow *stepflow.Flow) error {
+		<-ctx.Done()
+		return ctx.Err()
+	},
+})
+
+func TestStepTimeout(t *testing.T) {
+	te := newTestExecutor(t, blockFunctions, echoFunctions)
+	run := te.waitForRun(t, te.start(t, readDataflow(t, `{
+		"id": "StepTimeout",
+		"startAt": "block",
+		"steps": [
+			{"id": "block", "type": "function", "function": "block", "timeout": "20ms", "onError": "handler"},
+			{"id": "handler", "type": "function", "function": "echo", "keepOutput": true}
+		]
+	}`)).ID)
+
+	if result := resultJSON(t, run); !strings.Contains(result, "deadline exceeded") {
+		t.Errorf("Expected the step failed by its timeout, got %s run with %s", run.State, result)
+	}
+}
+
+func TestRunDeadline(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t, blockFunctions)
+	run := te.start(t, readDataflow(t, `{
+		"id": "RunDeadline",
+		"startAt": "block",
+		"timeout": "50ms",
+		"steps": [
+			{"id": "block", "type": "function", "function": "block", "next": "wait"},
+			{"id": "wait", "type": "wait-for-signal"}
+		]
+	}`))
+	if run.Deadline.IsZero() {
+		t.Errorf("Expected the run deadline set")
+	}
+
+	run = te.waitForRun(t, run.ID)
+	if run.State != stepflow.RunStateError || !strings.Contains(run.Message, "timed out") {
+		t.Errorf("Expected the run timed out, got %s run: %s", run.State, run.Message)
+	}
+	// the executing step is cancelled, so the flow does not continue
+	te.drain(t)
+	if flowIDs := te.storage.ListFlows(ctx, run.ID); len(flowIDs) != 0 {
+		t.Errorf("Expected no flows left after the timeout, got %v", flowIDs)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	ctx := context.Background()
+	df := readDataflow(t, `{
+		"id": "Recover",
+		"startAt": "values",
+		"steps": [
+			{"id": "values", "type": "constant", "next": "distribute", "value": [1, 2, 3]},
+			{"id": "distribute", "type": "distribute", "next": "echo"},
+			{"id": "echo", "type": "function", "function": "echo", "next": "join"},
+			{"id": "join", "type": "join"}
+		]
+	}`)
+
+	// without workers the flow is never handled, and it is lost when the
+	// queue stops, as if the process stopped
+	stopped := newTestExecutorWithStorage(t, inprocess.NewMemoryStorage(testLogger), 0, echoFunctions)
+	run := stopped.start(t, df)
+	stopped.drain(t)
+
+	te := newTestExecutorWithStorage(t, stopped.storage, 4, echoFunctions)
+	if errs := te.Recover(ctx); len(errs) > 0 {
+		t.Fatalf("Runs could not be recovered: %v", errs)
+	}
+	run = te.waitForRun(t, run.ID)
+	if result := resultJSON(t, run); run.State != stepflow.RunStateCompleted || result != `[1,2,3]` {
+		t.Errorf("Expected the recovered run completed, got %s run with %s", run.State, result)
+	}
+
+	// finished runs are not recovered again
+	te.drain(t)
+	if errs := te.Recover(ctx); len(errs) > 0 {
+		t.Errorf("Expected nothing to recover, got %v", errs)
+	}
+}
+
+func TestLoop(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t, stepflow.WithFunctions(map[string]stepflow.Function{
+		"increment": stepflow.JSONFunction(func(ctx context.Context, data interface{}) (interface{}, error) {
+			return data.(float64) + 1, nil
+		}),
+	}))
+	tests := []struct {
+		name      string
+		condition string
+		state     stepflow.DataflowRunState
+		result    string
+	}{
+		{"condition", "iteration < 3", stepflow.RunStateCompleted, "4"},
+		{"max iterations", "iteration >= 0", stepflow.RunStateError, ""},
+	}
+
+	for _, test := range tests {
+		df := readDataflow(t, `{
+			"id": "Loop",
+			"startAt": "loop",
+			"steps": [
+				{"id": "loop", "type": "loop", "condition": "`+test.condition+`", "body": "increment", "next": "done", "maxIterations": 5},
+				{"id": "increment", "type": "function", "function": "increment", "next": "loop"},
+				{"id": "done", "type": "function", "function": "increment"}
+			]
+		}`)
+		run, errs := te.StartWithInput(ctx, df, json.RawMessage(`0`), "application/json")
+		if len(errs) > 0 {
+			t.Fatalf("Run could not be started: %v", errs)
+		}
+		run = te.waitForRun(t, run.ID)
+		if run.State != test.state {
+			t.Errorf("%s: expected %s run, got %s: %s", test.name, test.state, run.State, run.Message)
+		} else if result := resultJSON(t, run); test.result != "" && result != test.result {
+			t.Errorf("%s: expected %s after 3 iterations and the next step, got %s", test.name, test.result, result)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t, echoFunctions)
+	tests := []struct {
+		name string
+		wait string
+	}{
+		{"duration", `"duration": "50ms"`},
+		{"until", `"until": "$.at"`},
+	}
+
+	for _, test := range tests {
+		df := readDataflow(t, `{
+			"id": "Wait",
+			"startAt": "wait",
+			"steps": [
+				{"id": "wait", "type": "wait", `+test.wait+`, "next": "echo"},
+				{"id": "echo", "type": "function", "function": "echo"}
+			]
+		}`)
+		notBefore := time.Now().Add(50 * time.Millisecond)
+		input := `{"at":"` + notBefore.Format(time.RFC3339Nano) + `"}`
+		run, errs := te.StartWithInput(ctx, df, json.RawMessage(input), "application/json")
+		if len(errs) > 0 {
+			t.Fatalf("Run could not be started: %v", errs)
+		}
+		run = te.waitForRun(t, run.ID)
+		if now := time.Now(); now.Before(notBefore) {
+			t.Errorf("%s: expected the flow delayed until %s, finished at %s", test.name, notBefore, now)
+		}
+		if result := resultJSON(t, run); run.State != stepflow.RunStateCompleted || result != input {
+			t.Errorf("%s: expected completed run with the input data, got %s run with %s", test.name, run.State, result)
+		}
+	}
+}
+
+func TestFunction(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t, failFunctions, stepflow.WithFunctions(map[string]stepflow.Function{
+		"greet": stepflow.JSONFunction(func(ctx context.Context, data interface{}) (interface{}, error) {
+			return map[string]interface{}{"greeting": "hello " + data.(map[string]interface{})["name"].(string)}, nil
+		}),
+	}))
+	df := readDataflow(t, `{
+		"id": "Function",
+		"startAt": "greet",
+		"steps": [{"id": "greet", "type": "function", "function": "greet"}]
+	}`)
+	run, errs := te.StartWithInput(ctx, df, json.RawMessage(`{"name": "world"}`), "application/json")
+	if len(errs) > 0 {
+		t.Fatalf("Run could not be started: %v", errs)
+	}
+	run = te.waitForRun(t, run.ID)
+	if result := resultJSON(t, run); run.State != stepflow.RunStateCompleted || result != `{"greeting":"hello world"}` {
+		t.Errorf("Expected completed run with the function result, got %s run with %s", run.State, result)
+	}
+
+	// a function error fails the flow
+	run = te.waitForRun(t, te.start(t, readDataflow(t, `{
+		"id": "Fail",
+		"startAt": "fail",
+		"steps": [{"id": "fail", "type": "function", "function": "fail"}]
+	}`)).ID)
+	if run.State != stepflow.RunStateError {
+		t.Errorf("Expected the run failed by the function, got %s", run.State)
+	}
+
+	errs = te.Validate(ctx, readDataflow(t, `{
+		"id": "Unregistered",
+		"startAt": "unknown",
+		"steps": [{"id": "unknown", "type": "function", "function": "unknown"}]
+	}`))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "not registered") {
+		t.Errorf("Expected the unregistered function reported, got %v", errs)
+	}
+}
+
+// signalAfterDelay checks the flow waits for the signal, even though it
+// was delayed before reaching the wait-for-signal step, and signals it
+func (te *testExecutor) signalAfterDelay(t *testing.T, run *stepflow.DataflowRun) {
+	token := te.waitForFlow(t, run.ID, stepflow.FlowStateWaiting).SignalToken
+	time.Sleep(50 * time.Millisecond)
+	current := te.storage.RetrieveDataflowRuns(context.Background(), []stepflow.DataflowRunID{run.ID})[run.ID]
+	if current.IsFinished() {
+		t.Fatalf("Expected the run waiting for the signal, got %s run: %s", current.State, current.Message)
+	}
+
+	if err := te.Signal(context.Background(), token, "approved", "text/plain"); err != nil {
+		t.Fatalf("Signal could not be sent: %s", err.Error())
+	}
+	if run = te.waitForRun(t, run.ID); run.State != stepflow.RunStateCompleted {
+		t.Errorf("Expected completed run, got %s: %s", run.State, run.Message)
+	}
+}
+
+func TestWaitThenSignal(t *testing.T) {
+	te := newTestExecutor(t, echoFunctions)
+	te.signalAfterDelay(t, te.start(t, readDataflow(t, `{
+		"id": "WaitThenSignal",
+		"startAt": "constant",
+		"steps": [
+			{"id": "constant", "type": "constant", "value": 1, "next": "wait"},
+			{"id": "wait", "type": "wait", "duration": "10ms", "next": "signal"},
+			{"id": "signal", "type": "wait-for-signal", "next": "echo"},
+			{"id": "echo", "type": "function", "function": "echo"}
+		]
+	}`)))
+}
+
+func TestRetryThenSignal(t *testing.T) {
+	te := newTestExecutor(t, echoFunctions, stepflow.WithFunctions(map[string]stepflow.Function{
+		"failOnce": func(ctx context.Context, flow *stepflow.Flow) error {
+			if flow.Attempts == 0 {
+				return errors.New("Step failed")
+			}
+			return nil
+		},
+	}))
+	te.signalAfterDelay(t, te.start(t, readDataflow(t, `{
+		"id": "RetryThenSignal",
+		"startAt": "failOnce",
+		"steps": [
+			{"id": "failOnce", "type": "function", "function": "failOnce", "next": "signal",
+				"retry": {"maxAttempts": 2, "initialInterval": "10ms"}},
+			{"id": "signal", "type": "wait-for-signal", "next": "echo"},
+			{"id": "echo", "type": "function", "function": "echo"}
+		]
+	}`)))
+}
+
+func TestWaitClearsNotBefore(t *testing.T) {
+	te := newTestExecutor(t, stepflow.WithFunctions(map[string]stepflow.Function{
+		"checkNotBefore": func(ctx context.Context, flow *stepflow.Flow) error {
+			if !flow.NotBefore.IsZero() {
+				return fmt.Errorf("Flow still delayed until %s", flow.NotBefore)
+			}
+			return nil
+		},
+	}))
+	run := te.waitForRun(t, te.start(t, readDataflow(t, `{
+		"id": "WaitClearsNotBefore",
+		"startAt": "wait",
+		"steps": [
+			{"id": "wait", "type": "wait", "duration": "10ms", "next": "check"},
+			{"id": "check", "type": "function", "function": "checkNotBefore"}
+		]
+	}`)).ID)
+	if run.State != stepflow.RunStateCompleted {
+		t.Errorf("Expected the delay cleared once the flow is delivered, got %s run: %s", run.State, run.Message)
+	}
+}
+
+func TestJoinOrderedBySplitIndex(t *testing.T) {
+	te := newTestExecutor(t, stepflow.WithFunctions(map[string]stepflow.Function{
+		// the first elements finish last
+		"delay": stepflow.JSONFunction(func(ctx context.Context, data interface{}) (interface{}, error) {
+			time.Sleep(time.Duration(5-data.(float64)) * 10 * time.Millisecond)
+			return data, nil
+		}),
+	}))
+	run := te.waitForRun(t, te.start(t, readDataflow(t, `{
+		"id": "JoinOrder",
+		"startAt": "values",
+		"steps": [
+			{"id": "values", "type": "constant", "next": "distribute", "value": [1, 2, 3, 4]},
+			{"id": "distribute", "type": "distribute", "next": "delay"},
+			{"id": "delay", "type": "function", "function": "delay", "next": "join"},
+			{"id": "join", "type": "join"}
+		]
+	}`)).ID)
+	if result := resultJSON(t, run); run.State != stepflow.RunStateCompleted || result != `[1,2,3,4]` {
+		t.Errorf("Expected the joined values in split order, got %s run with %s", run.State, result)
+	}
+}
+
+func TestJoinPlaceholders(t *testing.T) {
+	tests := []struct {
+		placeholders bool
+		expected     string
+	}{
+		{false, `[{"n":3},{"n":4}]`},
+		{true, `[null,null,{"n":3},{"n":4}]`},
+	}
+
+	for _, test := range tests {
+		te := newTestExecutor(t)
+		run := te.waitForRun(t, te.start(t, readDataflow(t, fmt.Sprintf(`{
+			"id": "Placeholders",
+			"startAt": "values",
+			"steps": [
+				{"id": "values", "type": "constant", "next": "distribute", "value": [{"n": 1}, {"n": 2}, {"n": 3}, {"n": 4}]},
+				{"id": "distribute", "type": "distribute", "next": "conditional"},
+				{"id": "conditional", "type": "conditional", "condition": "[$.n] > 2", "next": "join"},
+				{"id": "join", "type": "join", "placeholders": %t}
+			]
+		}`, test.placeholders))).ID)
+		if result := resultJSON(t, run); run.State != stepflow.RunStateCompleted || result != test.expected {
+			t.Errorf("Expected %s with placeholders %t, got %s run with %s", test.expected, test.placeholders, run.State, result)
+		}
+	}
+}
+
+func TestLoopRouteBuiltInCode(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t)
+	done := &stepflow.ConstantStep{BaseStep: stepflow.BaseStep{ID: "done"}}
+	body := &stepflow.ConstantStep{BaseStep: stepflow.BaseStep{ID: "body"}}
+	loop := &stepflow.LoopStep{BaseStep: stepflow.BaseStep{ID: "loop", Next: done}, Body: body, Condition: "iteration < 1", MaxIterations: 5}
+
+	// the IDs are not set, so the loop routes to the steps
+	flow := &stepflow.Flow{Data: json.RawMessage(`{}`), FlowNoData: stepflow.FlowNoData{ContentType: "application/json"}}
+	for _, expected := range []string{"body", "done"} {
+		nextID, err := loop.Route(ctx, te, flow)
+		if err != nil {
+			t.Fatalf("Loop could not route the flow: %s", err.Error())
+		}
+		if nextID != expected {
+			t.Errorf("Expected the flow routed to %s, got '%s'", expected, nextID)
+		}
+	}
+}
+
+func TestConditionNumericZero(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t)
+	df := readDataflow(t, `{
+		"id": "Zero",
+		"startAt": "conditional",
+		"steps": [
+			{"id": "conditional", "type": "conditional", "condition": "[$.count]", "next": "constant"},
+			{"id": "constant", "type": "constant", "value": "continued"}
+		]
+	}`)
+	for input, continues := range map[string]bool{`{"count": 0}`: false, `{"count": 2}`: true} {
+		run, errs := te.StartWithInput(ctx, df, json.RawMessage(input), "application/json")
+		if len(errs) > 0 {
+			t.Fatalf("Run could not be started: %v", errs)
+		}
+		run = te.waitForRun(t, run.ID)
+		if _, ok := run.Outputs["constant"]; ok != continues {
+			t.Errorf("Expected the flow to continue %t with %s, got outputs %v", continues, input, run.Outputs)
+		}
+	}
+}
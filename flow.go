@@ -2,8 +2,13 @@ package stepflow
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // FlowState represents the state of a flow
@@ -16,6 +21,7 @@ const (
 	FlowStateCompleted   FlowState = "Completed"   // flow dead-ended
 	FlowStateSplit       FlowState = "Split"       // there are child flows
 	FlowStateInterrupted FlowState = "Interrupted" // e.g. from a conditional
+	FlowStateWaiting     FlowState = "Waiting"     // e.g. for a subflow run or a signal
 )
 
 // FlowSplitIndexType represents the type of flow split index (key or numerical)
@@ -49,11 +55,16 @@ type FlowNoData struct {
 	PreviousStepID string
 	NextStepID     string
 	State          FlowState
-	Message        string        // if State is Error, this has the explanation
-	ContentType    string        // content type of data
-	Splits         []FlowSplitID // identifies the splits that led to this flow
-	SplitKey       string        // if the current split is from dictionary, the key
-	SplitIndex     int           // if the current split is from array, the index
+	Message        string         // if State is Error, this has the explanation
+	ContentType    string         // content type of data
+	Splits         []FlowSplitID  // identifies the splits that led to this flow
+	SplitKey       string         // if the current split is from dictionary, the key
+	SplitIndex     int            // if the current split is from array, the index
+	Attempts       int            // failed attempts at the next step, if retried
+	Iterations     map[string]int // iterations of the loops the flow is in, by loop step ID
+	ChildRunID     DataflowRunID  // if State is Waiting for a subflow, the child run
+	SignalToken    string         // if State is Waiting for a signal, the token to resume it
+	NotBefore      time.Time      // if set, the flow is not dequeued before this time
 }
 
 // Flow represents an execution unit for a workflow
@@ -66,6 +77,18 @@ type Flow struct {
 	Data       interface{} // if State is Completed, this has the result
 }
 
+// FlowDataFromBytes converts raw bytes to the flow data representation
+// used for the given content type: text is a string, JSON is a
+// json.RawMessage and anything else is kept as bytes
+func FlowDataFromBytes(contentType string, data []byte) interface{} {
+	if strings.HasPrefix(strings.ToLower(contentType), "text/") {
+		return string(data)
+	} else if contentType == "application/json" {
+		return json.RawMessage(data)
+	}
+	return data
+}
+
 func (f *Flow) isRoot() bool {
 	return len(f.Splits) == 0
 }
@@ -84,6 +107,47 @@ func (f *Flow) getLastSplit(ctx context.Context, exec Executor) (*FlowSplit, err
 	return split, nil
 }
 
+// markFinished records that the flow finished within the given split.
+// Returns false if it was already recorded (e.g. the flow is being
+// recovered), in which case it must not be counted again.
+func (f *Flow) markFinished(ctx context.Context, exec Executor, splitID FlowSplitID) (bool, error) {
+	count, err := exec.GetStorage().Increment(ctx, f.finishedKey(splitID), 1, 1)
+	return count == 1, err
+}
+
+// unmarkFinished deletes the record of markFinished, when the flow could
+// not be counted, so it is counted when handled again
+func (f *Flow) unmarkFinished(ctx context.Context, exec Executor, splitID FlowSplitID) {
+	if err := exec.GetStorage().DeleteCounter(ctx, f.finishedKey(splitID)); err != nil {
+		exec.GetLogger().Errorf(ctx, "Error deleting counter %s: %s", f.finishedKey(splitID), err.Error())
+	}
+}
+
+func (f *Flow) finishedKey(splitID FlowSplitID) string {
+	return string(splitID) + ":" + string(f.ID)
+}
+
+// countFinished adds the flow to the counts of finished flows (and flows
+// finished with error) of the split, unless it was already counted, and
+// returns the counts. isFirst is false if it was already counted.
+func (f *Flow) countFinished(ctx context.Context, exec Executor, split *FlowSplit) (isFirst bool, totalFinish int64, totalError int64, err error) {
+	if isFirst, err = f.markFinished(ctx, exec, split.ID); err != nil {
+		return false, 0, 0, err
+	}
+	var incr, errIncr int64
+	if isFirst {
+		incr = 1
+		if f.State == FlowStateError {
+			errIncr = 1
+		}
+	}
+	totalFinish, totalError, err = exec.GetStorage().IncrementWithError(ctx, string(split.ID), incr, errIncr)
+	if err != nil && isFirst {
+		f.unmarkFinished(ctx, exec, split.ID)
+	}
+	return isFirst, totalFinish, totalError, err
+}
+
 func (f *Flow) getSiblingFlows(ctx context.Context, exec Executor) ([]*Flow, *FlowSplit, error) {
 	var split *FlowSplit
 	var err error
@@ -93,14 +157,47 @@ func (f *Flow) getSiblingFlows(ctx context.Context, exec Executor) ([]*Flow, *Fl
 
 	flowMap := exec.GetStorage().RetrieveFlows(ctx, split.FlowIDs)
 
+	// keep the order of the split, flows missing from storage are skipped
 	flows := []*Flow{}
-	for _, flow := range flowMap {
-		flows = append(flows, flow)
+	for _, flowID := range split.FlowIDs {
+		if flow, ok := flowMap[flowID]; ok {
+			flows = append(flows, flow)
+		}
+	}
+	if split.IndexType == FlowSplitNumericalIndex {
+		sort.SliceStable(flows, func(i, j int) bool {
+			return flows[i].SplitIndex < flows[j].SplitIndex
+		})
 	}
 	return flows, split, nil
 }
 
+// getOutputKey returns the split keys and/or indexes leading to this flow,
+// from the outermost split to the innermost, joined by "/"
+func (f *Flow) getOutputKey(ctx context.Context, exec Executor) string {
+	var keys []string
+	for curr := f; !curr.isRoot(); {
+		split, err := curr.getLastSplit(ctx, exec)
+		if err != nil {
+			break
+		}
+
+		key := curr.SplitKey
+		if split.IndexType == FlowSplitNumericalIndex {
+			key = strconv.Itoa(curr.SplitIndex)
+		}
+		keys = append([]string{key}, keys...)
+
+		parent, ok := exec.GetStorage().RetrieveFlows(ctx, []FlowID{split.ParentFlowID})[split.ParentFlowID]
+		if !ok {
+			break
+		}
+		curr = parent
+	}
+	return strings.Join(keys, "/")
+}
+
 func (f *Flow) String() string {
-	return fmt.Sprintf("{ID: %s, DataflowRunID: %s, PreviousStepID: %s, NextStepID: %s, State: %s, Message: %s, ContentType: %s, Splits: %v, SplitKey: %s, SplitIndex: %d}",
-		f.ID, f.DataflowRunID, f.PreviousStepID, f.NextStepID, f.State, f.Message, f.ContentType, f.Splits, f.SplitKey, f.SplitIndex)
+	return fmt.Sprintf("{ID: %s, DataflowRunID: %s, PreviousStepID: %s, NextStepID: %s, State: %s, Message: %s, ContentType: %s, Splits: %v, SplitKey: %s, SplitIndex: %d, Attempts: %d, Iterations: %v}",
+		f.ID, f.DataflowRunID, f.PreviousStepID, f.NextStepID, f.State, f.Message, f.ContentType, f.Splits, f.SplitKey, f.SplitIndex, f.Attempts, f.Iterations)
 }
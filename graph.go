@@ -0,0 +1,262 @@
+package stepflow
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GraphFormat is the output format of RenderGraph
+type GraphFormat string
+
+// These are the supported graph formats
+const (
+	GraphDOT     GraphFormat = "dot"
+	GraphMermaid GraphFormat = "mermaid"
+)
+
+// GraphOptions control how RenderGraph draws a dataflow. If Run is set,
+// steps are colored by the state of the run: steps with outputs are
+// completed, and steps where Flows (the flows of the run, see
+// Storage.ListFlows) are waiting, active or failed are colored as such.
+type GraphOptions struct {
+	Run   *DataflowRun
+	Flows []*Flow
+}
+
+// renderEdge is an edge of the rendered graph
+type renderEdge struct {
+	to      string
+	label   string
+	isError bool
+}
+
+var dotShapes = map[StepType]string{
+	TypeWebMethod:     "box",
+	TypeFunction:      "component",
+	TypeDistribute:    "invtrapezium",
+	TypeBroadcast:     "invtrapezium",
+	TypeJoin:          "trapezium",
+	TypeRace:          "trapezium",
+	TypeConditional:   "diamond",
+	TypeChoice:        "diamond",
+	TypeLoop:          "hexagon",
+	TypeSelect:        "parallelogram",
+	TypeConstant:      "note",
+	TypeSubflow:       "box3d",
+	TypeWait:          "octagon",
+	TypeWaitForSignal: "octagon",
+}
+
+// mermaid shapes are given as the opening and closing brackets
+var mermaidShapes = map[StepType][2]string{
+	TypeWebMethod:     {"[", "]"},
+	TypeFunction:      {"(", ")"},
+	TypeDistribute:    {"[/", "\\]"},
+	TypeBroadcast:     {"[/", "\\]"},
+	TypeJoin:          {"[\\", "/]"},
+	TypeRace:          {"[\\", "/]"},
+	TypeConditional:   {"{", "}"},
+	TypeChoice:        {"{", "}"},
+	TypeLoop:          {"{{", "}}"},
+	TypeSelect:        {"[/", "/]"},
+	TypeConstant:      {">", "]"},
+	TypeSubflow:       {"[[", "]]"},
+	TypeWait:          {"((", "))"},
+	TypeWaitForSignal: {"((", "))"},
+}
+
+var stateColors = map[FlowState]string{
+	FlowStateCompleted:   "palegreen",
+	FlowStateActive:      "lightblue",
+	FlowStateWaiting:     "gold",
+	FlowStateError:       "salmon",
+	FlowStateInterrupted: "lightgrey",
+}
+
+// RenderGraph returns the dataflow graph in the given format. Nodes are
+// shaped by step type, and edges are labeled with conditions.
+func RenderGraph(workflow *Dataflow, format GraphFormat, options *GraphOptions) (string, error) {
+	if options == nil {
+		options = &GraphOptions{}
+	}
+	states := getStepStates(options)
+	switch format {
+	case GraphDOT:
+		return renderDOT(workflow, states), nil
+	case GraphMermaid:
+		return renderMermaid(workflow, states), nil
+	}
+	return "", fmt.Errorf("Graph format not recognized: %s", format)
+}
+
+func renderDOT(workflow *Dataflow, states map[string]FlowState) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(workflow.ID))
+	if workflow.StartAt != nil {
+		b.WriteString("  \"__start\" [shape=point];\n")
+		fmt.Fprintf(&b, "  \"__start\" -> %s;\n", dotQuote(workflow.StartAt.GetID()))
+	}
+	for _, step := range workflow.Steps {
+		shape, ok := dotShapes[step.GetType()]
+		if !ok {
+			shape = "box"
+		}
+		fmt.Fprintf(&b, "  %s [shape=%s, label=%s", dotQuote(step.GetID()), shape, dotQuote(getNodeLabel(step)))
+		if color, ok := stateColors[states[step.GetID()]]; ok {
+			fmt.Fprintf(&b, ", style=filled, fillcolor=%s", color)
+		}
+		b.WriteString("];\n")
+	}
+	for _, step := range workflow.Steps {
+		for _, edge := range getRenderEdges(step) {
+			fmt.Fprintf(&b, "  %s -> %s", dotQuote(step.GetID()), dotQuote(edge.to))
+			attrs := []string{}
+			if edge.label != "" {
+				attrs = append(attrs, "label="+dotQuote(edge.label))
+			}
+			if edge.isError {
+				attrs = append(attrs, "style=dashed", "color=red")
+			}
+			if len(attrs) > 0 {
+				fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ", "))
+			}
+			b.WriteString(";\n")
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func renderMermaid(workflow *Dataflow, states map[string]FlowState) string {
+	// step IDs can clash with mermaid keywords, so nodes are numbered
+	nodeIDs := make(map[string]string)
+	for i, step := range workflow.Steps {
+		nodeIDs[step.GetID()] = fmt.Sprintf("s%d", i)
+	}
+
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	if workflow.StartAt != nil {
+		b.WriteString("  start((\"start\"))\n")
+		fmt.Fprintf(&b, "  start --> %s\n", nodeIDs[workflow.StartAt.GetID()])
+	}
+	for _, step := range workflow.Steps {
+		shape, ok := mermaidShapes[step.GetType()]
+		if !ok {
+			shape = [2]string{"[", "]"}
+		}
+		fmt.Fprintf(&b, "  %s%s%s%s\n", nodeIDs[step.GetID()], shape[0], mermaidQuote(getNodeLabel(step)), shape[1])
+		if color, ok := stateColors[states[step.GetID()]]; ok {
+			fmt.Fprintf(&b, "  style %s fill:%s\n", nodeIDs[step.GetID()], color)
+		}
+	}
+	for _, step := range workflow.Steps {
+		for _, edge := range getRenderEdges(step) {
+			to, ok := nodeIDs[edge.to]
+			if !ok {
+				continue
+			}
+			arrow := "-->"
+			if edge.isError {
+				arrow = "-.->"
+			}
+			if edge.label != "" {
+				fmt.Fprintf(&b, "  %s %s|%s| %s\n", nodeIDs[step.GetID()], arrow, mermaidQuote(edge.label), to)
+			} else {
+				fmt.Fprintf(&b, "  %s %s %s\n", nodeIDs[step.GetID()], arrow, to)
+			}
+		}
+	}
+	return b.String()
+}
+
+// getNodeLabel returns the step ID and type, and the URL of web methods
+func getNodeLabel(step Step) string {
+	label := fmt.Sprintf("%s\n(%s)", step.GetID(), step.GetType())
+	if web, ok := step.(*WebMethodStep); ok {
+		label += fmt.Sprintf("\n%s %s", web.Method, web.URL)
+	}
+	return label
+}
+
+// getRenderEdges returns the transitions out of a step, labeled with the
+// conditions that lead to them
+func getRenderEdges(step Step) []renderEdge {
+	edges := []renderEdge{}
+	switch s := step.(type) {
+	case *ConditionalStep:
+		if nextID := s.GetNextID(); nextID != "" {
+			edges = append(edges, renderEdge{to: nextID, label: s.Condition})
+		}
+	case *ChoiceStep:
+		for _, choice := range s.Choices {
+			edges = append(edges, renderEdge{to: choice.getNextID(), label: choice.Condition})
+		}
+		if defaultID := s.getDefaultID(); defaultID != "" {
+			edges = append(edges, renderEdge{to: defaultID, label: "default"})
+		}
+	case *LoopStep:
+		edges = append(edges, renderEdge{to: s.getBodyID(), label: s.Condition})
+		if nextID := s.GetNextID(); nextID != "" {
+			edges = append(edges, renderEdge{to: nextID, label: "done"})
+		}
+	default:
+		if nextID := step.GetNextID(); nextID != "" {
+			edges = append(edges, renderEdge{to: nextID})
+		}
+		if branching, ok := step.(BranchingStep); ok {
+			for _, id := range branching.GetBranchIDs() {
+				edges = append(edges, renderEdge{to: id})
+			}
+		}
+	}
+	if onErrorID := step.GetOnErrorID(); onErrorID != "" {
+		edges = append(edges, renderEdge{to: onErrorID, label: "error", isError: true})
+	}
+	return edges
+}
+
+// getStepStates returns the state to color each step with
+func getStepStates(options *GraphOptions) map[string]FlowState {
+	states := make(map[string]FlowState)
+	if options.Run == nil {
+		return states
+	}
+
+	for stepID := range options.Run.Outputs {
+		states[stepID] = FlowStateCompleted
+	}
+	// a step with flows in different states is colored by the most relevant
+	priority := map[FlowState]int{
+		FlowStateCompleted:   1,
+		FlowStateInterrupted: 2,
+		FlowStateActive:      3,
+		FlowStateWaiting:     4,
+		FlowStateError:       5,
+	}
+	for _, flow := range options.Flows {
+		if flow.PreviousStepID != "" && states[flow.PreviousStepID] == "" {
+			states[flow.PreviousStepID] = FlowStateCompleted
+		}
+		state := flow.State
+		if state == FlowStateSplit {
+			// the flow was split by the step
+			state = FlowStateCompleted
+		}
+		if flow.NextStepID != "" && priority[state] > priority[states[flow.NextStepID]] {
+			states[flow.NextStepID] = state
+		}
+	}
+	return states
+}
+
+func dotQuote(text string) string {
+	text = strings.Replace(text, "\\", "\\\\", -1)
+	text = strings.Replace(text, "\"", "\\\"", -1)
+	return "\"" + strings.Replace(text, "\n", "\\n", -1) + "\""
+}
+
+func mermaidQuote(text string) string {
+	text = strings.Replace(text, "\"", "#quot;", -1)
+	return "\"" + strings.Replace(text, "\n", "<br/>", -1) + "\""
+}
@@ -0,0 +1,132 @@
+package stepflow_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+// newBroadcastDataflow builds a dataflow in code, setting the steps
+// instead of their IDs
+func newBroadcastDataflow() *stepflow.Dataflow {
+	join := &stepflow.JoinStep{BaseStep: stepflow.BaseStep{ID: "join"}}
+	left := &stepflow.ConstantStep{BaseStep: stepflow.BaseStep{ID: "left", Next: join}, Value: json.RawMessage(`"left"`)}
+	right := &stepflow.ConstantStep{BaseStep: stepflow.BaseStep{ID: "right", Next: join}, Value: json.RawMessage(`"right"`)}
+	broadcast := &stepflow.BroadcastStep{BaseStep: stepflow.BaseStep{ID: "broadcast"}, ForwardTo: []stepflow.Step{left, right}}
+	return &stepflow.Dataflow{
+		ID:      "Broadcast",
+		StartAt: broadcast,
+		Steps:   []stepflow.Step{broadcast, left, right, join},
+	}
+}
+
+func TestGraphOfDataflowBuiltInCode(t *testing.T) {
+	df := newBroadcastDataflow()
+	if errs := stepflow.ValidateGraph(df); len(errs) > 0 {
+		t.Errorf("Expected no validation errors, got %v", errs)
+	}
+
+	dot, err := stepflow.RenderGraph(df, stepflow.GraphDOT, nil)
+	if err != nil {
+		t.Fatalf("Graph could not be rendered: %s", err.Error())
+	}
+	for _, edge := range []string{`"broadcast" -> "left"`, `"broadcast" -> "right"`, `"left" -> "join"`} {
+		if !strings.Contains(dot, edge) {
+			t.Errorf("Expected edge %s in graph:\n%s", edge, dot)
+		}
+	}
+}
+
+const graphDataflow = `{
+	"id": "Graph",
+	"startAt": "choose",
+	"steps": [
+		{"id": "choose", "type": "choice", "choices": [{"condition": "[$.n] > 2", "next": "call"}], "default": "wait"},
+		{"id": "call", "type": "web-method", "method": "GET", "url": "http://example.com/\"n\"", "onError": "handle"},
+		{"id": "wait", "type": "wait-for-signal"},
+		{"id": "handle", "type": "constant", "value": "handled"}
+	]
+}`
+
+const graphMermaid = `flowchart TD
+  start(("start"))
+  start --> s0
+  s0{"choose<br/>(choice)"}
+  s1["call<br/>(web-method)<br/>GET http://example.com/#quot;n#quot;"]
+  s2(("wait<br/>(wait-for-signal)"))
+  s3>"handle<br/>(constant)"]
+  s0 -->|"[$.n] > 2"| s1
+  s0 -->|"default"| s2
+  s1 -.->|"error"| s3
+`
+
+func TestRenderMermaid(t *testing.T) {
+	df := readDataflow(t, graphDataflow)
+	graph, err := stepflow.RenderGraph(df, stepflow.GraphMermaid, nil)
+	if err != nil {
+		t.Fatalf("Graph could not be rendered: %s", err.Error())
+	}
+	if graph != graphMermaid {
+		t.Errorf("Expected graph:\n%s\ngot:\n%s", graphMermaid, graph)
+	}
+}
+
+func TestRenderRunState(t *testing.T) {
+	df := readDataflow(t, graphDataflow)
+	run := stepflow.NewDataflowRun(df)
+	run.Outputs = map[string]map[string]*stepflow.FlowOutput{
+		"handle": {"": {ContentType: "application/json", Data: "handled"}},
+	}
+	// choose is completed since flows left it, and call is colored by
+	// its failed flow rather than the active one
+	flows := []*stepflow.Flow{
+		{FlowNoData: stepflow.FlowNoData{ID: "flow-1", PreviousStepID: "choose", NextStepID: "wait", State: stepflow.FlowStateWaiting}},
+		{FlowNoData: stepflow.FlowNoData{ID: "flow-2", PreviousStepID: "choose", NextStepID: "call", State: stepflow.FlowStateActive}},
+		{FlowNoData: stepflow.FlowNoData{ID: "flow-3", PreviousStepID: "choose", NextStepID: "call", State: stepflow.FlowStateError}},
+	}
+
+	tests := []struct {
+		format   stepflow.GraphFormat
+		expected string
+	}{
+		{stepflow.GraphMermaid, `flowchart TD
+  start(("start"))
+  start --> s0
+  s0{"choose<br/>(choice)"}
+  style s0 fill:palegreen
+  s1["call<br/>(web-method)<br/>GET http://example.com/#quot;n#quot;"]
+  style s1 fill:salmon
+  s2(("wait<br/>(wait-for-signal)"))
+  style s2 fill:gold
+  s3>"handle<br/>(constant)"]
+  style s3 fill:palegreen
+  s0 -->|"[$.n] > 2"| s1
+  s0 -->|"default"| s2
+  s1 -.->|"error"| s3
+`},
+		{stepflow.GraphDOT, `digraph "Graph" {
+  "__start" [shape=point];
+  "__start" -> "choose";
+  "choose" [shape=diamond, label="choose\n(choice)", style=filled, fillcolor=palegreen];
+  "call" [shape=box, label="call\n(web-method)\nGET http://example.com/\"n\"", style=filled, fillcolor=salmon];
+  "wait" [shape=octagon, label="wait\n(wait-for-signal)", style=filled, fillcolor=gold];
+  "handle" [shape=note, label="handle\n(constant)", style=filled, fillcolor=palegreen];
+  "choose" -> "call" [label="[$.n] > 2"];
+  "choose" -> "wait" [label="default"];
+  "call" -> "handle" [label="error", style=dashed, color=red];
+}
+`},
+	}
+
+	for _, test := range tests {
+		graph, err := stepflow.RenderGraph(df, test.format, &stepflow.GraphOptions{Run: run, Flows: flows})
+		if err != nil {
+			t.Fatalf("Graph could not be rendered: %s", err.Error())
+		}
+		if graph != test.expected {
+			t.Errorf("Expected %s graph:\n%s\ngot:\n%s", test.format, test.expected, graph)
+		}
+	}
+}
@@ -6,64 +6,212 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 	"time"
 
 	stepflow "github.com/jcalvarado1965/go-stepflow"
 	"github.com/jcalvarado1965/go-stepflow/inprocess"
 )
 
+// exit codes
+const (
+	exitOK    = 0 // command succeeded, or the run completed
+	exitError = 1 // invalid dataflow, or the run finished with error or was interrupted
+	exitUsage = 2 // bad command line
+)
+
+const usage = `Usage: main <command> [flags]
+
+Commands:
+  validate  check a dataflow and print every validation error
+  run       run a dataflow and print the final run state and outputs as JSON
+  graph     print the dataflow graph in DOT or Mermaid format
+
+Run "main <command> -h" for the flags of each command.
+`
+
+// runResult is printed by the run command
+type runResult struct {
+	ID      stepflow.DataflowRunID                     `json:"id"`
+	State   stepflow.DataflowRunState                  `json:"state"`
+	Message string                                     `json:"message,omitempty"`
+	Outputs map[string]map[string]*stepflow.FlowOutput `json:"outputs,omitempty"`
+}
+
 func main() {
-	wfFile := flag.String("dataflow", "", "Path to JSON-serialized workflow")
-	flag.Parse()
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitUsage)
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	if strings.HasPrefix(command, "-") && command != "-h" && command != "-help" {
+		// no command given, run the dataflow as earlier versions did
+		command, args = "run", os.Args[1:]
+	}
+
+	switch command {
+	case "validate":
+		os.Exit(validate(args))
+	case "run":
+		os.Exit(run(args))
+	case "graph":
+		os.Exit(graph(args))
+	}
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(exitUsage)
+}
+
+// loadDataflow parses the flags and loads the dataflow given in the
+// dataflow flag
+func loadDataflow(flags *flag.FlagSet, wfFile *string, args []string) (*stepflow.Dataflow, int) {
+	flags.Parse(args)
 	if *wfFile == "" {
-		flag.PrintDefaults()
-		return
+		flags.PrintDefaults()
+		return nil, exitUsage
 	}
 
-	bytes, err := ioutil.ReadFile(*wfFile)
+	workflow, err := stepflow.LoadDataflow(*wfFile)
 	if err != nil {
-		fmt.Printf("File %s could not be read: %s\n", *wfFile, err.Error())
-		return
+		fmt.Fprintf(os.Stderr, "Dataflow in %s could not be read: %s\n", *wfFile, err.Error())
+		return nil, exitError
+	}
+	return workflow, exitOK
+}
+
+// validate prints the validation errors of the dataflow
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	wfFile := flags.String("dataflow", "", "Path to JSON or YAML (.yaml, .yml) serialized workflow")
+	workflow, code := loadDataflow(flags, wfFile, args)
+	if workflow == nil {
+		return code
+	}
+
+	logger := inprocess.NewLeveledConsoleLogger(inprocess.LevelError, os.Stderr)
+	executor := stepflow.NewExecutor(inprocess.NewHTTPClientFactory(), logger,
+		inprocess.NewMemoryStorage(logger), nil)
+	errs := executor.Validate(context.Background(), workflow)
+	for _, err := range errs {
+		fmt.Println(err.Error())
+	}
+	if len(errs) > 0 {
+		return exitError
+	}
+	fmt.Printf("Dataflow %s is valid\n", workflow.ID)
+	return exitOK
+}
+
+// run runs the dataflow until it finishes and prints the result
+func run(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	wfFile := flags.String("dataflow", "", "Path to JSON or YAML (.yaml, .yml) serialized workflow")
+	inputFile := flags.String("input", "", "Path to the initial flow data, or - to read from stdin")
+	contentType := flags.String("content-type", "application/json", "Content type of the initial flow data")
+	workers := flags.Int("workers", 10, "Number of queue workers")
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	timeout := flags.Duration("timeout", 0, "Dataflow run timeout, overrides the dataflow timeout if set")
+	workflow, code := loadDataflow(flags, wfFile, args)
+	if workflow == nil {
+		return code
 	}
 
-	var workflow stepflow.Dataflow
-	err = json.Unmarshal(bytes, &workflow)
+	level, err := inprocess.ParseLogLevel(*logLevel)
 	if err != nil {
-		fmt.Printf("Dataflow in %s could not be read: %s\n", *wfFile, err.Error())
-		return
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "Number of workers must be at least 1")
+		return exitUsage
+	}
+	if *timeout > 0 {
+		workflow.Timeout = stepflow.Duration(*timeout)
 	}
 
+	var input interface{}
+	var inputContentType string
+	if *inputFile != "" {
+		var inputBytes []byte
+		if *inputFile == "-" {
+			inputBytes, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			inputBytes, err = ioutil.ReadFile(*inputFile)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Input %s could not be read: %s\n", *inputFile, err.Error())
+			return exitError
+		}
+		input = stepflow.FlowDataFromBytes(*contentType, inputBytes)
+		inputContentType = *contentType
+	}
+
+	// logs go to stderr so the result can be read from stdout
 	httpClientFactory := inprocess.NewHTTPClientFactory()
-	logger := inprocess.NewConsoleLogger()
-	flowQueue := inprocess.NewMemoryQueue(logger, 10)
+	logger := inprocess.NewLeveledConsoleLogger(level, os.Stderr)
+	flowQueue := inprocess.NewMemoryQueue(logger, *workers)
 	storage := inprocess.NewMemoryStorage(logger)
 	executor := stepflow.NewExecutor(httpClientFactory, logger, storage, flowQueue)
 	ctx := context.Background()
 
-	run, errs := executor.Start(ctx, &workflow)
-
+	wr, errs := executor.StartWithInput(ctx, workflow, input, inputContentType)
 	if len(errs) > 0 {
 		for _, err := range errs {
 			logger.Errorf(ctx, err.Error())
 		}
-		return
+		return exitError
 	}
 
 	for {
-		time.Sleep(time.Second)
-		run, ok := storage.RetrieveDataflowRuns(ctx, []stepflow.DataflowRunID{run.ID})[run.ID]
-		if !ok ||
-			run.State == stepflow.RunStateCompleted ||
-			run.State == stepflow.RunStateError ||
-			run.State == stepflow.RunStateInterrupted {
+		time.Sleep(100 * time.Millisecond)
+		current := storage.RetrieveDataflowRuns(ctx, []stepflow.DataflowRunID{wr.ID})[wr.ID]
+		if current == nil {
+			fmt.Fprintf(os.Stderr, "Dataflow run %s not found\n", wr.ID)
+			return exitError
+		}
+		wr = current
+		if wr.State == stepflow.RunStateCompleted ||
+			wr.State == stepflow.RunStateError ||
+			wr.State == stepflow.RunStateInterrupted {
 			break
 		}
 	}
 
 	wg, _ := flowQueue.(*inprocess.MemoryQueue).Stop(ctx)
-
 	if wg != nil {
 		logger.Debugf(ctx, "Waiting for queue to stop")
 		wg.Wait()
 	}
+
+	result, err := json.MarshalIndent(runResult{ID: wr.ID, State: wr.State, Message: wr.Message, Outputs: wr.Outputs}, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Run result could not be serialized: %s\n", err.Error())
+		return exitError
+	}
+	fmt.Println(string(result))
+
+	if wr.State != stepflow.RunStateCompleted {
+		return exitError
+	}
+	return exitOK
+}
+
+// graph prints the dataflow graph in DOT or Mermaid format
+func graph(args []string) int {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	wfFile := flags.String("dataflow", "", "Path to JSON or YAML (.yaml, .yml) serialized workflow")
+	format := flags.String("format", "dot", "Graph format, dot or mermaid")
+	workflow, code := loadDataflow(flags, wfFile, args)
+	if workflow == nil {
+		return code
+	}
+
+	graph, err := stepflow.RenderGraph(workflow, stepflow.GraphFormat(*format), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	fmt.Print(graph)
+	return exitOK
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+// mainEnv is set when the test binary is run as the command
+const mainEnv = "STEPFLOW_TEST_MAIN"
+
+const sampleDataflow = "../../samples/two-constants.json"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		main()
+		os.Exit(exitOK)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with the arguments in a new process, since it
+// exits, and returns its exit code, stdout and stderr
+func runMain(t *testing.T, args ...string) (int, string, string) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), stdout.String(), stderr.String()
+	} else if err != nil {
+		t.Fatalf("Command could not be run: %s", err.Error())
+	}
+	return exitOK, stdout.String(), stderr.String()
+}
+
+// writeDataflow writes the dataflow to a file in a temporary directory,
+// and returns its path
+func writeDataflow(t *testing.T, dataflowJSON string) string {
+	path := filepath.Join(t.TempDir(), "dataflow.json")
+	if err := os.WriteFile(path, []byte(dataflowJSON), 0600); err != nil {
+		t.Fatalf("Dataflow could not be written: %s", err.Error())
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	code, stdout, _ := runMain(t, "validate", "-dataflow", sampleDataflow)
+	if code != exitOK || stdout != "Dataflow TwoConstants is valid\n" {
+		t.Errorf("Expected exit code %d and the dataflow valid, got %d: %s", exitOK, code, stdout)
+	}
+
+	invalid := writeDataflow(t, `{"id": "Invalid", "steps": [{"id": "constant", "type": "constant"}]}`)
+	code, stdout, _ = runMain(t, "validate", "-dataflow", invalid)
+	if code != exitError || stdout == "" || strings.Contains(stdout, "is valid") {
+		t.Errorf("Expected exit code %d and the validation errors, got %d: %s", exitError, code, stdout)
+	}
+}
+
+func TestRun(t *testing.T) {
+	code, stdout, stderr := runMain(t, "run", "-log-level", "error", "-dataflow", sampleDataflow)
+	if code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d: %s", exitOK, code, stderr)
+	}
+	var result runResult
+	if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+		t.Fatalf("Run result could not be read: %s", err.Error())
+	}
+	if result.State != stepflow.RunStateCompleted || result.Outputs["constant-2"] == nil {
+		t.Errorf("Expected the run completed with the output of constant-2, got %s", stdout)
+	}
+
+	invalid := writeDataflow(t, `{"id": "Invalid", "steps": [{"id": "constant", "type": "constant"}]}`)
+	if code, stdout, _ = runMain(t, "run", "-log-level", "error", "-dataflow", invalid); code != exitError || stdout != "" {
+		t.Errorf("Expected exit code %d and no result, got %d: %s", exitError, code, stdout)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	code, stdout, _ := runMain(t, "graph", "-format", "mermaid", "-dataflow", sampleDataflow)
+	if code != exitOK || !strings.HasPrefix(stdout, "flowchart TD\n") || !strings.Contains(stdout, "s0 --> s1") {
+		t.Errorf("Expected exit code %d and the Mermaid graph, got %d: %s", exitOK, code, stdout)
+	}
+
+	unreadable := writeDataflow(t, `{"id": "Unknown", "steps": [{"id": "step", "type": "unknown"}]}`)
+	if code, _, stderr := runMain(t, "graph", "-dataflow", unreadable); code != exitError || !strings.Contains(stderr, "could not be read") {
+		t.Errorf("Expected exit code %d reading an unknown step type, got %d: %s", exitError, code, stderr)
+	}
+	if code, _, _ = runMain(t, "graph", "-format", "png", "-dataflow", sampleDataflow); code != exitUsage {
+		t.Errorf("Expected exit code %d with an unknown format, got %d", exitUsage, code)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no command", nil},
+		{"unknown command", []string{"unknown"}},
+		{"no dataflow", []string{"validate"}},
+	}
+
+	for _, test := range tests {
+		code, stdout, stderr := runMain(t, test.args...)
+		if code != exitUsage || stdout != "" || stderr == "" {
+			t.Errorf("%s: expected exit code %d and the usage, got %d: %s", test.name, exitUsage, code, stderr)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package inprocess
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+// Defaults of the file queue settings
+const (
+	DefaultMaxDeliveries   = 5
+	DefaultRedeliveryDelay = time.Second
+)
+
+// compactThreshold is the number of obsolete log records that triggers
+// a compaction of the log
+const compactThreshold = 1000
+
+// write-ahead log operations
+const (
+	walEnqueue = "enqueue" // a flow was enqueued
+	walFail    = "fail"    // a delivery of the flow failed
+	walAck     = "ack"     // the flow was handled, or dropped
+)
+
+// walRecord is a line of the write-ahead log
+type walRecord struct {
+	Op         string          `json:"op"`
+	ID         uint64          `json:"id"`
+	Flow       json.RawMessage `json:"flow,omitempty"`
+	NotBefore  int64           `json:"notBefore,omitempty"` // unix milliseconds
+	Deliveries int             `json:"deliveries,omitempty"`
+}
+
+// fileQueueEntry is a flow that has not been acknowledged
+type fileQueueEntry struct {
+	ID         uint64
+	Flow       json.RawMessage
+	NotBefore  time.Time
+	Deliveries int // failed deliveries
+}
+
+// FileQueue is a durable flow queue, backed by a write-ahead log file.
+// A flow stays in the log until the dequeue callback returns without
+// error. A failed delivery is retried after RedeliveryDelay, and the flow
+// is dropped once it has failed MaxDeliveries times. Flows that were not
+// acknowledged when the process stopped are delivered again when the
+// queue is reopened, so the executor does not recover them.
+type FileQueue struct {
+	Logger          stepflow.Logger
+	DequeueCb       func(ctx context.Context, flow *stepflow.Flow) error
+	DummyCtx        context.Context
+	MaxDeliveries   int
+	RedeliveryDelay time.Duration
+	NumWorkers      int
+	IsStopped       bool
+	WaitGroup       sync.WaitGroup // done when the queue is stopped and the log closed
+	Path            string
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	file      *os.File
+	nextID    uint64
+	entries   map[uint64]*fileQueueEntry // not acknowledged
+	ready     []*fileQueueEntry          // waiting for a worker, in order
+	timers    map[*time.Timer]bool
+	obsolete  int // log records of acknowledged or failed deliveries
+	startOnce sync.Once
+	workers   sync.WaitGroup
+}
+
+// NewFileQueue opens the queue with the log in the given file, creating
+// it if needed. Flows left in the log are delivered again once the
+// dequeue callback is set, which also starts the workers.
+func NewFileQueue(logger stepflow.Logger, path string, numWorkers int) (*FileQueue, error) {
+	fq := &FileQueue{
+		Logger:          logger,
+		DummyCtx:        context.Background(),
+		MaxDeliveries:   DefaultMaxDeliveries,
+		RedeliveryDelay: DefaultRedeliveryDelay,
+		NumWorkers:      numWorkers,
+		Path:            path,
+		entries:         make(map[uint64]*fileQueueEntry),
+		timers:          make(map[*time.Timer]bool),
+	}
+	fq.cond = sync.NewCond(&fq.mu)
+
+	if err := fq.replay(); err != nil {
+		return nil, fmt.Errorf("Queue log %s could not be read: %s", path, err.Error())
+	}
+	// rewriting the log drops acknowledged flows and any partly written record
+	if err := fq.compact(); err != nil {
+		return nil, fmt.Errorf("Queue log %s could not be written: %s", path, err.Error())
+	}
+	for _, entry := range fq.ordered() {
+		fq.schedule(entry)
+	}
+	logger.Infof(fq.DummyCtx, "Opened queue log %s with %d flows", path, len(fq.entries))
+
+	fq.WaitGroup.Add(1)
+	return fq, nil
+}
+
+func (fq *FileQueue) SetDequeueCb(cb func(ctx context.Context, flow *stepflow.Flow) error) {
+	fq.mu.Lock()
+	fq.DequeueCb = cb
+	fq.mu.Unlock()
+	fq.Logger.Debugf(fq.DummyCtx, "Dequeue callback set")
+	fq.startOnce.Do(fq.start)
+}
+
+// IsDurable returns true, since flows are kept in the log until handled
+func (fq *FileQueue) IsDurable() bool {
+	return true
+}
+
+func (fq *FileQueue) Enqueue(ctx context.Context, flow *stepflow.Flow) error {
+	fq.Logger.Debugf(fq.DummyCtx, "Enqueueing flow %v", flow)
+	return fq.enqueue(flow, time.Time{})
+}
+
+func (fq *FileQueue) EnqueueAfter(ctx context.Context, flow *stepflow.Flow, delay time.Duration) error {
+	fq.Logger.Debugf(fq.DummyCtx, "Enqueueing flow %v in %s", flow, delay)
+	return fq.enqueue(flow, time.Now().Add(delay))
+}
+
+func (fq *FileQueue) enqueue(flow *stepflow.Flow, notBefore time.Time) error {
+	value, err := stepflow.MarshalFlow(flow)
+	if err != nil {
+		return err
+	}
+
+	// flows handled while the queue stops can still enqueue the next ones,
+	// until the log is closed
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if fq.file == nil {
+		fq.Logger.Errorf(fq.DummyCtx, "Enqueueing flow on stopped queue %v", flow)
+		return errors.New("Queue already stopped")
+	}
+
+	fq.nextID++
+	entry := &fileQueueEntry{ID: fq.nextID, Flow: value, NotBefore: notBefore}
+	record := &walRecord{Op: walEnqueue, ID: entry.ID, Flow: value}
+	if !notBefore.IsZero() {
+		record.NotBefore = notBefore.UnixMilli()
+	}
+	if err = fq.write(record); err != nil {
+		return err
+	}
+	fq.entries[entry.ID] = entry
+	fq.schedule(entry)
+	return nil
+}
+
+// Stop stops delivering flows. Flows not yet delivered stay in the log.
+// The returned wait group is done when the flows being handled are
+// finished and the log is closed.
+func (fq *FileQueue) Stop(ctx context.Context) (*sync.WaitGroup, error) {
+	fq.Logger.Infof(fq.DummyCtx, "Stopping file queue")
+	fq.mu.Lock()
+	if fq.IsStopped {
+		fq.mu.Unlock()
+		return nil, errors.New("Queue already stopped")
+	}
+	fq.IsStopped = true
+	for timer := range fq.timers {
+		timer.Stop()
+	}
+	fq.timers = make(map[*time.Timer]bool)
+	fq.cond.Broadcast()
+	fq.mu.Unlock()
+
+	go func() {
+		fq.workers.Wait()
+		fq.mu.Lock()
+		if err := fq.file.Close(); err != nil {
+			fq.Logger.Errorf(fq.DummyCtx, "Error closing queue log: %s", err.Error())
+		}
+		fq.file = nil
+		fq.mu.Unlock()
+		fq.WaitGroup.Done()
+	}()
+	return &fq.WaitGroup, nil
+}
+
+func (fq *FileQueue) start() {
+	for i := 0; i < fq.NumWorkers; i++ {
+		fq.workers.Add(1)
+		go fq.worker(i)
+	}
+	fq.Logger.Debugf(fq.DummyCtx, "Started file queue with %d workers", fq.NumWorkers)
+}
+
+func (fq *FileQueue) worker(workerID int) {
+	defer fq.workers.Done()
+	fq.Logger.Infof(fq.DummyCtx, "Worker %d: starting...", workerID)
+	for {
+		fq.mu.Lock()
+		for len(fq.ready) == 0 && !fq.IsStopped {
+			fq.cond.Wait()
+		}
+		if fq.IsStopped {
+			fq.mu.Unlock()
+			break
+		}
+		entry := fq.ready[0]
+		fq.ready[0] = nil
+		fq.ready = fq.ready[1:]
+		fq.mu.Unlock()
+
+		fq.deliver(workerID, entry)
+	}
+	fq.Logger.Infof(fq.DummyCtx, "Worker %d: exiting...", workerID)
+}
+
+// deliver calls the dequeue callback with the flow of the entry, and
+// acknowledges it if the callback succeeds
+func (fq *FileQueue) deliver(workerID int, entry *fileQueueEntry) {
+	flow, err := stepflow.UnmarshalFlow(entry.Flow)
+	if err != nil {
+		// it will never be read, so it is dropped
+		fq.Logger.Errorf(fq.DummyCtx, "Worker %d: dropping invalid flow: %s", workerID, err.Error())
+		fq.mu.Lock()
+		fq.acknowledge(entry)
+		fq.mu.Unlock()
+		return
+	}
+
+	fq.Logger.Debugf(fq.DummyCtx, "Worker %d: dequeued flow %v", workerID, flow)
+	fq.mu.Lock()
+	dequeueCb := fq.DequeueCb
+	fq.mu.Unlock()
+	err = dequeueCb(fq.DummyCtx, flow)
+
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if err == nil {
+		fq.acknowledge(entry)
+		return
+	}
+
+	entry.Deliveries++
+	if entry.Deliveries >= fq.MaxDeliveries {
+		fq.Logger.Errorf(fq.DummyCtx, "Dropping flow %s after %d failed deliveries: %s", flow.ID, entry.Deliveries, err.Error())
+		fq.acknowledge(entry)
+		return
+	}
+
+	fq.Logger.Warnf(fq.DummyCtx, "Flow %s will be redelivered in %s after failing: %s", flow.ID, fq.RedeliveryDelay, err.Error())
+	// the redelivery time is logged, so it is kept after a restart
+	entry.NotBefore = time.Now().Add(fq.RedeliveryDelay)
+	record := &walRecord{Op: walFail, ID: entry.ID, NotBefore: entry.NotBefore.UnixMilli()}
+	if err = fq.write(record); err != nil {
+		fq.Logger.Errorf(fq.DummyCtx, "Error writing queue log: %s", err.Error())
+	}
+	fq.obsolete++
+	if !fq.IsStopped {
+		fq.schedule(entry)
+	}
+}
+
+// acknowledge removes the entry from the queue. Must be called with the
+// lock held.
+func (fq *FileQueue) acknowledge(entry *fileQueueEntry) {
+	if err := fq.write(&walRecord{Op: walAck, ID: entry.ID}); err != nil {
+		// the flow will be delivered again when the log is reopened
+		fq.Logger.Errorf(fq.DummyCtx, "Error writing queue log: %s", err.Error())
+	}
+	delete(fq.entries, entry.ID)
+	fq.obsolete += 2
+
+	if fq.obsolete > compactThreshold && fq.obsolete > len(fq.entries) {
+		if err := fq.compact(); err != nil {
+			fq.Logger.Errorf(fq.DummyCtx, "Error compacting queue log: %s", err.Error())
+		}
+	}
+}
+
+// schedule makes the entry ready for a worker once it is due. Must be
+// called with the lock held.
+func (fq *FileQueue) schedule(entry *fileQueueEntry) {
+	delay := time.Until(entry.NotBefore)
+	if delay <= 0 {
+		fq.ready = append(fq.ready, entry)
+		fq.cond.Signal()
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		fq.mu.Lock()
+		defer fq.mu.Unlock()
+		delete(fq.timers, timer)
+		if !fq.IsStopped {
+			fq.ready = append(fq.ready, entry)
+			fq.cond.Signal()
+		}
+	})
+	fq.timers[timer] = true
+}
+
+// write appends the record to the log, and syncs it to disk. Must be
+// called with the lock held.
+func (fq *FileQueue) write(record *walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = fq.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return fq.file.Sync()
+}
+
+// replay reads the log, keeping the flows that were not acknowledged
+func (fq *FileQueue) replay() error {
+	file, err := os.Open(fq.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fq.Logger.Warnf(fq.DummyCtx, "Ignoring partly written record at the end of queue log %s", fq.Path)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var record walRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		if record.ID > fq.nextID {
+			fq.nextID = record.ID
+		}
+		switch record.Op {
+		case walEnqueue:
+			entry := &fileQueueEntry{ID: record.ID, Flow: record.Flow, Deliveries: record.Deliveries}
+			if record.NotBefore != 0 {
+				entry.NotBefore = time.UnixMilli(record.NotBefore)
+			}
+			fq.entries[record.ID] = entry
+		case walFail:
+			if entry, ok := fq.entries[record.ID]; ok {
+				entry.Deliveries++
+				if record.NotBefore != 0 {
+					entry.NotBefore = time.UnixMilli(record.NotBefore)
+				}
+			}
+		case walAck:
+			delete(fq.entries, record.ID)
+		}
+	}
+}
+
+// ordered returns the flows that were not acknowledged, in the order
+// they were enqueued. Must be called with the lock held, or before the
+// workers start.
+func (fq *FileQueue) ordered() []*fileQueueEntry {
+	ordered := make([]*fileQueueEntry, 0, len(fq.entries))
+	for _, entry := range fq.entries {
+		ordered = append(ordered, entry)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].ID < ordered[j].ID })
+	return ordered
+}
+
+// compact rewrites the log with only the flows that were not
+// acknowledged. The new log is opened for appending before it replaces
+// the old one, so the queue keeps writing to the old log if it fails.
+// Must be called with the lock held, or before the workers start.
+func (fq *FileQueue) compact() error {
+	tmpPath := fq.Path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range fq.ordered() {
+		record := &walRecord{Op: walEnqueue, ID: entry.ID, Flow: entry.Flow, Deliveries: entry.Deliveries}
+		if !entry.NotBefore.IsZero() {
+			record.NotBefore = entry.NotBefore.UnixMilli()
+		}
+		line, err := json.Marshal(record)
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, fq.Path)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// the file opened keeps being written after it is renamed
+	if fq.file != nil {
+		fq.file.Close()
+	}
+	fq.file = tmp
+	fq.obsolete = 0
+	return nil
+}
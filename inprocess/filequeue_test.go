@@ -0,0 +1,276 @@
+package inprocess
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+func openTestFileQueue(t *testing.T, path string) *FileQueue {
+	fq, err := NewFileQueue(newTestLogger(), path, 1)
+	if err != nil {
+		t.Fatalf("File queue could not be opened: %s", err.Error())
+	}
+	return fq
+}
+
+// stopFileQueue stops the queue and waits until the log is closed
+func stopFileQueue(t *testing.T, fq *FileQueue) {
+	wg, err := fq.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("File queue could not be stopped: %s", err.Error())
+	}
+	wg.Wait()
+}
+
+func enqueueTestFlows(t *testing.T, fq *FileQueue, ids ...stepflow.FlowID) {
+	for _, id := range ids {
+		flow := &stepflow.Flow{FlowNoData: stepflow.FlowNoData{ID: id, NextStepID: "start"}}
+		if err := fq.Enqueue(context.Background(), flow); err != nil {
+			t.Fatalf("Flow %s could not be enqueued: %s", id, err.Error())
+		}
+	}
+}
+
+// receiveFlowIDs waits for the given number of flow IDs
+func receiveFlowIDs(t *testing.T, delivered chan stepflow.FlowID, count int) []stepflow.FlowID {
+	ids := []stepflow.FlowID{}
+	for len(ids) < count {
+		select {
+		case id := <-delivered:
+			ids = append(ids, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d deliveries, got %v", count, ids)
+		}
+	}
+	return ids
+}
+
+func countLogLines(t *testing.T, path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Queue log could not be read: %s", err.Error())
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestFileQueueReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+
+	// without a dequeue callback the workers are not started, so the
+	// flows stay in the log
+	fq := openTestFileQueue(t, path)
+	enqueueTestFlows(t, fq, "first", "second", "third")
+	stopFileQueue(t, fq)
+
+	fq = openTestFileQueue(t, path)
+	delivered := make(chan stepflow.FlowID, 10)
+	fq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered <- flow.ID
+		return nil
+	})
+	ids := receiveFlowIDs(t, delivered, 3)
+	stopFileQueue(t, fq)
+
+	if fmt.Sprint(ids) != "[first second third]" {
+		t.Errorf("Expected the flows replayed in order, got %v", ids)
+	}
+
+	// acknowledged flows are not replayed
+	fq = openTestFileQueue(t, path)
+	defer stopFileQueue(t, fq)
+	if len(fq.entries) != 0 {
+		t.Errorf("Expected no flows after reopening, got %d", len(fq.entries))
+	}
+}
+
+func TestFileQueueRedelivery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	fq := openTestFileQueue(t, path)
+	fq.RedeliveryDelay = 10 * time.Millisecond
+
+	delivered := make(chan stepflow.FlowID, 10)
+	failures := 1
+	fq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered <- flow.ID
+		if failures > 0 {
+			failures--
+			return errors.New("failed")
+		}
+		return nil
+	})
+	enqueueTestFlows(t, fq, "flow")
+	ids := receiveFlowIDs(t, delivered, 2)
+	stopFileQueue(t, fq)
+
+	if fmt.Sprint(ids) != "[flow flow]" {
+		t.Errorf("Expected the failed flow delivered again, got %v", ids)
+	}
+}
+
+func TestFileQueueRedeliveryAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	fq := openTestFileQueue(t, path)
+	fq.RedeliveryDelay = 10 * time.Millisecond
+
+	delivered := make(chan stepflow.FlowID, 10)
+	fq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered <- flow.ID
+		return errors.New("failed")
+	})
+	enqueueTestFlows(t, fq, "flow")
+	receiveFlowIDs(t, delivered, 1)
+	// the redelivery is still pending when the queue stops
+	stopFileQueue(t, fq)
+
+	fq = openTestFileQueue(t, path)
+	entry, ok := fq.entries[1]
+	if !ok || entry.Deliveries != 1 {
+		t.Fatalf("Expected the unacknowledged flow with 1 failed delivery, got %v", entry)
+	}
+	fq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered <- flow.ID
+		return nil
+	})
+	ids := receiveFlowIDs(t, delivered, 1)
+	stopFileQueue(t, fq)
+
+	if ids[0] != "flow" {
+		t.Errorf("Expected the unacknowledged flow delivered again, got %v", ids)
+	}
+}
+
+func TestFileQueueRedeliveryDelayAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	fq := openTestFileQueue(t, path)
+	fq.RedeliveryDelay = time.Hour
+
+	delivered := make(chan stepflow.FlowID, 10)
+	fq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered <- flow.ID
+		return errors.New("failed")
+	})
+	enqueueTestFlows(t, fq, "flow")
+	receiveFlowIDs(t, delivered, 1)
+	stopFileQueue(t, fq)
+
+	// the failed flow is not redelivered at once after a restart
+	fq = openTestFileQueue(t, path)
+	defer stopFileQueue(t, fq)
+	entry, ok := fq.entries[1]
+	if !ok || time.Until(entry.NotBefore) < 59*time.Minute {
+		t.Fatalf("Expected the failed flow redelivered in an hour, got %v", entry)
+	}
+	fq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered <- flow.ID
+		return nil
+	})
+	select {
+	case id := <-delivered:
+		t.Errorf("Expected no delivery before the redelivery delay, got delivery of %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFileQueueMaxDeliveries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	fq := openTestFileQueue(t, path)
+	fq.MaxDeliveries = 2
+	fq.RedeliveryDelay = 10 * time.Millisecond
+
+	delivered := make(chan stepflow.FlowID, 10)
+	fq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered <- flow.ID
+		return errors.New("failed")
+	})
+	enqueueTestFlows(t, fq, "flow")
+	receiveFlowIDs(t, delivered, 2)
+
+	// the flow is dropped after the second failure
+	select {
+	case id := <-delivered:
+		t.Errorf("Expected flow dropped after 2 deliveries, got delivery of %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stopFileQueue(t, fq)
+
+	fq = openTestFileQueue(t, path)
+	defer stopFileQueue(t, fq)
+	if len(fq.entries) != 0 {
+		t.Errorf("Expected the dropped flow not replayed, got %d flows", len(fq.entries))
+	}
+}
+
+func TestFileQueueCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	fq := openTestFileQueue(t, path)
+	enqueueTestFlows(t, fq, "pending")
+
+	// each flow handled leaves an enqueue and an ack record
+	count := compactThreshold
+	delivered := make(chan stepflow.FlowID, count)
+	fq.RedeliveryDelay = time.Hour
+	fq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		if flow.ID == "pending" {
+			return errors.New("failed")
+		}
+		delivered <- flow.ID
+		return nil
+	})
+	for i := 0; i < count; i++ {
+		enqueueTestFlows(t, fq, stepflow.FlowID(fmt.Sprintf("flow%d", i)))
+	}
+	receiveFlowIDs(t, delivered, count)
+	stopFileQueue(t, fq)
+
+	// without compaction the log would have 2 records per flow handled
+	if lines := countLogLines(t, path); lines >= 2*count {
+		t.Errorf("Expected the log compacted, got %d records", lines)
+	}
+
+	fq = openTestFileQueue(t, path)
+	defer stopFileQueue(t, fq)
+	if len(fq.entries) != 1 || fq.entries[1] == nil || fq.entries[1].Deliveries != 1 {
+		t.Errorf("Expected only the failed flow kept by the compaction, got %v", fq.entries)
+	}
+	if lines := countLogLines(t, path); lines != 1 {
+		t.Errorf("Expected 1 record after reopening, got %d", lines)
+	}
+}
+
+func TestFileQueueCompactionFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	fq := openTestFileQueue(t, path)
+	enqueueTestFlows(t, fq, "first")
+
+	// the new log cannot be created where a directory is
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatalf("Directory could not be created: %s", err.Error())
+	}
+	fq.mu.Lock()
+	err := fq.compact()
+	fq.mu.Unlock()
+	if err == nil {
+		t.Fatalf("Expected the compaction to fail")
+	}
+
+	// flows are still written to the old log
+	enqueueTestFlows(t, fq, "second")
+	stopFileQueue(t, fq)
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatalf("Directory could not be removed: %s", err.Error())
+	}
+
+	fq = openTestFileQueue(t, path)
+	defer stopFileQueue(t, fq)
+	if len(fq.entries) != 2 {
+		t.Errorf("Expected the 2 flows after reopening, got %d", len(fq.entries))
+	}
+}
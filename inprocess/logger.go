@@ -3,6 +3,8 @@ package inprocess
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -11,27 +13,70 @@ import (
 	stepflow "github.com/jcalvarado1965/go-stepflow"
 )
 
+// LogLevel is the minimum level of the messages logged
+type LogLevel int
+
+// These are the log levels, from most to least verbose
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// ParseLogLevel returns the log level with the given name (debug, info,
+// warn or error)
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelDebug, fmt.Errorf("Log level not recognized: %s", name)
+}
+
 type consoleLogger struct {
 	Mutex *sync.Mutex
+	Level LogLevel
+	Out   io.Writer
 }
 
-// NewConsoleLogger creates a console logger
+// NewConsoleLogger creates a console logger writing all messages to stdout
 func NewConsoleLogger() stepflow.Logger {
+	return NewLeveledConsoleLogger(LevelDebug, os.Stdout)
+}
+
+// NewLeveledConsoleLogger creates a console logger writing messages of
+// the given level or above to out
+func NewLeveledConsoleLogger(level LogLevel, out io.Writer) stepflow.Logger {
 	return &consoleLogger{
 		Mutex: &sync.Mutex{},
+		Level: level,
+		Out:   out,
 	}
 }
 
 func (l *consoleLogger) Debugf(ctx context.Context, format string, params ...interface{}) {
-	l.logf(ctx, color.FgBlue, "DEBUG", format, params)
+	if l.Level <= LevelDebug {
+		l.logf(ctx, color.FgBlue, "DEBUG", format, params)
+	}
 }
 
 func (l *consoleLogger) Infof(ctx context.Context, format string, params ...interface{}) {
-	l.logf(ctx, color.FgWhite, "INFO ", format, params)
+	if l.Level <= LevelInfo {
+		l.logf(ctx, color.FgWhite, "INFO ", format, params)
+	}
 }
 
 func (l *consoleLogger) Warnf(ctx context.Context, format string, params ...interface{}) {
-	l.logf(ctx, color.FgYellow, "WARN ", format, params)
+	if l.Level <= LevelWarn {
+		l.logf(ctx, color.FgYellow, "WARN ", format, params)
+	}
 }
 
 func (l *consoleLogger) Errorf(ctx context.Context, format string, params ...interface{}) {
@@ -43,25 +88,23 @@ func trimID(id string) string {
 }
 
 func (l *consoleLogger) logf(ctx context.Context, attr color.Attribute, level string, format string, params []interface{}) {
-	l.Mutex.Lock()
-	defer l.Mutex.Unlock()
-
-	color.Set(attr)
-	defer color.Unset()
-
+	var line strings.Builder
 	now := time.Now()
-	fmt.Printf("%s %s ", level, now.Format(time.Stamp))
+	fmt.Fprintf(&line, "%s %s ", level, now.Format(time.Stamp))
 
 	if wfrunid := ctx.Value(stepflow.DataflowRunContextKey); wfrunid != nil {
-		fmt.Printf("[%s] ", trimID(string(wfrunid.(stepflow.DataflowRunID))))
+		fmt.Fprintf(&line, "[%s] ", trimID(string(wfrunid.(stepflow.DataflowRunID))))
 		if flowid := ctx.Value(stepflow.FlowContextKey); flowid != nil {
-			fmt.Printf("[%s] ", trimID(string(flowid.(stepflow.FlowID))))
+			fmt.Fprintf(&line, "[%s] ", trimID(string(flowid.(stepflow.FlowID))))
 			if stepid := ctx.Value(stepflow.StepContextKey); stepid != nil {
-				fmt.Printf("[%s] ", stepid.(string))
+				fmt.Fprintf(&line, "[%s] ", stepid.(string))
 			}
 		}
 	}
 
-	fmt.Printf(format, params...)
-	fmt.Print("\n")
+	fmt.Fprintf(&line, format, params...)
+
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	color.New(attr).Fprintln(l.Out, line.String())
 }
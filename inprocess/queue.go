@@ -4,27 +4,61 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	stepflow "github.com/jcalvarado1965/go-stepflow"
 )
 
+// ErrQueueFull is returned by Enqueue on a bounded memory queue that
+// already holds its maximum number of flows
+var ErrQueueFull = errors.New("Queue is full")
+
+// workerContextKey is the key of the queue in the context passed to the
+// dequeue callback, so flows enqueued while handling a flow are known
+type workerContextKey struct{}
+
+// MemoryQueue queues flows in memory for its workers. Flows are enqueued
+// by the workers themselves (e.g. when a flow advances or is split), so
+// the queue grows as needed and Enqueue never blocks. When MaxQueued is
+// set, Enqueue fails with ErrQueueFull instead of queueing more than
+// MaxQueued flows, so callers starting runs can apply backpressure. The
+// limit only applies to the first flow of a run enqueued outside the
+// workers, i.e. by Start or StartWithInput, for which the executor drops
+// the run. Other flows (e.g. resumed by a signal, or enqueued by the
+// workers half way through a split) would otherwise be lost, and delayed
+// flows have no caller to report the error to.
 type MemoryQueue struct {
 	Logger    stepflow.Logger
-	Queue     chan *stepflow.Flow
 	IsStopped bool
 	DequeueCb func(ctx context.Context, flow *stepflow.Flow) error
 	DummyCtx  context.Context
 	WaitGroup sync.WaitGroup
+	MaxQueued int // zero for no limit
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*stepflow.Flow     // waiting for a worker, in order
+	timers map[*time.Timer]bool // delayed enqueues not yet fired
 }
 
-// NewMemoryQueue creates a memory queue service
+// NewMemoryQueue creates a memory queue service with no limit on the
+// number of queued flows
 func NewMemoryQueue(logger stepflow.Logger, numWorkers int) stepflow.FlowQueue {
+	return NewBoundedMemoryQueue(logger, numWorkers, 0)
+}
+
+// NewBoundedMemoryQueue creates a memory queue service that returns
+// ErrQueueFull when more than maxQueued flows are enqueued. A maxQueued
+// of zero means no limit.
+func NewBoundedMemoryQueue(logger stepflow.Logger, numWorkers int, maxQueued int) stepflow.FlowQueue {
 	mq := &MemoryQueue{
 		Logger:    logger,
-		Queue:     make(chan *stepflow.Flow, numWorkers),
 		DummyCtx:  context.Background(),
 		IsStopped: false,
+		MaxQueued: maxQueued,
+		timers:    make(map[*time.Timer]bool),
 	}
+	mq.cond = sync.NewCond(&mq.mu)
 
 	for i := 0; i < numWorkers; i++ {
 		go mq.worker(i)
@@ -35,40 +69,110 @@ func NewMemoryQueue(logger stepflow.Logger, numWorkers int) stepflow.FlowQueue {
 }
 
 func (mq *MemoryQueue) SetDequeueCb(cb func(ctx context.Context, flow *stepflow.Flow) error) {
+	mq.mu.Lock()
 	mq.DequeueCb = cb
+	mq.mu.Unlock()
 	mq.Logger.Debugf(mq.DummyCtx, "Dequeue callback set")
 }
 
 func (mq *MemoryQueue) Enqueue(ctx context.Context, flow *stepflow.Flow) error {
 	mq.Logger.Debugf(mq.DummyCtx, "Enqueueing flow %v", flow)
+	return mq.push(flow, ctx.Value(workerContextKey{}) != mq && startsRun(flow))
+}
+
+// startsRun returns true if the flow is the first flow of a run, which has
+// not left a step yet
+func startsRun(flow *stepflow.Flow) bool {
+	return flow.PreviousStepID == "" && len(flow.Splits) == 0 && flow.Attempts == 0
+}
+
+// EnqueueAfter starts a timer that enqueues the flow once the delay has
+// passed. Timers not yet fired are stopped when the queue is stopped.
+func (mq *MemoryQueue) EnqueueAfter(ctx context.Context, flow *stepflow.Flow, delay time.Duration) error {
+	mq.Logger.Debugf(mq.DummyCtx, "Enqueueing flow %v in %s", flow, delay)
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
 	if mq.IsStopped {
 		mq.Logger.Errorf(mq.DummyCtx, "Enqueueing flow on stopped queue %v", flow)
 		return errors.New("Queue already stopped")
 	}
 
-	mq.Queue <- flow
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		mq.mu.Lock()
+		delete(mq.timers, timer)
+		mq.mu.Unlock()
+		if err := mq.push(flow, false); err != nil {
+			mq.Logger.Errorf(mq.DummyCtx, "Error enqueueing delayed flow %v: %s", flow, err.Error())
+		}
+	})
+	mq.timers[timer] = true
 	return nil
 }
 
+// push adds the flow at the end of the queue, checking the limit if
+// bounded is true
+func (mq *MemoryQueue) push(flow *stepflow.Flow, bounded bool) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if mq.IsStopped {
+		mq.Logger.Errorf(mq.DummyCtx, "Enqueueing flow on stopped queue %v", flow)
+		return errors.New("Queue already stopped")
+	}
+	if bounded && mq.MaxQueued > 0 && len(mq.queue) >= mq.MaxQueued {
+		mq.Logger.Warnf(mq.DummyCtx, "Queue full with %d flows, rejecting flow %v", len(mq.queue), flow)
+		return ErrQueueFull
+	}
+
+	mq.queue = append(mq.queue, flow)
+	mq.cond.Signal()
+	return nil
+}
+
+// Stop stops accepting flows. The workers handle the flows already queued
+// before exiting, and the returned wait group is done when they have.
 func (mq *MemoryQueue) Stop(ctx context.Context) (*sync.WaitGroup, error) {
 	mq.Logger.Infof(mq.DummyCtx, "Stopping memory queue")
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
 	if mq.IsStopped {
 		return nil, errors.New("Queue already stopped")
 	}
 
 	mq.IsStopped = true
-	close(mq.Queue)
+	for timer := range mq.timers {
+		timer.Stop()
+	}
+	mq.timers = make(map[*time.Timer]bool)
+	mq.cond.Broadcast()
 	return &mq.WaitGroup, nil
 }
 
 func (mq *MemoryQueue) worker(workerID int) {
 	mq.Logger.Infof(mq.DummyCtx, "Worker %d: starting...", workerID)
-	for flow := range mq.Queue {
+	workerCtx := context.WithValue(mq.DummyCtx, workerContextKey{}, mq)
+	for {
+		mq.mu.Lock()
+		for len(mq.queue) == 0 && !mq.IsStopped {
+			mq.cond.Wait()
+		}
+		if len(mq.queue) == 0 {
+			// stopped, and nothing left to handle
+			mq.mu.Unlock()
+			break
+		}
+		flow := mq.queue[0]
+		mq.queue[0] = nil
+		mq.queue = mq.queue[1:]
+		dequeueCb := mq.DequeueCb
+		mq.mu.Unlock()
+
 		mq.Logger.Debugf(mq.DummyCtx, "Worker %d: dequeued flow %v", workerID, flow)
-		if mq.DequeueCb != nil {
-			mq.DequeueCb(mq.DummyCtx, flow)
-		} else {
+		if dequeueCb == nil {
 			mq.Logger.Errorf(mq.DummyCtx, "Worker %d: no callback for dequeued flow %v", workerID, flow)
+		} else if err := dequeueCb(workerCtx, flow); err != nil {
+			// the memory queue does not redeliver failed flows
+			mq.Logger.Errorf(mq.DummyCtx, "Worker %d: error handling flow %s: %s", workerID, flow.ID, err.Error())
 		}
 	}
 	mq.Logger.Infof(mq.DummyCtx, "Worker %d: exiting...", workerID)
@@ -0,0 +1,66 @@
+package inprocess
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+func newTestLogger() stepflow.Logger {
+	return NewLeveledConsoleLogger(LevelWarn, ioutil.Discard)
+}
+
+func TestBoundedMemoryQueue(t *testing.T) {
+	ctx := context.Background()
+	// without workers, the flows stay queued
+	mq := NewBoundedMemoryQueue(newTestLogger(), 0, 1).(*MemoryQueue)
+	defer mq.Stop(ctx)
+
+	first := &stepflow.Flow{FlowNoData: stepflow.FlowNoData{ID: "first", NextStepID: "start"}}
+	if err := mq.Enqueue(ctx, first); err != nil {
+		t.Fatalf("First flow could not be enqueued: %s", err.Error())
+	}
+	second := &stepflow.Flow{FlowNoData: stepflow.FlowNoData{ID: "second", NextStepID: "start"}}
+	if err := mq.Enqueue(ctx, second); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull starting a run on a full queue, got %v", err)
+	}
+
+	// flows that do not start a run are not limited
+	resumed := &stepflow.Flow{FlowNoData: stepflow.FlowNoData{ID: "resumed", PreviousStepID: "wait", NextStepID: "next"}}
+	if err := mq.Enqueue(ctx, resumed); err != nil {
+		t.Errorf("Expected a resumed flow enqueued on a full queue, got %s", err.Error())
+	}
+	workerCtx := context.WithValue(ctx, workerContextKey{}, mq)
+	if err := mq.Enqueue(workerCtx, second); err != nil {
+		t.Errorf("Expected a flow enqueued by a worker on a full queue, got %s", err.Error())
+	}
+	if len(mq.queue) != 3 {
+		t.Errorf("Expected 3 queued flows, got %d", len(mq.queue))
+	}
+}
+
+func TestStartOnFullQueue(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	storage := NewMemoryStorage(logger)
+	mq := NewBoundedMemoryQueue(logger, 0, 1).(*MemoryQueue)
+	defer mq.Stop(ctx)
+	exec := stepflow.NewExecutor(NewHTTPClientFactory(), logger, storage, mq)
+
+	df := &stepflow.Dataflow{ID: "Constant"}
+	constant := &stepflow.ConstantStep{BaseStep: stepflow.BaseStep{ID: "constant"}, Value: []byte(`1`)}
+	df.Steps = []stepflow.Step{constant}
+	df.StartAt = constant
+
+	if _, errs := exec.Start(ctx, df); len(errs) > 0 {
+		t.Fatalf("First run could not be started: %v", errs)
+	}
+	if _, errs := exec.Start(ctx, df); len(errs) != 1 || errs[0] != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull starting a run on a full queue, got %v", errs)
+	}
+	if runIDs := storage.ListDataflowRuns(ctx); len(runIDs) != 1 {
+		t.Errorf("Expected only the first run stored, got %v", runIDs)
+	}
+}
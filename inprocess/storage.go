@@ -3,6 +3,8 @@ package inprocess
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
 
 	stepflow "github.com/jcalvarado1965/go-stepflow"
@@ -22,7 +24,9 @@ const flowSplitKind = "FlowSplit:"
 
 var errNotFound = errors.New("Not found")
 
-// NewMemoryStorage creates a memory storage service
+// NewMemoryStorage creates a memory storage service. Runs, flows and
+// splits are stored and retrieved as copies, as they would be by a durable
+// storage service, so they can be read while workers change them.
 func NewMemoryStorage(logger stepflow.Logger) stepflow.Storage {
 	return &memoryStorage{
 		Logger: logger,
@@ -30,16 +34,45 @@ func NewMemoryStorage(logger stepflow.Logger) stepflow.Storage {
 	}
 }
 
+// StoreDataflowRun stores a copy of the run, so outputs can be added to
+// it while callers hold the runs they stored or retrieved
 func (ms *memoryStorage) StoreDataflowRun(ctx context.Context, run *stepflow.DataflowRun) error {
-	ms.Cache.Set(dataflowRunKind+string(run.ID), run, cache.NoExpiration)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	stored := *run
+	stored.Outputs = nil
+	if value, ok := ms.Cache.Get(dataflowRunKind + string(run.ID)); ok {
+		// outputs already stored are kept
+		addOutputs(&stored, value.(*stepflow.DataflowRun).Outputs)
+	}
+	addOutputs(&stored, run.Outputs)
+	ms.Cache.Set(dataflowRunKind+string(run.ID), &stored, cache.NoExpiration)
+	return nil
+}
+
+func (ms *memoryStorage) StoreFlowOutput(ctx context.Context, runID stepflow.DataflowRunID, stepID string, key string, output *stepflow.FlowOutput) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	value, ok := ms.Cache.Get(dataflowRunKind + string(runID))
+	if !ok {
+		return fmt.Errorf("Dataflow run %s not found", runID)
+	}
+	run := value.(*stepflow.DataflowRun)
+	delete(run.Outputs[stepID], key)
+	addOutput(run, stepID, key, output)
 	return nil
 }
 
 func (ms *memoryStorage) RetrieveDataflowRuns(ctx context.Context, keys []stepflow.DataflowRunID) map[stepflow.DataflowRunID]*stepflow.DataflowRun {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
 	runs := make(map[stepflow.DataflowRunID]*stepflow.DataflowRun)
 	for _, key := range keys {
 		if value, ok := ms.Cache.Get(dataflowRunKind + string(key)); ok {
-			runs[key] = value.(*stepflow.DataflowRun)
+			runs[key] = copyRun(value.(*stepflow.DataflowRun))
 		} else {
 			runs[key] = nil
 		}
@@ -52,8 +85,20 @@ func (ms *memoryStorage) DeleteDataflowRun(ctx context.Context, key stepflow.Dat
 	return nil
 }
 
+func (ms *memoryStorage) ListDataflowRuns(ctx context.Context) []stepflow.DataflowRunID {
+	runIDs := []stepflow.DataflowRunID{}
+	for key := range ms.Cache.Items() {
+		if strings.HasPrefix(key, dataflowRunKind) {
+			runIDs = append(runIDs, stepflow.DataflowRunID(strings.TrimPrefix(key, dataflowRunKind)))
+		}
+	}
+	return runIDs
+}
+
+// StoreFlow stores a copy of the flow, so callers can change the flows
+// they stored or retrieved while others read them
 func (ms *memoryStorage) StoreFlow(ctx context.Context, flow *stepflow.Flow) error {
-	ms.Cache.Set(flowKind+string(flow.ID), flow, cache.NoExpiration)
+	ms.Cache.Set(flowKind+string(flow.ID), copyFlow(flow), cache.NoExpiration)
 	return nil
 }
 
@@ -61,7 +106,7 @@ func (ms *memoryStorage) RetrieveFlows(ctx context.Context, keys []stepflow.Flow
 	flows := make(map[stepflow.FlowID]*stepflow.Flow)
 	for _, key := range keys {
 		if value, ok := ms.Cache.Get(flowKind + string(key)); ok {
-			flows[key] = value.(*stepflow.Flow)
+			flows[key] = copyFlow(value.(*stepflow.Flow))
 		}
 	}
 	return flows
@@ -72,8 +117,18 @@ func (ms *memoryStorage) DeleteFlow(ctx context.Context, key stepflow.FlowID) er
 	return nil
 }
 
+func (ms *memoryStorage) ListFlows(ctx context.Context, runID stepflow.DataflowRunID) []stepflow.FlowID {
+	flowIDs := []stepflow.FlowID{}
+	for key, item := range ms.Cache.Items() {
+		if strings.HasPrefix(key, flowKind) && item.Object.(*stepflow.Flow).DataflowRunID == runID {
+			flowIDs = append(flowIDs, stepflow.FlowID(strings.TrimPrefix(key, flowKind)))
+		}
+	}
+	return flowIDs
+}
+
 func (ms *memoryStorage) StoreFlowSplit(ctx context.Context, flowSplit *stepflow.FlowSplit) error {
-	ms.Cache.Set(flowSplitKind+string(flowSplit.ID), flowSplit, cache.NoExpiration)
+	ms.Cache.Set(flowSplitKind+string(flowSplit.ID), copyFlowSplit(flowSplit), cache.NoExpiration)
 	return nil
 }
 
@@ -81,34 +136,102 @@ func (ms *memoryStorage) RetrieveFlowSplits(ctx context.Context, keys []stepflow
 	flowSplits := make(map[stepflow.FlowSplitID]*stepflow.FlowSplit)
 	for _, key := range keys {
 		if value, ok := ms.Cache.Get(flowSplitKind + string(key)); ok {
-			flowSplits[key] = value.(*stepflow.FlowSplit)
+			flowSplits[key] = copyFlowSplit(value.(*stepflow.FlowSplit))
 		}
 	}
 	return flowSplits
 }
 
 func (ms *memoryStorage) DeleteFlowSplit(ctx context.Context, key stepflow.FlowSplitID) error {
-	ms.Cache.Delete(flowKind + string(key))
+	ms.Cache.Delete(flowSplitKind + string(key))
 	return nil
 }
 
-func (ms *memoryStorage) Increment(ctx context.Context, key string, initialValue int64, increment int64) int64 {
+func (ms *memoryStorage) ListFlowSplits(ctx context.Context, runID stepflow.DataflowRunID) []stepflow.FlowSplitID {
+	flowSplitIDs := []stepflow.FlowSplitID{}
+	for key, item := range ms.Cache.Items() {
+		if strings.HasPrefix(key, flowSplitKind) && item.Object.(*stepflow.FlowSplit).DataflowRunID == runID {
+			flowSplitIDs = append(flowSplitIDs, stepflow.FlowSplitID(strings.TrimPrefix(key, flowSplitKind)))
+		}
+	}
+	return flowSplitIDs
+}
+
+func (ms *memoryStorage) Increment(ctx context.Context, key string, initialValue int64, increment int64) (int64, error) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
 	err := ms.Cache.Add(key, initialValue, cache.NoExpiration)
 	if err != nil { // already has value, so increment
-		value, _ := ms.Cache.IncrementInt64(key, increment)
-		return value
+		return ms.Cache.IncrementInt64(key, increment)
 	}
 
-	return initialValue
+	return initialValue, nil
 }
 
-func (ms *memoryStorage) IncrementWithError(ctx context.Context, key string, increment int64, errIncrement int64) (count int64, errCount int64) {
+func (ms *memoryStorage) IncrementWithError(ctx context.Context, key string, increment int64, errIncrement int64) (count int64, errCount int64, err error) {
 	const errUnit int64 = 1 << 32
 	const lowMask int64 = errUnit - 1
 	totalIncr := increment + errUnit*errIncrement
-	incremented := ms.Increment(ctx, key, totalIncr, totalIncr)
-	return incremented & lowMask, incremented / errUnit
+	incremented, err := ms.Increment(ctx, key, totalIncr, totalIncr)
+	return incremented & lowMask, incremented / errUnit, err
+}
+
+func (ms *memoryStorage) DeleteCounter(ctx context.Context, key string) error {
+	ms.Cache.Delete(key)
+	return nil
+}
+
+// copyRun copies the run and its outputs map. The outputs themselves are
+// not changed once kept, so they are shared.
+func copyRun(run *stepflow.DataflowRun) *stepflow.DataflowRun {
+	copied := *run
+	copied.Outputs = nil
+	addOutputs(&copied, run.Outputs)
+	return &copied
+}
+
+// copyFlow copies the flow, its splits and its loop iterations. The flow
+// data is replaced rather than changed by the steps, so it is shared.
+func copyFlow(flow *stepflow.Flow) *stepflow.Flow {
+	copied := *flow
+	copied.Splits = append([]stepflow.FlowSplitID(nil), flow.Splits...)
+	if flow.Iterations != nil {
+		copied.Iterations = make(map[string]int, len(flow.Iterations))
+		for stepID, iteration := range flow.Iterations {
+			copied.Iterations[stepID] = iteration
+		}
+	}
+	return &copied
+}
+
+func copyFlowSplit(flowSplit *stepflow.FlowSplit) *stepflow.FlowSplit {
+	copied := *flowSplit
+	copied.FlowIDs = append([]stepflow.FlowID(nil), flowSplit.FlowIDs...)
+	return &copied
+}
+
+// addOutputs adds the outputs the run does not already have
+func addOutputs(run *stepflow.DataflowRun, outputs map[string]map[string]*stepflow.FlowOutput) {
+	for stepID, stepOutputs := range outputs {
+		for key, output := range stepOutputs {
+			addOutput(run, stepID, key, output)
+		}
+	}
+}
+
+// addOutput adds the output to the run, unless it already has an output
+// for the step and key
+func addOutput(run *stepflow.DataflowRun, stepID string, key string, output *stepflow.FlowOutput) {
+	if run.Outputs == nil {
+		run.Outputs = make(map[string]map[string]*stepflow.FlowOutput)
+	}
+	stepOutputs, ok := run.Outputs[stepID]
+	if !ok {
+		stepOutputs = make(map[string]*stepflow.FlowOutput)
+		run.Outputs[stepID] = stepOutputs
+	}
+	if _, ok = stepOutputs[key]; !ok {
+		stepOutputs[key] = output
+	}
 }
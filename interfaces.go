@@ -3,6 +3,7 @@ package stepflow
 import (
 	"context"
 	"net/http"
+	"time"
 )
 
 // FlowContextKeyType used to store flow id in context
@@ -24,36 +25,68 @@ var (
 // Executor is the interface implemented by the executing engine
 type Executor interface {
 	Start(ctx context.Context, workflow *Dataflow) (*DataflowRun, []error)
+	StartWithInput(ctx context.Context, workflow *Dataflow, data interface{}, contentType string) (*DataflowRun, []error)
 	Validate(ctx context.Context, workflow *Dataflow) []error
 	Interrupt(ctx context.Context, run *DataflowRun)
+	Recover(ctx context.Context) []error
+	StartSubflow(ctx context.Context, workflow *Dataflow, parent *Flow) (*DataflowRun, []error)
+	GetDataflow(ID string) *Dataflow
+	GetFunction(name string) Function
+	Signal(ctx context.Context, token string, data interface{}, contentType string) error
 
 	GetHTTPClientFactory() HTTPClientFactory
 	GetLogger() Logger
 	GetStorage() Storage
 }
 
-// Storage is the interface implemented by external storage service
+// Storage is the interface implemented by external storage service.
+// StoreFlowOutput adds an output to a stored run without rewriting the
+// rest of it, so outputs kept by concurrent flows are not lost. For the
+// same reason, StoreDataflowRun keeps the outputs already stored, adding
+// only the outputs of the run that are not. Increment and
+// IncrementWithError return an error if the counter could not be updated,
+// since the counts tell flows whether to continue. DeleteCounter deletes
+// the counts of both Increment and IncrementWithError for the key.
 type Storage interface {
 	StoreDataflowRun(ctx context.Context, run *DataflowRun) error
+	StoreFlowOutput(ctx context.Context, runID DataflowRunID, stepID string, key string, output *FlowOutput) error
 	RetrieveDataflowRuns(ctx context.Context, keys []DataflowRunID) map[DataflowRunID]*DataflowRun
 	DeleteDataflowRun(ctx context.Context, key DataflowRunID) error
+	ListDataflowRuns(ctx context.Context) []DataflowRunID
 
 	StoreFlow(ctx context.Context, flow *Flow) error
 	RetrieveFlows(ctx context.Context, keys []FlowID) map[FlowID]*Flow
 	DeleteFlow(ctx context.Context, key FlowID) error
+	ListFlows(ctx context.Context, runID DataflowRunID) []FlowID
 
 	StoreFlowSplit(ctx context.Context, flowSplit *FlowSplit) error
 	RetrieveFlowSplits(ctx context.Context, keys []FlowSplitID) map[FlowSplitID]*FlowSplit
 	DeleteFlowSplit(ctx context.Context, key FlowSplitID) error
+	ListFlowSplits(ctx context.Context, runID DataflowRunID) []FlowSplitID
 
-	Increment(ctx context.Context, key string, initialValue int64, increment int64) int64
-	IncrementWithError(ctx context.Context, key string, increment int64, errIncrement int64) (count int64, errCount int64)
+	Increment(ctx context.Context, key string, initialValue int64, increment int64) (int64, error)
+	IncrementWithError(ctx context.Context, key string, increment int64, errIncrement int64) (count int64, errCount int64, err error)
+	DeleteCounter(ctx context.Context, key string) error
 }
 
-// FlowQueue is the interface implemented by external queue service
+// FlowQueue is the interface implemented by external queue service.
+// EnqueueAfter enqueues the flow once the delay has passed, and must not
+// block a worker in the meantime. The dequeue callback returns an error
+// only if the flow could not be handled, e.g. because the storage failed,
+// and not if its step failed, which is handled by the dataflow. Queues
+// may deliver the flow again after an error, or drop it.
 type FlowQueue interface {
 	SetDequeueCb(func(ctx context.Context, flow *Flow) error)
 	Enqueue(ctx context.Context, flow *Flow) error
+	EnqueueAfter(ctx context.Context, flow *Flow, delay time.Duration) error
+}
+
+// DurableFlowQueue is implemented by queues that keep the flows enqueued
+// until they are handled, even if the process stops, so Recover does not
+// enqueue them again
+type DurableFlowQueue interface {
+	FlowQueue
+	IsDurable() bool
 }
 
 // Logger is passed to other services for pluggable logging
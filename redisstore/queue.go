@@ -0,0 +1,370 @@
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Defaults of the queue settings
+const (
+	DefaultClaimIdle     = time.Minute
+	DefaultMaxDeliveries = 5
+)
+
+// how long a worker blocks waiting for a flow, and how often delayed
+// flows are moved to the stream
+const (
+	readBlock    = time.Second
+	pollInterval = 100 * time.Millisecond
+)
+
+// moveDueScript moves the delayed flows that are due to the stream. Each
+// member of the delayed set is a UUID followed by the flow, so that equal
+// flows delayed twice are kept apart. Both keys have the {queue} hash tag,
+// so they are in the same slot on Redis Cluster.
+var moveDueScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, member in ipairs(due) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('XADD', KEYS[2], '*', 'flow', string.sub(member, 37))
+end
+return #due
+`)
+
+// RedisQueue is a flow queue on a Redis stream, read by a consumer group
+// so flows are shared by the executors of several processes. A flow is
+// acknowledged when the dequeue callback returns without error. Flows
+// that are not acknowledged, because the callback failed or the process
+// stopped, are redelivered once they have been pending for ClaimIdle,
+// up to MaxDeliveries times. The claim on a flow is renewed while it is
+// handled, so steps can take longer than ClaimIdle. Delayed flows wait in a sorted set until
+// they are due.
+type RedisQueue struct {
+	Logger        stepflow.Logger
+	Client        redis.UniversalClient
+	Prefix        string // prepended to all keys
+	Consumer      string // name of this process in the consumer group
+	DequeueCb     func(ctx context.Context, flow *stepflow.Flow) error
+	DummyCtx      context.Context
+	ClaimIdle     time.Duration
+	MaxDeliveries int64
+	NumWorkers    int
+	WaitGroup     sync.WaitGroup
+	stop          chan struct{}
+	claims        chan redis.XPendingExt // pending messages to claim, read by the workers
+	startOnce     sync.Once
+	stopOnce      sync.Once
+}
+
+// NewRedisQueue creates a Redis flow queue, creating the stream and the
+// consumer group if needed. Keys start with the given prefix, which must
+// be the same for all the processes sharing the queue. The workers start
+// reading flows once the dequeue callback is set.
+func NewRedisQueue(logger stepflow.Logger, client redis.UniversalClient, prefix string, numWorkers int) (*RedisQueue, error) {
+	hostname, _ := os.Hostname()
+	rq := &RedisQueue{
+		Logger:        logger,
+		Client:        client,
+		Prefix:        prefix,
+		Consumer:      fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.New().String()),
+		DummyCtx:      context.Background(),
+		ClaimIdle:     DefaultClaimIdle,
+		MaxDeliveries: DefaultMaxDeliveries,
+		NumWorkers:    numWorkers,
+		stop:          make(chan struct{}),
+		claims:        make(chan redis.XPendingExt),
+	}
+
+	err := client.XGroupCreateMkStream(rq.DummyCtx, rq.streamKey(), rq.groupName(), "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("Consumer group could not be created: %s", err.Error())
+	}
+	return rq, nil
+}
+
+func (rq *RedisQueue) streamKey() string {
+	return rq.Prefix + "{queue}"
+}
+
+func (rq *RedisQueue) delayedKey() string {
+	return rq.Prefix + "{queue}:delayed"
+}
+
+func (rq *RedisQueue) groupName() string {
+	return rq.Prefix + "workers"
+}
+
+// IsDurable returns true, since flows are kept in the stream until handled
+func (rq *RedisQueue) IsDurable() bool {
+	return true
+}
+
+func (rq *RedisQueue) SetDequeueCb(cb func(ctx context.Context, flow *stepflow.Flow) error) {
+	rq.DequeueCb = cb
+	rq.Logger.Debugf(rq.DummyCtx, "Dequeue callback set")
+	rq.startOnce.Do(rq.start)
+}
+
+func (rq *RedisQueue) Enqueue(ctx context.Context, flow *stepflow.Flow) error {
+	rq.Logger.Debugf(rq.DummyCtx, "Enqueueing flow %v", flow)
+	value, err := stepflow.MarshalFlow(flow)
+	if err != nil {
+		return err
+	}
+	return rq.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: rq.streamKey(),
+		Values: map[string]interface{}{"flow": value},
+	}).Err()
+}
+
+func (rq *RedisQueue) EnqueueAfter(ctx context.Context, flow *stepflow.Flow, delay time.Duration) error {
+	if delay <= 0 {
+		return rq.Enqueue(ctx, flow)
+	}
+
+	rq.Logger.Debugf(rq.DummyCtx, "Enqueueing flow %v in %s", flow, delay)
+	value, err := stepflow.MarshalFlow(flow)
+	if err != nil {
+		return err
+	}
+	return rq.Client.ZAdd(ctx, rq.delayedKey(), redis.Z{
+		Score:  float64(time.Now().Add(delay).UnixMilli()),
+		Member: uuid.New().String() + string(value),
+	}).Err()
+}
+
+// Stop stops reading flows. The returned wait group is done when the
+// flows being handled are finished.
+func (rq *RedisQueue) Stop(ctx context.Context) (*sync.WaitGroup, error) {
+	rq.Logger.Infof(rq.DummyCtx, "Stopping Redis queue")
+	err := errors.New("Queue already stopped")
+	rq.stopOnce.Do(func() {
+		close(rq.stop)
+		err = nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rq.WaitGroup, nil
+}
+
+func (rq *RedisQueue) isStopped() bool {
+	select {
+	case <-rq.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rq *RedisQueue) start() {
+	if rq.ClaimIdle <= 0 {
+		rq.ClaimIdle = DefaultClaimIdle
+	}
+	for i := 0; i < rq.NumWorkers; i++ {
+		rq.WaitGroup.Add(1)
+		go rq.worker(i)
+	}
+	rq.WaitGroup.Add(2)
+	go rq.every(pollInterval, rq.moveDue)
+	go rq.every(rq.ClaimIdle/2, rq.claimPending)
+	rq.Logger.Debugf(rq.DummyCtx, "Started Redis queue with %d workers", rq.NumWorkers)
+}
+
+func (rq *RedisQueue) worker(workerID int) {
+	defer rq.WaitGroup.Done()
+	rq.Logger.Infof(rq.DummyCtx, "Worker %d: starting...", workerID)
+	for !rq.isStopped() {
+		select {
+		case entry := <-rq.claims:
+			rq.redeliver(workerID, entry)
+			continue
+		default:
+		}
+
+		streams, err := rq.Client.XReadGroup(rq.DummyCtx, &redis.XReadGroupArgs{
+			Group:    rq.groupName(),
+			Consumer: rq.Consumer,
+			Streams:  []string{rq.streamKey(), ">"},
+			Count:    1,
+			Block:    readBlock,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			rq.Logger.Errorf(rq.DummyCtx, "Worker %d: error reading queue: %s", workerID, err.Error())
+			rq.sleep(readBlock)
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				rq.Logger.Debugf(rq.DummyCtx, "Worker %d: dequeued message %s", workerID, message.ID)
+				rq.deliver(message)
+			}
+		}
+	}
+	rq.Logger.Infof(rq.DummyCtx, "Worker %d: exiting...", workerID)
+}
+
+// deliver calls the dequeue callback with the flow in the message, and
+// acknowledges the message if it succeeds
+func (rq *RedisQueue) deliver(message redis.XMessage) {
+	value, _ := message.Values["flow"].(string)
+	flow, err := stepflow.UnmarshalFlow([]byte(value))
+	if err != nil {
+		// it will never be read, so it is dropped
+		rq.Logger.Errorf(rq.DummyCtx, "Dropping message %s with invalid flow: %s", message.ID, err.Error())
+		rq.ack(message.ID)
+		return
+	}
+
+	// the message is claimed again while the flow is handled, so it is not
+	// redelivered to another process if the step takes longer than ClaimIdle
+	done := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		rq.renewClaim(message.ID, done)
+	}()
+	err = rq.DequeueCb(rq.DummyCtx, flow)
+	close(done)
+	<-renewed
+
+	if err != nil {
+		rq.Logger.Warnf(rq.DummyCtx, "Flow %s will be redelivered after failing: %s", flow.ID, err.Error())
+		return
+	}
+	rq.ack(message.ID)
+}
+
+// renewClaim resets the idle time of the message until done is closed.
+// Claiming with JUSTID does not count as a delivery.
+func (rq *RedisQueue) renewClaim(messageID string, done chan struct{}) {
+	ticker := time.NewTicker(rq.ClaimIdle / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := rq.Client.XClaimJustID(rq.DummyCtx, &redis.XClaimArgs{
+				Stream:   rq.streamKey(),
+				Group:    rq.groupName(),
+				Consumer: rq.Consumer,
+				MinIdle:  0,
+				Messages: []string{messageID},
+			}).Err()
+			if err != nil {
+				rq.Logger.Errorf(rq.DummyCtx, "Error renewing claim of message %s: %s", messageID, err.Error())
+			}
+		}
+	}
+}
+
+func (rq *RedisQueue) ack(messageID string) {
+	_, err := rq.Client.TxPipelined(rq.DummyCtx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(rq.DummyCtx, rq.streamKey(), rq.groupName(), messageID)
+		pipe.XDel(rq.DummyCtx, rq.streamKey(), messageID)
+		return nil
+	})
+	if err != nil {
+		rq.Logger.Errorf(rq.DummyCtx, "Error acknowledging message %s: %s", messageID, err.Error())
+	}
+}
+
+// moveDue moves the delayed flows that are due to the stream
+func (rq *RedisQueue) moveDue() {
+	now := time.Now().UnixMilli()
+	keys := []string{rq.delayedKey(), rq.streamKey()}
+	if err := moveDueScript.Run(rq.DummyCtx, rq.Client, keys, now).Err(); err != nil && err != redis.Nil {
+		rq.Logger.Errorf(rq.DummyCtx, "Error moving delayed flows: %s", err.Error())
+	}
+}
+
+// claimPending hands the messages of any consumer in the group that have
+// been pending for ClaimIdle to the workers, and drops those delivered
+// too often. It returns once the workers took them, or the queue stopped.
+func (rq *RedisQueue) claimPending() {
+	pending, err := rq.Client.XPendingExt(rq.DummyCtx, &redis.XPendingExtArgs{
+		Stream: rq.streamKey(),
+		Group:  rq.groupName(),
+		Idle:   rq.ClaimIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  100,
+	}).Result()
+	if err != nil {
+		rq.Logger.Errorf(rq.DummyCtx, "Error reading pending flows: %s", err.Error())
+		return
+	}
+
+	for _, entry := range pending {
+		if rq.isStopped() {
+			return
+		}
+		if entry.RetryCount >= rq.MaxDeliveries {
+			rq.Logger.Errorf(rq.DummyCtx, "Dropping message %s after %d deliveries", entry.ID, entry.RetryCount)
+			rq.ack(entry.ID)
+			continue
+		}
+
+		select {
+		case rq.claims <- entry:
+		case <-rq.stop:
+			return
+		}
+	}
+}
+
+// redeliver claims the pending message and delivers it. The claim fails
+// if another process claimed it in the meantime.
+func (rq *RedisQueue) redeliver(workerID int, entry redis.XPendingExt) {
+	messages, err := rq.Client.XClaim(rq.DummyCtx, &redis.XClaimArgs{
+		Stream:   rq.streamKey(),
+		Group:    rq.groupName(),
+		Consumer: rq.Consumer,
+		MinIdle:  rq.ClaimIdle,
+		Messages: []string{entry.ID},
+	}).Result()
+	if err != nil {
+		rq.Logger.Errorf(rq.DummyCtx, "Worker %d: error claiming message %s: %s", workerID, entry.ID, err.Error())
+		return
+	}
+	for _, message := range messages {
+		rq.Logger.Infof(rq.DummyCtx, "Worker %d: redelivering message %s, delivered %d times", workerID, message.ID, entry.RetryCount)
+		rq.deliver(message)
+	}
+}
+
+// every calls the function at the interval until the queue stops
+func (rq *RedisQueue) every(interval time.Duration, fn func()) {
+	defer rq.WaitGroup.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rq.stop:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+func (rq *RedisQueue) sleep(duration time.Duration) {
+	select {
+	case <-rq.stop:
+	case <-time.After(duration):
+	}
+}
@@ -0,0 +1,318 @@
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestQueue(t *testing.T, server *miniredis.Miniredis, numWorkers int) *RedisQueue {
+	rq, err := NewRedisQueue(testLogger, newTestClient(t, server), testPrefix, numWorkers)
+	if err != nil {
+		t.Fatalf("Queue could not be created: %s", err.Error())
+	}
+	return rq
+}
+
+func newTestFlow(id string) *stepflow.Flow {
+	return &stepflow.Flow{FlowNoData: stepflow.FlowNoData{ID: stepflow.FlowID(id), State: stepflow.FlowStateActive}}
+}
+
+// stopTestQueue stops the queue and waits for its workers
+func stopTestQueue(t *testing.T, rq *RedisQueue) {
+	wg, err := rq.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("Queue could not be stopped: %s", err.Error())
+	}
+	wg.Wait()
+}
+
+// readAsConsumer reads the next message for a consumer that never
+// acknowledges it, e.g. a process that stopped while handling the flow
+func readAsConsumer(t *testing.T, rq *RedisQueue, consumer string) {
+	_, err := rq.Client.XReadGroup(rq.DummyCtx, &redis.XReadGroupArgs{
+		Group:    rq.groupName(),
+		Consumer: consumer,
+		Streams:  []string{rq.streamKey(), ">"},
+		Count:    1,
+	}).Result()
+	if err != nil {
+		t.Fatalf("Message could not be read: %s", err.Error())
+	}
+}
+
+// claimPendingNow claims the pending messages, redelivering them in the
+// test goroutine instead of the workers
+func claimPendingNow(rq *RedisQueue) {
+	done := make(chan struct{})
+	go func() {
+		rq.claimPending()
+		close(done)
+	}()
+	for {
+		select {
+		case entry := <-rq.claims:
+			rq.redeliver(0, entry)
+		case <-done:
+			return
+		}
+	}
+}
+
+func pendingCount(t *testing.T, rq *RedisQueue) int64 {
+	pending, err := rq.Client.XPending(rq.DummyCtx, rq.streamKey(), rq.groupName()).Result()
+	if err != nil {
+		t.Fatalf("Pending messages could not be read: %s", err.Error())
+	}
+	return pending.Count
+}
+
+func TestGroupDeliversEachFlowOnce(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	const numFlows = 20
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(numFlows)
+	deliveries := make(map[stepflow.FlowID]int)
+	dequeueCb := func(ctx context.Context, flow *stepflow.Flow) error {
+		mu.Lock()
+		deliveries[flow.ID]++
+		mu.Unlock()
+		wg.Done()
+		return nil
+	}
+
+	// two processes sharing the queue
+	queues := []*RedisQueue{newTestQueue(t, server, 2), newTestQueue(t, server, 2)}
+	for _, rq := range queues {
+		rq.SetDequeueCb(dequeueCb)
+	}
+	for i := 0; i < numFlows; i++ {
+		if err := queues[i%2].Enqueue(ctx, newTestFlow(string(rune('a'+i)))); err != nil {
+			t.Fatalf("Flow could not be enqueued: %s", err.Error())
+		}
+	}
+	wg.Wait()
+	for _, rq := range queues {
+		stopTestQueue(t, rq)
+	}
+
+	if len(deliveries) != numFlows {
+		t.Errorf("Expected %d flows delivered, got %d", numFlows, len(deliveries))
+	}
+	for flowID, count := range deliveries {
+		if count != 1 {
+			t.Errorf("Expected flow %s delivered once, got %d deliveries", flowID, count)
+		}
+	}
+	if length, _ := queues[0].Client.XLen(ctx, queues[0].streamKey()).Result(); length != 0 {
+		t.Errorf("Expected acknowledged messages deleted, got %d in the stream", length)
+	}
+}
+
+func TestEnqueueAfterMovesDueFlows(t *testing.T) {
+	ctx := context.Background()
+	rq := newTestQueue(t, miniredis.RunT(t), 1)
+
+	if err := rq.EnqueueAfter(ctx, newTestFlow("later"), time.Hour); err != nil {
+		t.Fatalf("Flow could not be enqueued: %s", err.Error())
+	}
+	if err := rq.EnqueueAfter(ctx, newTestFlow("soon"), 10*time.Millisecond); err != nil {
+		t.Fatalf("Flow could not be enqueued: %s", err.Error())
+	}
+	// the same flow delayed twice is kept twice
+	if err := rq.EnqueueAfter(ctx, newTestFlow("soon"), 10*time.Millisecond); err != nil {
+		t.Fatalf("Flow could not be enqueued: %s", err.Error())
+	}
+
+	rq.moveDue()
+	if length, _ := rq.Client.XLen(ctx, rq.streamKey()).Result(); length != 0 {
+		t.Errorf("Expected no flows due yet, got %d in the stream", length)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	rq.moveDue()
+	messages, err := rq.Client.XRange(ctx, rq.streamKey(), "-", "+").Result()
+	if err != nil {
+		t.Fatalf("Stream could not be read: %s", err.Error())
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 flows due, got %d", len(messages))
+	}
+	for _, message := range messages {
+		value, _ := message.Values["flow"].(string)
+		if flow, err := stepflow.UnmarshalFlow([]byte(value)); err != nil || flow.ID != "soon" {
+			t.Errorf("Expected flow soon in the stream, got %s", value)
+		}
+	}
+	if delayed, _ := rq.Client.ZCard(ctx, rq.delayedKey()).Result(); delayed != 1 {
+		t.Errorf("Expected 1 flow still delayed, got %d", delayed)
+	}
+}
+
+func TestClaimPendingRedelivers(t *testing.T) {
+	ctx := context.Background()
+	rq := newTestQueue(t, miniredis.RunT(t), 0)
+	rq.ClaimIdle = 10 * time.Millisecond
+
+	if err := rq.Enqueue(ctx, newTestFlow("lost")); err != nil {
+		t.Fatalf("Flow could not be enqueued: %s", err.Error())
+	}
+	readAsConsumer(t, rq, "stopped-process")
+
+	var delivered []stepflow.FlowID
+	rq.DequeueCb = func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered = append(delivered, flow.ID)
+		return nil
+	}
+
+	// not idle for long enough yet
+	rq.ClaimIdle = time.Hour
+	claimPendingNow(rq)
+	if len(delivered) != 0 {
+		t.Fatalf("Expected no flow redelivered before ClaimIdle, got %v", delivered)
+	}
+
+	rq.ClaimIdle = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	claimPendingNow(rq)
+	if len(delivered) != 1 || delivered[0] != "lost" {
+		t.Fatalf("Expected flow lost redelivered, got %v", delivered)
+	}
+	if count := pendingCount(t, rq); count != 0 {
+		t.Errorf("Expected the redelivered flow acknowledged, got %d pending", count)
+	}
+}
+
+func TestClaimPendingDropsAfterMaxDeliveries(t *testing.T) {
+	ctx := context.Background()
+	rq := newTestQueue(t, miniredis.RunT(t), 0)
+	rq.ClaimIdle = 10 * time.Millisecond
+	rq.MaxDeliveries = 3
+
+	if err := rq.Enqueue(ctx, newTestFlow("failing")); err != nil {
+		t.Fatalf("Flow could not be enqueued: %s", err.Error())
+	}
+	readAsConsumer(t, rq, "stopped-process")
+
+	deliveries := 0
+	rq.DequeueCb = func(ctx context.Context, flow *stepflow.Flow) error {
+		deliveries++
+		return errors.New("Storage not available")
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		claimPendingNow(rq)
+	}
+
+	// the first delivery was to the stopped process
+	if deliveries != int(rq.MaxDeliveries)-1 {
+		t.Errorf("Expected %d redeliveries, got %d", rq.MaxDeliveries-1, deliveries)
+	}
+	if count := pendingCount(t, rq); count != 0 {
+		t.Errorf("Expected the flow dropped, got %d pending", count)
+	}
+}
+
+func TestClaimRenewedWhileHandled(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	var mu sync.Mutex
+	deliveries := 0
+	handled := make(chan struct{})
+	dequeueCb := func(ctx context.Context, flow *stepflow.Flow) error {
+		mu.Lock()
+		deliveries++
+		first := deliveries == 1
+		mu.Unlock()
+		time.Sleep(300 * time.Millisecond)
+		if first {
+			close(handled)
+		}
+		return nil
+	}
+
+	queues := []*RedisQueue{newTestQueue(t, server, 1), newTestQueue(t, server, 1)}
+	for _, rq := range queues {
+		rq.ClaimIdle = 60 * time.Millisecond
+		rq.SetDequeueCb(dequeueCb)
+	}
+	if err := queues[0].Enqueue(ctx, newTestFlow("slow")); err != nil {
+		t.Fatalf("Flow could not be enqueued: %s", err.Error())
+	}
+	<-handled
+	time.Sleep(100 * time.Millisecond)
+	for _, rq := range queues {
+		stopTestQueue(t, rq)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if deliveries != 1 {
+		t.Errorf("Expected the slow flow delivered once, got %d deliveries", deliveries)
+	}
+}
+
+func TestClaimedFlowHandledByWorker(t *testing.T) {
+	ctx := context.Background()
+	rq := newTestQueue(t, miniredis.RunT(t), 1)
+	rq.ClaimIdle = 20 * time.Millisecond
+
+	if err := rq.Enqueue(ctx, newTestFlow("lost")); err != nil {
+		t.Fatalf("Flow could not be enqueued: %s", err.Error())
+	}
+	readAsConsumer(t, rq, "stopped-process")
+
+	delivered := make(chan stepflow.FlowID, 1)
+	rq.SetDequeueCb(func(ctx context.Context, flow *stepflow.Flow) error {
+		delivered <- flow.ID
+		return nil
+	})
+	select {
+	case id := <-delivered:
+		if id != "lost" {
+			t.Errorf("Expected flow lost redelivered, got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the pending flow redelivered by the worker")
+	}
+	stopTestQueue(t, rq)
+}
+
+func TestClaimPendingReturnsOnStop(t *testing.T) {
+	ctx := context.Background()
+	// without workers, nothing takes the claimed messages
+	rq := newTestQueue(t, miniredis.RunT(t), 0)
+	rq.ClaimIdle = 10 * time.Millisecond
+
+	if err := rq.Enqueue(ctx, newTestFlow("lost")); err != nil {
+		t.Fatalf("Flow could not be enqueued: %s", err.Error())
+	}
+	readAsConsumer(t, rq, "stopped-process")
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		rq.claimPending()
+		close(done)
+	}()
+	stopTestQueue(t, rq)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected claimPending to return once the queue stopped")
+	}
+	if count := pendingCount(t, rq); count != 1 {
+		t.Errorf("Expected the flow still pending, got %d pending", count)
+	}
+}
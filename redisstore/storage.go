@@ -0,0 +1,377 @@
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStorage is a storage service on a Redis server, which can be
+// shared by executors in several processes. Runs, flows and splits are
+// kept as JSON in hashes, and counters are incremented with INCRBY and
+// HINCRBY. Run outputs are kept in a hash per run apart from the run, so
+// outputs added by flows in different processes are merged rather than
+// overwritten. Errors are logged and returned where the Storage interface
+// allows it. Transactions touch several keys (e.g. the runs hash and the
+// outputs of a run), so all keys have the {storage} hash tag, which puts
+// them in the same slot on Redis Cluster.
+type RedisStorage struct {
+	Logger stepflow.Logger
+	Client redis.UniversalClient
+	Prefix string // prepended to all keys
+}
+
+// NewRedisStorage creates a Redis storage service. Keys start with the
+// given prefix, so several engines can share a Redis database.
+func NewRedisStorage(logger stepflow.Logger, client redis.UniversalClient, prefix string) *RedisStorage {
+	return &RedisStorage{
+		Logger: logger,
+		Client: client,
+		Prefix: prefix,
+	}
+}
+
+func (rs *RedisStorage) runsKey() string {
+	return rs.Prefix + "{storage}:runs"
+}
+
+func (rs *RedisStorage) outputsKey(runID stepflow.DataflowRunID) string {
+	return rs.Prefix + "{storage}:outputs:" + string(runID)
+}
+
+func (rs *RedisStorage) flowsKey() string {
+	return rs.Prefix + "{storage}:flows"
+}
+
+func (rs *RedisStorage) runFlowsKey(runID stepflow.DataflowRunID) string {
+	return rs.Prefix + "{storage}:run-flows:" + string(runID)
+}
+
+func (rs *RedisStorage) flowSplitsKey() string {
+	return rs.Prefix + "{storage}:splits"
+}
+
+func (rs *RedisStorage) runSplitsKey(runID stepflow.DataflowRunID) string {
+	return rs.Prefix + "{storage}:run-splits:" + string(runID)
+}
+
+func (rs *RedisStorage) counterKey(key string) string {
+	return rs.Prefix + "{storage}:counter:" + key
+}
+
+func (rs *RedisStorage) errorCounterKey(key string) string {
+	return rs.Prefix + "{storage}:error-counter:" + key
+}
+
+// outputField is the field of an output in the outputs hash of a run
+func outputField(stepID string, key string) string {
+	field, _ := json.Marshal([]string{stepID, key})
+	return string(field)
+}
+
+func (rs *RedisStorage) StoreDataflowRun(ctx context.Context, run *stepflow.DataflowRun) error {
+	outputs := make(map[string][]byte)
+	for stepID, stepOutputs := range run.Outputs {
+		for key, output := range stepOutputs {
+			value, err := stepflow.MarshalFlowOutput(output)
+			if err != nil {
+				return fmt.Errorf("Output of step %s could not be serialized: %s", stepID, err.Error())
+			}
+			outputs[outputField(stepID, key)] = value
+		}
+	}
+
+	// the outputs are stored apart from the run
+	runNoOutputs := *run
+	runNoOutputs.Outputs = nil
+	value, err := stepflow.MarshalDataflowRun(&runNoOutputs)
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		// outputs already stored are kept
+		for field, value := range outputs {
+			pipe.HSetNX(ctx, rs.outputsKey(run.ID), field, value)
+		}
+		pipe.HSet(ctx, rs.runsKey(), string(run.ID), value)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStorage) StoreFlowOutput(ctx context.Context, runID stepflow.DataflowRunID, stepID string, key string, output *stepflow.FlowOutput) error {
+	value, err := stepflow.MarshalFlowOutput(output)
+	if err != nil {
+		return fmt.Errorf("Output of step %s could not be serialized: %s", stepID, err.Error())
+	}
+	return rs.Client.HSet(ctx, rs.outputsKey(runID), outputField(stepID, key), value).Err()
+}
+
+func (rs *RedisStorage) RetrieveDataflowRuns(ctx context.Context, keys []stepflow.DataflowRunID) map[stepflow.DataflowRunID]*stepflow.DataflowRun {
+	runs := make(map[stepflow.DataflowRunID]*stepflow.DataflowRun)
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		runs[key] = nil
+		ids[i] = string(key)
+	}
+
+	err := rs.getValues(ctx, rs.runsKey(), ids, func(id string, value string) error {
+		run, err := stepflow.UnmarshalDataflowRun([]byte(value))
+		if err != nil {
+			return fmt.Errorf("Dataflow run %s could not be read: %s", id, err.Error())
+		}
+		if run.Outputs, err = rs.retrieveOutputs(ctx, run.ID); err != nil {
+			return fmt.Errorf("Outputs of dataflow run %s could not be read: %s", id, err.Error())
+		}
+		runs[run.ID] = run
+		return nil
+	})
+	if err != nil {
+		rs.Logger.Errorf(ctx, "Error retrieving dataflow runs: %s", err.Error())
+	}
+	return runs
+}
+
+func (rs *RedisStorage) retrieveOutputs(ctx context.Context, runID stepflow.DataflowRunID) (map[string]map[string]*stepflow.FlowOutput, error) {
+	values, err := rs.Client.HGetAll(ctx, rs.outputsKey(runID)).Result()
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+
+	outputs := make(map[string]map[string]*stepflow.FlowOutput)
+	for field, value := range values {
+		var stepKey []string
+		if err = json.Unmarshal([]byte(field), &stepKey); err != nil || len(stepKey) != 2 {
+			return nil, fmt.Errorf("Invalid output field %s", field)
+		}
+		output, err := stepflow.UnmarshalFlowOutput([]byte(value))
+		if err != nil {
+			return nil, err
+		}
+		if outputs[stepKey[0]] == nil {
+			outputs[stepKey[0]] = make(map[string]*stepflow.FlowOutput)
+		}
+		outputs[stepKey[0]][stepKey[1]] = output
+	}
+	return outputs, nil
+}
+
+func (rs *RedisStorage) DeleteDataflowRun(ctx context.Context, key stepflow.DataflowRunID) error {
+	_, err := rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, rs.runsKey(), string(key))
+		pipe.Del(ctx, rs.outputsKey(key))
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStorage) ListDataflowRuns(ctx context.Context) []stepflow.DataflowRunID {
+	runIDs := []stepflow.DataflowRunID{}
+	ids, err := rs.Client.HKeys(ctx, rs.runsKey()).Result()
+	if err != nil {
+		rs.Logger.Errorf(ctx, "Error listing dataflow runs: %s", err.Error())
+	}
+	for _, id := range ids {
+		runIDs = append(runIDs, stepflow.DataflowRunID(id))
+	}
+	return runIDs
+}
+
+func (rs *RedisStorage) StoreFlow(ctx context.Context, flow *stepflow.Flow) error {
+	value, err := stepflow.MarshalFlow(flow)
+	if err != nil {
+		return err
+	}
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, rs.runFlowsKey(flow.DataflowRunID), string(flow.ID))
+		pipe.HSet(ctx, rs.flowsKey(), string(flow.ID), value)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStorage) RetrieveFlows(ctx context.Context, keys []stepflow.FlowID) map[stepflow.FlowID]*stepflow.Flow {
+	flows := make(map[stepflow.FlowID]*stepflow.Flow)
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = string(key)
+	}
+
+	err := rs.getValues(ctx, rs.flowsKey(), ids, func(id string, value string) error {
+		flow, err := stepflow.UnmarshalFlow([]byte(value))
+		if err != nil {
+			return fmt.Errorf("Flow %s could not be read: %s", id, err.Error())
+		}
+		flows[stepflow.FlowID(id)] = flow
+		return nil
+	})
+	if err != nil {
+		rs.Logger.Errorf(ctx, "Error retrieving flows: %s", err.Error())
+	}
+	return flows
+}
+
+func (rs *RedisStorage) DeleteFlow(ctx context.Context, key stepflow.FlowID) error {
+	value, err := rs.Client.HGet(ctx, rs.flowsKey(), string(key)).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// only the run ID is needed to remove the flow from the run index
+	var flow stepflow.FlowNoData
+	if err = json.Unmarshal([]byte(value), &flow); err != nil {
+		return fmt.Errorf("Flow %s could not be read: %s", key, err.Error())
+	}
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, rs.runFlowsKey(flow.DataflowRunID), string(key))
+		pipe.HDel(ctx, rs.flowsKey(), string(key))
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStorage) ListFlows(ctx context.Context, runID stepflow.DataflowRunID) []stepflow.FlowID {
+	flowIDs := []stepflow.FlowID{}
+	ids, err := rs.Client.SMembers(ctx, rs.runFlowsKey(runID)).Result()
+	if err != nil {
+		rs.Logger.Errorf(ctx, "Error listing flows of run %s: %s", runID, err.Error())
+	}
+	for _, id := range ids {
+		flowIDs = append(flowIDs, stepflow.FlowID(id))
+	}
+	return flowIDs
+}
+
+func (rs *RedisStorage) StoreFlowSplit(ctx context.Context, flowSplit *stepflow.FlowSplit) error {
+	value, err := json.Marshal(flowSplit)
+	if err != nil {
+		return err
+	}
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, rs.runSplitsKey(flowSplit.DataflowRunID), string(flowSplit.ID))
+		pipe.HSet(ctx, rs.flowSplitsKey(), string(flowSplit.ID), value)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStorage) RetrieveFlowSplits(ctx context.Context, keys []stepflow.FlowSplitID) map[stepflow.FlowSplitID]*stepflow.FlowSplit {
+	flowSplits := make(map[stepflow.FlowSplitID]*stepflow.FlowSplit)
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = string(key)
+	}
+
+	err := rs.getValues(ctx, rs.flowSplitsKey(), ids, func(id string, value string) error {
+		flowSplit := &stepflow.FlowSplit{}
+		if err := json.Unmarshal([]byte(value), flowSplit); err != nil {
+			return fmt.Errorf("Flow split %s could not be read: %s", id, err.Error())
+		}
+		flowSplits[stepflow.FlowSplitID(id)] = flowSplit
+		return nil
+	})
+	if err != nil {
+		rs.Logger.Errorf(ctx, "Error retrieving flow splits: %s", err.Error())
+	}
+	return flowSplits
+}
+
+func (rs *RedisStorage) DeleteFlowSplit(ctx context.Context, key stepflow.FlowSplitID) error {
+	value, err := rs.Client.HGet(ctx, rs.flowSplitsKey(), string(key)).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// the run ID is needed to remove the split from the run index
+	var flowSplit stepflow.FlowSplit
+	if err = json.Unmarshal([]byte(value), &flowSplit); err != nil {
+		return fmt.Errorf("Flow split %s could not be read: %s", key, err.Error())
+	}
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, rs.runSplitsKey(flowSplit.DataflowRunID), string(key))
+		pipe.HDel(ctx, rs.flowSplitsKey(), string(key))
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStorage) ListFlowSplits(ctx context.Context, runID stepflow.DataflowRunID) []stepflow.FlowSplitID {
+	flowSplitIDs := []stepflow.FlowSplitID{}
+	ids, err := rs.Client.SMembers(ctx, rs.runSplitsKey(runID)).Result()
+	if err != nil {
+		rs.Logger.Errorf(ctx, "Error listing flow splits of run %s: %s", runID, err.Error())
+	}
+	for _, id := range ids {
+		flowSplitIDs = append(flowSplitIDs, stepflow.FlowSplitID(id))
+	}
+	return flowSplitIDs
+}
+
+// Increment sets the counter to the initial value the first time it is
+// called for a key, and increments it on later calls
+func (rs *RedisStorage) Increment(ctx context.Context, key string, initialValue int64, increment int64) (int64, error) {
+	counterKey := rs.counterKey(key)
+	created, err := rs.Client.SetNX(ctx, counterKey, initialValue, 0).Result()
+	if err == nil && created {
+		return initialValue, nil
+	}
+
+	var value int64
+	if err == nil {
+		value, err = rs.Client.IncrBy(ctx, counterKey, increment).Result()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Counter %s could not be incremented: %s", key, err.Error())
+	}
+	return value, nil
+}
+
+// IncrementWithError increments both the count and the error count of
+// the key, starting from zero, in a single transaction
+func (rs *RedisStorage) IncrementWithError(ctx context.Context, key string, increment int64, errIncrement int64) (count int64, errCount int64, err error) {
+	var countCmd, errCountCmd *redis.IntCmd
+	counterKey := rs.errorCounterKey(key)
+	_, err = rs.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		countCmd = pipe.HIncrBy(ctx, counterKey, "count", increment)
+		errCountCmd = pipe.HIncrBy(ctx, counterKey, "errors", errIncrement)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("Counter %s could not be incremented: %s", key, err.Error())
+	}
+	return countCmd.Val(), errCountCmd.Val(), nil
+}
+
+func (rs *RedisStorage) DeleteCounter(ctx context.Context, key string) error {
+	return rs.Client.Del(ctx, rs.counterKey(key), rs.errorCounterKey(key)).Err()
+}
+
+// getValues calls the function with each value of the hash found for the
+// given fields
+func (rs *RedisStorage) getValues(ctx context.Context, key string, fields []string, fn func(field string, value string) error) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	values, err := rs.Client.HMGet(ctx, key, fields...).Result()
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		if text, ok := value.(string); ok {
+			if err = fn(fields[i], text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
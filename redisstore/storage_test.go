@@ -0,0 +1,243 @@
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+	"github.com/jcalvarado1965/go-stepflow/inprocess"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const testPrefix = "test:"
+
+const testDataflow = `{
+	"id": "TwoConstants",
+	"startAt": "constant-1",
+	"steps": [
+		{"id": "constant-1", "type": "constant", "next": "constant-2", "value": [1, 2, 3]},
+		{"id": "constant-2", "type": "constant", "value": {"aString": "foobar"}}
+	]
+}`
+
+var testLogger = inprocess.NewLeveledConsoleLogger(inprocess.LevelError, ioutil.Discard)
+
+// newTestClient returns a new client of the server, as a process sharing
+// the server would have, closed when the test ends
+func newTestClient(t *testing.T, server *miniredis.Miniredis) redis.UniversalClient {
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestOutputsMergedAcrossProcesses(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	storage1 := NewRedisStorage(testLogger, newTestClient(t, server), testPrefix)
+	storage2 := NewRedisStorage(testLogger, newTestClient(t, server), testPrefix)
+
+	var df stepflow.Dataflow
+	if err := json.Unmarshal([]byte(testDataflow), &df); err != nil {
+		t.Fatalf("Dataflow could not be read: %s", err.Error())
+	}
+	run := stepflow.NewDataflowRun(&df)
+	run.State = stepflow.RunStateActive
+	if err := storage1.StoreDataflowRun(ctx, run); err != nil {
+		t.Fatalf("Run could not be stored: %s", err.Error())
+	}
+
+	// each process keeps an output of its flows, then the first one stores
+	// its copy of the run, which only has its own output
+	output1 := &stepflow.FlowOutput{ContentType: "text/plain", Data: "first"}
+	output2 := &stepflow.FlowOutput{ContentType: "text/plain", Data: "second"}
+	if err := storage1.StoreFlowOutput(ctx, run.ID, "constant-1", "0", output1); err != nil {
+		t.Fatalf("Output could not be stored: %s", err.Error())
+	}
+	if err := storage2.StoreFlowOutput(ctx, run.ID, "constant-1", "1", output2); err != nil {
+		t.Fatalf("Output could not be stored: %s", err.Error())
+	}
+	run.State = stepflow.RunStateCompleted
+	run.Outputs = map[string]map[string]*stepflow.FlowOutput{
+		"constant-1": {"0": {ContentType: "text/plain", Data: "stale"}},
+	}
+	if err := storage1.StoreDataflowRun(ctx, run); err != nil {
+		t.Fatalf("Run could not be stored: %s", err.Error())
+	}
+
+	stored := storage2.RetrieveDataflowRuns(ctx, []stepflow.DataflowRunID{run.ID})[run.ID]
+	if stored == nil {
+		t.Fatalf("Run %s not found", run.ID)
+	}
+	if stored.State != stepflow.RunStateCompleted {
+		t.Errorf("Expected completed run, got %s", stored.State)
+	}
+	for key, expected := range map[string]string{"0": "first", "1": "second"} {
+		if output := stored.Outputs["constant-1"][key]; output == nil || output.Data != expected {
+			t.Errorf("Expected output %s with key %s, got %v", expected, key, output)
+		}
+	}
+
+	if err := storage2.DeleteDataflowRun(ctx, run.ID); err != nil {
+		t.Fatalf("Run could not be deleted: %s", err.Error())
+	}
+	if server.Exists(storage1.outputsKey(run.ID)) {
+		t.Errorf("Expected the outputs of the deleted run deleted")
+	}
+}
+
+func TestFlowSplitsListedByRun(t *testing.T) {
+	ctx := context.Background()
+	storage := NewRedisStorage(testLogger, newTestClient(t, miniredis.RunT(t)), testPrefix)
+
+	split := &stepflow.FlowSplit{
+		ID:            "split-1",
+		DataflowRunID: "run-1",
+		ParentFlowID:  "flow-1",
+		IndexType:     stepflow.FlowSplitKeyIndex,
+		FlowIDs:       []stepflow.FlowID{"flow-2", "flow-3"},
+	}
+	if err := storage.StoreFlowSplit(ctx, split); err != nil {
+		t.Fatalf("Split could not be stored: %s", err.Error())
+	}
+	if stored, ok := storage.RetrieveFlowSplits(ctx, []stepflow.FlowSplitID{split.ID})[split.ID]; !ok || len(stored.FlowIDs) != 2 {
+		t.Errorf("Expected split %v, got %v", split, stored)
+	}
+	if splitIDs := storage.ListFlowSplits(ctx, "run-1"); len(splitIDs) != 1 || splitIDs[0] != split.ID {
+		t.Errorf("Expected split %s listed, got %v", split.ID, splitIDs)
+	}
+
+	if err := storage.DeleteFlowSplit(ctx, split.ID); err != nil {
+		t.Fatalf("Split could not be deleted: %s", err.Error())
+	}
+	if splitIDs := storage.ListFlowSplits(ctx, "run-1"); len(splitIDs) != 0 {
+		t.Errorf("Expected no splits listed, got %v", splitIDs)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	ctx := context.Background()
+	storage := NewRedisStorage(testLogger, newTestClient(t, miniredis.RunT(t)), testPrefix)
+
+	if value, err := storage.Increment(ctx, "key", 5, 2); err != nil || value != 5 {
+		t.Errorf("Expected the initial value 5, got %d", value)
+	}
+	if value, err := storage.Increment(ctx, "key", 5, 2); err != nil || value != 7 {
+		t.Errorf("Expected 7 after incrementing, got %d", value)
+	}
+	if count, errCount, err := storage.IncrementWithError(ctx, "split", 1, 1); err != nil || count != 1 || errCount != 1 {
+		t.Errorf("Expected counts 1 and 1, got %d and %d", count, errCount)
+	}
+	if count, errCount, err := storage.IncrementWithError(ctx, "split", 1, 0); err != nil || count != 2 || errCount != 1 {
+		t.Errorf("Expected counts 2 and 1, got %d and %d", count, errCount)
+	}
+
+	for _, key := range []string{"key", "split"} {
+		if err := storage.DeleteCounter(ctx, key); err != nil {
+			t.Fatalf("Counter %s could not be deleted: %s", key, err.Error())
+		}
+	}
+	if value, err := storage.Increment(ctx, "key", 5, 2); err != nil || value != 5 {
+		t.Errorf("Expected the initial value 5 after deleting, got %d", value)
+	}
+	if count, errCount, err := storage.IncrementWithError(ctx, "split", 0, 0); err != nil || count != 0 || errCount != 0 {
+		t.Errorf("Expected counts 0 and 0 after deleting, got %d and %d", count, errCount)
+	}
+}
+
+func TestCountersAcrossProcesses(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	storages := []*RedisStorage{
+		NewRedisStorage(testLogger, newTestClient(t, server), testPrefix),
+		NewRedisStorage(testLogger, newTestClient(t, server), testPrefix),
+	}
+
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	firsts := make(chan int64, workers*increments)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			storage := storages[worker%len(storages)]
+			for j := 0; j < increments; j++ {
+				if value, _ := storage.Increment(ctx, "counter", 1, 1); value == 1 {
+					firsts <- value
+				}
+				storage.IncrementWithError(ctx, "split", 1, int64(worker%2))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(firsts)
+
+	if len(firsts) != 1 {
+		t.Errorf("Expected the initial value returned once, got it %d times", len(firsts))
+	}
+	if value, err := storages[0].Increment(ctx, "counter", 1, 0); err != nil || value != workers*increments {
+		t.Errorf("Expected counter %d, got %d", workers*increments, value)
+	}
+	count, errCount, err := storages[1].IncrementWithError(ctx, "split", 0, 0)
+	if err != nil || count != workers*increments || errCount != workers/2*increments {
+		t.Errorf("Expected counts %d and %d, got %d and %d", workers*increments, workers/2*increments, count, errCount)
+	}
+}
+
+// hashTag returns the part of the key hashed by Redis Cluster to find its
+// slot, i.e. the text between the first { and the next }, if not empty
+func hashTag(key string) string {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+func TestKeysInOneSlot(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	storage := NewRedisStorage(testLogger, newTestClient(t, server), testPrefix)
+
+	run := &stepflow.DataflowRun{
+		ID:    "run-1",
+		State: stepflow.RunStateActive,
+		Outputs: map[string]map[string]*stepflow.FlowOutput{
+			"step": {"0": {ContentType: "text/plain", Data: "output"}},
+		},
+	}
+	flow := &stepflow.Flow{FlowNoData: stepflow.FlowNoData{ID: "flow-1", DataflowRunID: run.ID}}
+	split := &stepflow.FlowSplit{ID: "split-1", DataflowRunID: run.ID}
+	if err := storage.StoreDataflowRun(ctx, run); err != nil {
+		t.Fatalf("Run could not be stored: %s", err.Error())
+	}
+	if err := storage.StoreFlow(ctx, flow); err != nil {
+		t.Fatalf("Flow could not be stored: %s", err.Error())
+	}
+	if err := storage.StoreFlowSplit(ctx, split); err != nil {
+		t.Fatalf("Split could not be stored: %s", err.Error())
+	}
+	if _, err := storage.Increment(ctx, "key", 1, 1); err != nil {
+		t.Fatalf("Counter could not be incremented: %s", err.Error())
+	}
+	if _, _, err := storage.IncrementWithError(ctx, "key", 1, 1); err != nil {
+		t.Fatalf("Counter could not be incremented: %s", err.Error())
+	}
+
+	// keys of a transaction must be in the same slot on Redis Cluster
+	keys := server.Keys()
+	if len(keys) != 8 {
+		t.Errorf("Expected 8 keys, got %v", keys)
+	}
+	for _, key := range keys {
+		if tag := hashTag(key); tag != "storage" {
+			t.Errorf("Expected key %s with the storage hash tag, got %s", key, tag)
+		}
+	}
+}
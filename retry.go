@@ -0,0 +1,87 @@
+package stepflow
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how a step is retried when it fails. MaxAttempts
+// is the total number of attempts, including the first. The delay before
+// the first retry is InitialInterval, and it is multiplied by
+// BackoffMultiplier for each subsequent retry, up to MaxInterval. If
+// RetryOnStatus or RetryOnError are set, only errors with one of the given
+// HTTP statuses, or whose message contains one of the given strings, are
+// retried. Otherwise all errors are retried.
+type RetryPolicy struct {
+	MaxAttempts       int      `json:"maxAttempts,omitempty"`
+	InitialInterval   Duration `json:"initialInterval,omitempty"`
+	BackoffMultiplier float64  `json:"backoffMultiplier,omitempty"`
+	MaxInterval       Duration `json:"maxInterval,omitempty"`
+	RetryOnStatus     []int    `json:"retryOnStatus,omitempty"`
+	RetryOnError      []string `json:"retryOnError,omitempty"`
+}
+
+// Validate checks the retry policy values
+func (p *RetryPolicy) Validate() []error {
+	errs := []error{}
+	if p.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("Retry maxAttempts must be at least 1, got %d", p.MaxAttempts))
+	}
+	if p.InitialInterval < 0 || p.MaxInterval < 0 {
+		errs = append(errs, errors.New("Retry intervals cannot be negative"))
+	}
+	if p.BackoffMultiplier != 0 && p.BackoffMultiplier < 1 {
+		errs = append(errs, fmt.Errorf("Retry backoffMultiplier must be at least 1, got %g", p.BackoffMultiplier))
+	}
+	return errs
+}
+
+// isRetryable checks whether the policy applies to the given error
+func (p *RetryPolicy) isRetryable(err error) bool {
+	if len(p.RetryOnStatus) == 0 && len(p.RetryOnError) == 0 {
+		return true
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		for _, status := range p.RetryOnStatus {
+			if status == httpErr.StatusCode {
+				return true
+			}
+		}
+	}
+
+	for _, msg := range p.RetryOnError {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getInterval returns the delay before retrying after the given number of
+// failed attempts. Without MaxInterval, the delay grows up to the longest
+// time.Duration.
+func (p *RetryPolicy) getInterval(attempts int) time.Duration {
+	if p.InitialInterval <= 0 {
+		return 0
+	}
+	multiplier := p.BackoffMultiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+
+	interval := float64(p.InitialInterval) * math.Pow(multiplier, float64(attempts-1))
+	if p.MaxInterval > 0 && interval > float64(p.MaxInterval) {
+		return time.Duration(p.MaxInterval)
+	}
+	// converting a float too large for an int64 is undefined
+	if interval >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(interval)
+}
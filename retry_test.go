@@ -0,0 +1,31 @@
+package stepflow
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRetryInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int
+		expected time.Duration
+	}{
+		{"first retry", RetryPolicy{InitialInterval: Duration(time.Second), BackoffMultiplier: 2}, 1, time.Second},
+		{"backoff", RetryPolicy{InitialInterval: Duration(time.Second), BackoffMultiplier: 2}, 4, 8 * time.Second},
+		{"no multiplier", RetryPolicy{InitialInterval: Duration(time.Second)}, 4, time.Second},
+		{"max interval", RetryPolicy{InitialInterval: Duration(time.Second), BackoffMultiplier: 2, MaxInterval: Duration(5 * time.Second)}, 4, 5 * time.Second},
+		{"max interval overflow", RetryPolicy{InitialInterval: Duration(time.Second), BackoffMultiplier: 10, MaxInterval: Duration(time.Minute)}, 100, time.Minute},
+		{"overflow", RetryPolicy{InitialInterval: Duration(time.Second), BackoffMultiplier: 10}, 100, math.MaxInt64},
+		{"infinite", RetryPolicy{InitialInterval: Duration(time.Second), BackoffMultiplier: 10}, 1000, math.MaxInt64},
+		{"no initial interval", RetryPolicy{BackoffMultiplier: 10}, 1000, 0},
+	}
+
+	for _, test := range tests {
+		if interval := test.policy.getInterval(test.attempts); interval != test.expected {
+			t.Errorf("%s: expected interval %s, got %s", test.name, test.expected, interval)
+		}
+	}
+}
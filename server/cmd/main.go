@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+	"github.com/jcalvarado1965/go-stepflow/boltstore"
+	"github.com/jcalvarado1965/go-stepflow/inprocess"
+	"github.com/jcalvarado1965/go-stepflow/server"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "Address to listen on. The API is not authenticated, so listen on other interfaces only behind an authenticating proxy")
+	dataflowDir := flag.String("dataflows", "", "Directory of JSON or YAML dataflows to register, so runs can be started by dataflow ID")
+	workers := flag.Int("workers", 10, "Number of queue workers")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	dbFile := flag.String("db", "", "Path to a bbolt database file to keep runs in, so they survive restarts. Runs are kept in memory if not set")
+	queueFile := flag.String("queue", "", "Path to a log file to keep queued flows in, so they survive restarts. Flows are queued in memory if not set")
+	flag.Parse()
+
+	level, err := inprocess.ParseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "Number of workers must be at least 1")
+		os.Exit(2)
+	}
+
+	dataflows, err := loadDataflows(*dataflowDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	logger := inprocess.NewLeveledConsoleLogger(level, os.Stdout)
+	var flowQueue interface {
+		stepflow.FlowQueue
+		Stop(ctx context.Context) (*sync.WaitGroup, error)
+	}
+	if *queueFile != "" {
+		fileQueue, err := inprocess.NewFileQueue(logger, *queueFile, *workers)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		flowQueue = fileQueue
+	} else {
+		flowQueue = inprocess.NewMemoryQueue(logger, *workers).(*inprocess.MemoryQueue)
+	}
+	storage := inprocess.NewMemoryStorage(logger)
+	if *dbFile != "" {
+		boltStorage, err := boltstore.NewBoltStorage(logger, *dbFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		defer boltStorage.Close()
+		storage = boltStorage
+	}
+	executor := stepflow.NewExecutor(inprocess.NewHTTPClientFactory(), logger, storage, flowQueue,
+		stepflow.WithDataflows(dataflows...))
+	ctx := context.Background()
+
+	// resume the runs that were active when the server stopped. Flows kept
+	// in a queue file are delivered again by the queue itself, but the runs
+	// still need their deadlines and finished flows accounted for.
+	for _, err := range executor.Recover(ctx) {
+		logger.Errorf(ctx, "Error recovering runs: %s", err.Error())
+	}
+
+	httpServer := &http.Server{
+		Addr:    *addr,
+		Handler: server.NewServer(executor),
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		logger.Infof(ctx, "Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	logger.Infof(ctx, "Listening on %s", *addr)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Errorf(ctx, "Server failed: %s", err.Error())
+		os.Exit(1)
+	}
+
+	wg, _ := flowQueue.Stop(ctx)
+	if wg != nil {
+		logger.Debugf(ctx, "Waiting for queue to stop")
+		wg.Wait()
+	}
+}
+
+// loadDataflows loads the JSON and YAML dataflows in the directory. The
+// dataflow IDs must be unique, since dataflows are started by ID.
+func loadDataflows(dir string) ([]*stepflow.Dataflow, error) {
+	dataflows := []*stepflow.Dataflow{}
+	paths := make(map[string]string) // by dataflow ID
+	if dir == "" {
+		return dataflows, nil
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Dataflow directory %s could not be read: %s", dir, err.Error())
+	}
+	for _, file := range files {
+		switch filepath.Ext(file.Name()) {
+		case ".json", ".yaml", ".yml":
+		default:
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		workflow, err := stepflow.LoadDataflow(path)
+		if err != nil {
+			return nil, fmt.Errorf("Dataflow in %s could not be read: %s", path, err.Error())
+		}
+		if other, ok := paths[workflow.ID]; ok {
+			return nil, fmt.Errorf("Dataflow ID %s is used in both %s and %s", workflow.ID, other, path)
+		}
+		paths[workflow.ID] = path
+		dataflows = append(dataflows, workflow)
+	}
+	return dataflows, nil
+}
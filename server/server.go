@@ -0,0 +1,371 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+// maxBodySize limits the size of request bodies
+const maxBodySize = 10 << 20
+
+// Server exposes an executor over a REST API:
+//
+//	POST /runs                  start a run of a dataflow with input
+//	GET  /runs                  list the runs
+//	GET  /runs/{id}             get the state and outputs of a run
+//	POST /runs/{id}/interrupt   interrupt a run
+//	POST /validate              validate a dataflow without running it
+//	POST /signals/{token}       signal a flow waiting in a wait-for-signal step
+//
+// Requests and responses are JSON.
+type Server struct {
+	Executor stepflow.Executor
+	Storage  stepflow.Storage
+	Logger   stepflow.Logger
+}
+
+// StartRequest is the body of a request to start a run. Either Dataflow
+// or DataflowID (of a dataflow registered with the executor) must be set.
+// Input is the initial flow data; it is passed as JSON unless ContentType
+// is set to something else, in which case Input must be a JSON string.
+type StartRequest struct {
+	Dataflow    *stepflow.Dataflow `json:"dataflow,omitempty"`
+	DataflowID  string             `json:"dataflowId,omitempty"`
+	Input       json.RawMessage    `json:"input,omitempty"`
+	ContentType string             `json:"contentType,omitempty"`
+}
+
+// SignalRequest is the body of a signal request. Data and ContentType are
+// interpreted as the Input and ContentType of a StartRequest.
+type SignalRequest struct {
+	Data        json.RawMessage `json:"data,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+}
+
+// RunSummary describes a run in the run list
+type RunSummary struct {
+	ID         stepflow.DataflowRunID    `json:"id"`
+	DataflowID string                    `json:"dataflowId"`
+	State      stepflow.DataflowRunState `json:"state"`
+	Message    string                    `json:"message,omitempty"`
+}
+
+// Run describes the state and outputs of a run. Signals lists the flows
+// waiting for a signal, with the token to signal them.
+type Run struct {
+	RunSummary
+	Deadline    *time.Time                                 `json:"deadline,omitempty"`
+	ParentRunID stepflow.DataflowRunID                     `json:"parentRunId,omitempty"`
+	Outputs     map[string]map[string]*stepflow.FlowOutput `json:"outputs,omitempty"`
+	Signals     []*WaitingSignal                           `json:"signals,omitempty"`
+}
+
+// WaitingSignal is a flow waiting for a signal
+type WaitingSignal struct {
+	FlowID stepflow.FlowID `json:"flowId"`
+	StepID string          `json:"stepId"`
+	Token  string          `json:"token"`
+}
+
+// ErrorResponse is returned on failed requests. Errors has the validation
+// errors of a dataflow.
+type ErrorResponse struct {
+	Error  string   `json:"error"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// NewServer creates a server for the executor, using the executor
+// storage and logger
+func NewServer(executor stepflow.Executor) *Server {
+	return &Server{
+		Executor: executor,
+		Storage:  executor.GetStorage(),
+		Logger:   executor.GetLogger(),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "runs":
+		s.handleMethods(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:  s.listRuns,
+			http.MethodPost: s.startRun,
+		})
+	case parts[0] == "runs" && len(parts) == 2:
+		s.handleMethods(w, r, map[string]http.HandlerFunc{
+			http.MethodGet: func(w http.ResponseWriter, r *http.Request) { s.getRun(w, r, parts[1]) },
+		})
+	case parts[0] == "runs" && len(parts) == 3 && parts[2] == "interrupt":
+		s.handleMethods(w, r, map[string]http.HandlerFunc{
+			http.MethodPost: func(w http.ResponseWriter, r *http.Request) { s.interruptRun(w, r, parts[1]) },
+		})
+	case path == "validate":
+		s.handleMethods(w, r, map[string]http.HandlerFunc{
+			http.MethodPost: s.validate,
+		})
+	case parts[0] == "signals" && len(parts) == 2:
+		s.handleMethods(w, r, map[string]http.HandlerFunc{
+			http.MethodPost: func(w http.ResponseWriter, r *http.Request) { s.signal(w, r, parts[1]) },
+		})
+	default:
+		s.writeError(w, http.StatusNotFound, fmt.Sprintf("No resource at %s", r.URL.Path))
+	}
+}
+
+func (s *Server) handleMethods(w http.ResponseWriter, r *http.Request, handlers map[string]http.HandlerFunc) {
+	if handler, ok := handlers[r.Method]; ok {
+		handler(w, r)
+		return
+	}
+
+	allowed := []string{}
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	s.writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method))
+}
+
+func (s *Server) startRun(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req StartRequest
+	if err := s.readJSON(r, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	workflow, err := s.getDataflow(&req)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	data, contentType, err := inputData(req.Input, req.ContentType)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the run outlives the request, so it keeps the request values but not
+	// its cancellation
+	run, errs := s.Executor.StartWithInput(context.WithoutCancel(ctx), workflow, data, contentType)
+	if len(errs) > 0 {
+		s.writeValidationErrors(w, errs)
+		return
+	}
+
+	s.Logger.Infof(ctx, "Started run %s of dataflow %s", run.ID, workflow.ID)
+	s.writeJSON(w, http.StatusCreated, s.describeRun(ctx, run))
+}
+
+func (s *Server) listRuns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	runs := s.Storage.RetrieveDataflowRuns(ctx, s.Storage.ListDataflowRuns(ctx))
+
+	summaries := []*RunSummary{}
+	for _, run := range runs {
+		if run != nil {
+			summaries = append(summaries, summarizeRun(run))
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+	s.writeJSON(w, http.StatusOK, summaries)
+}
+
+func (s *Server) getRun(w http.ResponseWriter, r *http.Request, runID string) {
+	ctx := r.Context()
+	run := s.retrieveRun(ctx, runID)
+	if run == nil {
+		s.writeError(w, http.StatusNotFound, fmt.Sprintf("Run %s not found", runID))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.describeRun(ctx, run))
+}
+
+func (s *Server) interruptRun(w http.ResponseWriter, r *http.Request, runID string) {
+	ctx := r.Context()
+	run := s.retrieveRun(ctx, runID)
+	if run == nil {
+		s.writeError(w, http.StatusNotFound, fmt.Sprintf("Run %s not found", runID))
+		return
+	}
+	if run.IsFinished() {
+		s.writeError(w, http.StatusConflict, fmt.Sprintf("Run %s already finished with state %s", runID, run.State))
+		return
+	}
+
+	s.Executor.Interrupt(ctx, run)
+	s.Logger.Infof(ctx, "Interrupted run %s", run.ID)
+	if current := s.retrieveRun(ctx, runID); current != nil {
+		run = current
+	}
+	s.writeJSON(w, http.StatusOK, s.describeRun(ctx, run))
+}
+
+func (s *Server) validate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workflow := &stepflow.Dataflow{}
+	if err := s.readJSON(r, workflow); err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if errs := s.Executor.Validate(ctx, workflow); len(errs) > 0 {
+		s.writeValidationErrors(w, errs)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) signal(w http.ResponseWriter, r *http.Request, token string) {
+	ctx := r.Context()
+	var req SignalRequest
+	if err := s.readJSON(r, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	data, contentType, err := inputData(req.Data, req.ContentType)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the signalled flow continues after the request, so it keeps the
+	// request values but not its cancellation
+	if err := s.Executor.Signal(context.WithoutCancel(ctx), token, data, contentType); errors.Is(err, stepflow.ErrSignalNotFound) {
+		s.writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		// e.g. the run already finished
+		s.writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getDataflow returns the dataflow given inline or by ID in the request
+func (s *Server) getDataflow(req *StartRequest) (*stepflow.Dataflow, error) {
+	if req.Dataflow != nil && req.DataflowID != "" {
+		return nil, fmt.Errorf("Only one of dataflow and dataflowId can be set")
+	}
+	if req.Dataflow != nil {
+		return req.Dataflow, nil
+	}
+	if req.DataflowID == "" {
+		return nil, fmt.Errorf("One of dataflow or dataflowId must be set")
+	}
+	if workflow := s.Executor.GetDataflow(req.DataflowID); workflow != nil {
+		return workflow, nil
+	}
+	return nil, fmt.Errorf("Dataflow %s is not registered", req.DataflowID)
+}
+
+// inputData converts the raw JSON input to flow data. Input for content
+// types other than JSON must be a JSON string.
+func inputData(input json.RawMessage, contentType string) (interface{}, string, error) {
+	if len(input) == 0 {
+		return nil, "", nil
+	}
+	if contentType == "" || contentType == "application/json" {
+		return input, "application/json", nil
+	}
+
+	var text string
+	if err := json.Unmarshal(input, &text); err != nil {
+		return nil, "", fmt.Errorf("Input with content type %s must be a JSON string", contentType)
+	}
+	return stepflow.FlowDataFromBytes(contentType, []byte(text)), contentType, nil
+}
+
+func (s *Server) retrieveRun(ctx context.Context, runID string) *stepflow.DataflowRun {
+	ID := stepflow.DataflowRunID(runID)
+	return s.Storage.RetrieveDataflowRuns(ctx, []stepflow.DataflowRunID{ID})[ID]
+}
+
+func (s *Server) describeRun(ctx context.Context, run *stepflow.DataflowRun) *Run {
+	desc := &Run{
+		RunSummary:  *summarizeRun(run),
+		ParentRunID: run.ParentRunID,
+		Outputs:     run.Outputs,
+	}
+	if !run.Deadline.IsZero() {
+		deadline := run.Deadline
+		desc.Deadline = &deadline
+	}
+
+	if !run.IsFinished() {
+		flows := s.Storage.RetrieveFlows(ctx, s.Storage.ListFlows(ctx, run.ID))
+		for _, flow := range flows {
+			if flow != nil && flow.State == stepflow.FlowStateWaiting && flow.SignalToken != "" {
+				desc.Signals = append(desc.Signals, &WaitingSignal{
+					FlowID: flow.ID,
+					StepID: flow.NextStepID,
+					Token:  flow.SignalToken,
+				})
+			}
+		}
+		sort.Slice(desc.Signals, func(i, j int) bool { return desc.Signals[i].FlowID < desc.Signals[j].FlowID })
+	}
+	return desc
+}
+
+func summarizeRun(run *stepflow.DataflowRun) *RunSummary {
+	summary := &RunSummary{
+		ID:      run.ID,
+		State:   run.State,
+		Message: run.Message,
+	}
+	if run.Dataflow != nil {
+		summary.DataflowID = run.Dataflow.ID
+	}
+	return summary
+}
+
+func (s *Server) readJSON(r *http.Request, value interface{}) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	if err != nil {
+		return fmt.Errorf("Request body could not be read: %s", err.Error())
+	}
+	if err = json.Unmarshal(body, value); err != nil {
+		return fmt.Errorf("Request body is not valid: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *Server) writeValidationErrors(w http.ResponseWriter, errs []error) {
+	resp := &ErrorResponse{Error: "Dataflow is not valid"}
+	for _, err := range errs {
+		resp.Errors = append(resp.Errors, err.Error())
+	}
+	s.writeJSON(w, http.StatusBadRequest, resp)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, &ErrorResponse{Error: message})
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		s.Logger.Errorf(context.Background(), "Response could not be serialized: %s", err.Error())
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(&ErrorResponse{Error: "Response could not be serialized"})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
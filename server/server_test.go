@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+	"github.com/jcalvarado1965/go-stepflow/inprocess"
+)
+
+const constantDataflow = `{
+	"id": "Constant",
+	"startAt": "constant",
+	"steps": [{"id": "constant", "type": "constant", "value": {"answer": 42}}]
+}`
+
+const signalDataflow = `{
+	"id": "Signal",
+	"startAt": "wait",
+	"steps": [{"id": "wait", "type": "wait-for-signal"}]
+}`
+
+func newTestServer(t *testing.T, options ...stepflow.ExecutorOption) *Server {
+	logger := inprocess.NewLeveledConsoleLogger(inprocess.LevelWarn, ioutil.Discard)
+	queue := inprocess.NewMemoryQueue(logger, 2).(*inprocess.MemoryQueue)
+	t.Cleanup(func() { queue.Stop(context.Background()) })
+	exec := stepflow.NewExecutor(inprocess.NewHTTPClientFactory(), logger, inprocess.NewMemoryStorage(logger), queue, options...)
+	return NewServer(exec)
+}
+
+func readTestDataflow(t *testing.T, dataflowJSON string) *stepflow.Dataflow {
+	var df stepflow.Dataflow
+	if err := json.Unmarshal([]byte(dataflowJSON), &df); err != nil {
+		t.Fatalf("Dataflow could not be read: %s", err.Error())
+	}
+	return &df
+}
+
+// serve sends the request to the server, and decodes the JSON response
+// into resp if it is not nil
+func serve(t *testing.T, s *Server, method string, path string, body string, resp interface{}) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if resp != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			t.Fatalf("%s %s response could not be read: %s", method, path, err.Error())
+		}
+	}
+	return rec
+}
+
+// startTestRun starts a run with the request, and returns it
+func startTestRun(t *testing.T, s *Server, body string) *Run {
+	var run Run
+	if rec := serve(t, s, http.MethodPost, "/runs", body, &run); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d starting a run, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	return &run
+}
+
+// waitForRun gets the run until the condition is satisfied
+func waitForRun(t *testing.T, s *Server, runID stepflow.DataflowRunID, condition func(run *Run) bool) *Run {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var run Run
+		if rec := serve(t, s, http.MethodGet, "/runs/"+string(runID), "", &run); rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %d getting run %s, got %d: %s", http.StatusOK, runID, rec.Code, rec.Body.String())
+		}
+		if condition(&run) {
+			return &run
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Run %s did not reach the expected state, last got %v", runID, run)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func isFinished(run *Run) bool {
+	return run.State != stepflow.RunStateNew && run.State != stepflow.RunStateActive
+}
+
+func TestStartAndGetRun(t *testing.T) {
+	s := newTestServer(t)
+	run := startTestRun(t, s, `{"dataflow": `+constantDataflow+`}`)
+	if run.ID == "" || run.DataflowID != "Constant" {
+		t.Errorf("Expected a run of dataflow Constant, got %v", run)
+	}
+
+	run = waitForRun(t, s, run.ID, isFinished)
+	if run.State != stepflow.RunStateCompleted {
+		t.Fatalf("Expected completed run, got %s: %s", run.State, run.Message)
+	}
+	output, _ := json.Marshal(run.Outputs["constant"])
+	if !strings.Contains(string(output), `{"answer":42}`) {
+		t.Errorf("Expected the constant step output, got %s", output)
+	}
+}
+
+func TestStartRegisteredDataflowWithInput(t *testing.T) {
+	s := newTestServer(t, stepflow.WithDataflows(readTestDataflow(t, signalDataflow)))
+	run := startTestRun(t, s, `{"dataflowId": "Signal", "input": "hello", "contentType": "text/plain"}`)
+	if run.DataflowID != "Signal" {
+		t.Errorf("Expected a run of dataflow Signal, got %s", run.DataflowID)
+	}
+}
+
+func TestStartOutlivesRequest(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(`{"dataflow": `+constantDataflow+`}`)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	cancel()
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d starting a run, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var run Run
+	json.Unmarshal(rec.Body.Bytes(), &run)
+	if run := waitForRun(t, s, run.ID, isFinished); run.State != stepflow.RunStateCompleted {
+		t.Errorf("Expected the run completed after the request was cancelled, got %s: %s", run.State, run.Message)
+	}
+}
+
+func TestStartBadRequests(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `{"dataflow": `},
+		{"no dataflow", `{}`},
+		{"both dataflow and ID", `{"dataflow": ` + constantDataflow + `, "dataflowId": "Constant"}`},
+		{"unregistered dataflow", `{"dataflowId": "Unknown"}`},
+		{"text input not a string", `{"dataflow": ` + constantDataflow + `, "input": 1, "contentType": "text/plain"}`},
+		{"invalid dataflow", `{"dataflow": {"id": "Invalid", "steps": []}}`},
+	}
+
+	for _, test := range tests {
+		var resp ErrorResponse
+		if rec := serve(t, s, http.MethodPost, "/runs", test.body, &resp); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusBadRequest, rec.Code)
+		}
+		if resp.Error == "" {
+			t.Errorf("%s: expected an error message", test.name)
+		}
+	}
+}
+
+func TestListRuns(t *testing.T) {
+	s := newTestServer(t)
+	first := startTestRun(t, s, `{"dataflow": `+constantDataflow+`}`)
+	second := startTestRun(t, s, `{"dataflow": `+signalDataflow+`}`)
+
+	var runs []*RunSummary
+	if rec := serve(t, s, http.MethodGet, "/runs", "", &runs); rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d listing runs, got %d", http.StatusOK, rec.Code)
+	}
+	found := make(map[stepflow.DataflowRunID]string)
+	for _, run := range runs {
+		found[run.ID] = run.DataflowID
+	}
+	if len(runs) != 2 || found[first.ID] != "Constant" || found[second.ID] != "Signal" {
+		t.Errorf("Expected the 2 runs started, got %v", found)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	s := newTestServer(t)
+	run := startTestRun(t, s, `{"dataflow": `+signalDataflow+`}`)
+	run = waitForRun(t, s, run.ID, func(run *Run) bool { return len(run.Signals) == 1 })
+	token := run.Signals[0].Token
+	if run.Signals[0].StepID != "wait" {
+		t.Errorf("Expected the flow waiting in step wait, got %s", run.Signals[0].StepID)
+	}
+
+	body := `{"data": {"approved": true}}`
+	if rec := serve(t, s, http.MethodPost, "/signals/"+token, body, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d signalling, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	run = waitForRun(t, s, run.ID, isFinished)
+	if run.State != stepflow.RunStateCompleted {
+		t.Errorf("Expected completed run, got %s: %s", run.State, run.Message)
+	}
+
+	// the flow is deleted once the run completes, so the token is unknown
+	if rec := serve(t, s, http.MethodPost, "/signals/"+token, body, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d signalling twice, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := serve(t, s, http.MethodPost, "/signals/unknown", body, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d with an unknown token, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := serve(t, s, http.MethodPost, "/signals/"+token, `{"data": `, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d with an invalid body, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+// finishedRunExecutor fails signals as if the run of the flow had already
+// finished
+type finishedRunExecutor struct {
+	stepflow.Executor
+}
+
+func (e *finishedRunExecutor) Signal(ctx context.Context, token string, data interface{}, contentType string) error {
+	return fmt.Errorf("Dataflow run of signal %s already finished", token)
+}
+
+func TestSignalFinishedRun(t *testing.T) {
+	s := newTestServer(t)
+	s.Executor = &finishedRunExecutor{s.Executor}
+	var resp ErrorResponse
+	if rec := serve(t, s, http.MethodPost, "/signals/token", `{"data": true}`, &resp); rec.Code != http.StatusConflict {
+		t.Errorf("Expected status %d signalling a finished run, got %d", http.StatusConflict, rec.Code)
+	}
+	if resp.Error == "" {
+		t.Errorf("Expected an error message")
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	s := newTestServer(t)
+	run := startTestRun(t, s, `{"dataflow": `+signalDataflow+`}`)
+	waitForRun(t, s, run.ID, func(run *Run) bool { return len(run.Signals) == 1 })
+
+	path := "/runs/" + string(run.ID) + "/interrupt"
+	if rec := serve(t, s, http.MethodPost, path, "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d interrupting, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	run = waitForRun(t, s, run.ID, isFinished)
+	if run.State != stepflow.RunStateInterrupted {
+		t.Errorf("Expected interrupted run, got %s", run.State)
+	}
+	if rec := serve(t, s, http.MethodPost, path, "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("Expected status %d interrupting a finished run, got %d", http.StatusConflict, rec.Code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := newTestServer(t)
+	if rec := serve(t, s, http.MethodPost, "/validate", constantDataflow, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d validating a valid dataflow, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	var resp ErrorResponse
+	if rec := serve(t, s, http.MethodPost, "/validate", `{"id": "Invalid", "steps": []}`, &resp); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d validating an invalid dataflow, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if len(resp.Errors) == 0 {
+		t.Errorf("Expected the validation errors, got %v", resp)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"/runs/unknown", "/runs/unknown/interrupt", "/unknown", "/runs/unknown/other"} {
+		method := http.MethodGet
+		if strings.HasSuffix(path, "/interrupt") {
+			method = http.MethodPost
+		}
+		var resp ErrorResponse
+		if rec := serve(t, s, method, path, "", &resp); rec.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d for %s %s, got %d", http.StatusNotFound, method, path, rec.Code)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	s := newTestServer(t)
+	rec := serve(t, s, http.MethodDelete, "/runs", "", nil)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("Expected GET and POST allowed, got %s", allow)
+	}
+}
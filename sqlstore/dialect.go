@@ -0,0 +1,114 @@
+package sqlstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect holds the SQL differences between databases. The storage
+// writes queries with ? placeholders and standard SQL otherwise.
+type Dialect struct {
+	Name string
+	// TextType is the column type for serialized runs and flows
+	TextType string
+	// Numbered is true if placeholders are numbered ($1, $2...) instead of ?
+	Numbered bool
+	// InsertIgnore inserts the row unless a row with the same key exists.
+	// The key columns are separated by commas if there are several.
+	InsertIgnore func(table string, keyColumn string, columns []string) string
+	// Upsert inserts the row, or replaces the other columns of the row
+	// with the same key
+	Upsert func(table string, keyColumn string, columns []string) string
+}
+
+// These are the supported databases
+var (
+	SQLite = &Dialect{
+		Name:         "sqlite",
+		TextType:     "TEXT",
+		InsertIgnore: onConflictDoNothing,
+		Upsert:       onConflictDoUpdate,
+	}
+	Postgres = &Dialect{
+		Name:         "postgres",
+		TextType:     "TEXT",
+		Numbered:     true,
+		InsertIgnore: onConflictDoNothing,
+		Upsert:       onConflictDoUpdate,
+	}
+	MySQL = &Dialect{
+		Name:     "mysql",
+		TextType: "LONGTEXT",
+		InsertIgnore: func(table string, keyColumn string, columns []string) string {
+			return "INSERT IGNORE" + strings.TrimPrefix(insert(table, columns), "INSERT")
+		},
+		Upsert: func(table string, keyColumn string, columns []string) string {
+			updates := []string{}
+			for _, column := range columns {
+				if !isKeyColumn(keyColumn, column) {
+					updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", column, column))
+				}
+			}
+			return insert(table, columns) + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+		},
+	}
+)
+
+// GetDialect returns the dialect with the given name
+func GetDialect(name string) (*Dialect, error) {
+	for _, dialect := range []*Dialect{SQLite, Postgres, MySQL} {
+		if dialect.Name == name {
+			return dialect, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown SQL dialect %s", name)
+}
+
+// rebind replaces ? placeholders for dialects with numbered placeholders
+func (d *Dialect) rebind(query string) string {
+	if !d.Numbered {
+		return query
+	}
+
+	var builder strings.Builder
+	index := 0
+	for _, char := range query {
+		if char == '?' {
+			index++
+			fmt.Fprintf(&builder, "$%d", index)
+		} else {
+			builder.WriteRune(char)
+		}
+	}
+	return builder.String()
+}
+
+// isKeyColumn returns true if the column is one of the comma separated
+// key columns
+func isKeyColumn(keyColumn string, column string) bool {
+	for _, key := range strings.Split(keyColumn, ",") {
+		if strings.TrimSpace(key) == column {
+			return true
+		}
+	}
+	return false
+}
+
+func insert(table string, columns []string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders)
+}
+
+func onConflictDoNothing(table string, keyColumn string, columns []string) string {
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO NOTHING", insert(table, columns), keyColumn)
+}
+
+func onConflictDoUpdate(table string, keyColumn string, columns []string) string {
+	updates := []string{}
+	for _, column := range columns {
+		if !isKeyColumn(keyColumn, column) {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", column, column))
+		}
+	}
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", insert(table, columns), keyColumn, strings.Join(updates, ", "))
+}
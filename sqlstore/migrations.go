@@ -0,0 +1,80 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations are the schema changes, applied in order. Each migration is
+// applied once, and its index (starting at 1) is recorded as the schema
+// version. Migrations must never be changed once released; add a new one
+// instead.
+var migrations = []func(d *Dialect) []string{
+	func(d *Dialect) []string {
+		return []string{
+			`CREATE TABLE stepflow_runs (
+				id VARCHAR(64) NOT NULL PRIMARY KEY,
+				state VARCHAR(32) NOT NULL,
+				data ` + d.TextType + ` NOT NULL
+			)`,
+			`CREATE TABLE stepflow_flows (
+				id VARCHAR(64) NOT NULL PRIMARY KEY,
+				run_id VARCHAR(64) NOT NULL,
+				data ` + d.TextType + ` NOT NULL
+			)`,
+			`CREATE INDEX stepflow_flows_run_id ON stepflow_flows (run_id)`,
+			`CREATE TABLE stepflow_splits (
+				id VARCHAR(64) NOT NULL PRIMARY KEY,
+				run_id VARCHAR(64) NOT NULL,
+				data ` + d.TextType + ` NOT NULL
+			)`,
+			`CREATE INDEX stepflow_splits_run_id ON stepflow_splits (run_id)`,
+			`CREATE TABLE stepflow_counters (
+				id VARCHAR(255) NOT NULL PRIMARY KEY,
+				total BIGINT NOT NULL,
+				error_total BIGINT NOT NULL
+			)`,
+			// outputs are kept apart from the run, so flows can add them
+			// without rewriting it
+			`CREATE TABLE stepflow_outputs (
+				run_id VARCHAR(64) NOT NULL,
+				step_id VARCHAR(255) NOT NULL,
+				output_key VARCHAR(255) NOT NULL,
+				data ` + d.TextType + ` NOT NULL,
+				PRIMARY KEY (run_id, step_id, output_key)
+			)`,
+		}
+	},
+}
+
+// migrate creates the tables, or updates them to the latest schema
+func (ss *SQLStorage) migrate(ctx context.Context) error {
+	_, err := ss.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS stepflow_schema (version INT NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		return fmt.Errorf("Schema version table could not be created: %s", err.Error())
+	}
+
+	var version int
+	err = ss.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM stepflow_schema`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("Schema version could not be read: %s", err.Error())
+	}
+
+	for ; version < len(migrations); version++ {
+		ss.Logger.Infof(ctx, "Migrating SQL storage schema to version %d", version+1)
+		err = ss.transact(ctx, func(tx *sql.Tx) error {
+			for _, statement := range migrations[version](ss.Dialect) {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx, ss.Dialect.rebind(`INSERT INTO stepflow_schema (version) VALUES (?)`), version+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Schema could not be migrated to version %d: %s", version+1, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+// maxQueryIDs is the most IDs retrieved in one query
+const maxQueryIDs = 500
+
+// outputColumns are the columns of the outputs table
+var outputColumns = []string{"run_id", "step_id", "output_key", "data"}
+
+// SQLStorage is a durable storage service on a SQL database accessed
+// through database/sql. Runs, flows and splits are kept as JSON in their
+// own tables, with the run outputs in a table apart from the runs, and
+// counters are incremented with atomic UPDATE statements.
+// The database driver is chosen by the application, with the matching
+// Dialect. Errors are logged and returned where the Storage interface
+// allows it.
+type SQLStorage struct {
+	Logger  stepflow.Logger
+	DB      *sql.DB
+	Dialect *Dialect
+}
+
+// NewSQLStorage creates a storage service on the database, creating or
+// migrating its tables if needed
+func NewSQLStorage(logger stepflow.Logger, db *sql.DB, dialect *Dialect) (*SQLStorage, error) {
+	ss := &SQLStorage{
+		Logger:  logger,
+		DB:      db,
+		Dialect: dialect,
+	}
+	if err := ss.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (ss *SQLStorage) StoreDataflowRun(ctx context.Context, run *stepflow.DataflowRun) error {
+	// the outputs are stored apart from the run
+	runNoOutputs := *run
+	runNoOutputs.Outputs = nil
+	value, err := stepflow.MarshalDataflowRun(&runNoOutputs)
+	if err != nil {
+		return err
+	}
+	return ss.transact(ctx, func(tx *sql.Tx) error {
+		query := ss.Dialect.Upsert("stepflow_runs", "id", []string{"id", "state", "data"})
+		if _, err := tx.ExecContext(ctx, ss.Dialect.rebind(query), string(run.ID), string(run.State), string(value)); err != nil {
+			return err
+		}
+
+		// outputs already stored are kept
+		query = ss.Dialect.InsertIgnore("stepflow_outputs", "run_id, step_id, output_key", outputColumns)
+		for stepID, stepOutputs := range run.Outputs {
+			for key, output := range stepOutputs {
+				value, err := stepflow.MarshalFlowOutput(output)
+				if err != nil {
+					return fmt.Errorf("Output of step %s could not be serialized: %s", stepID, err.Error())
+				}
+				if _, err = tx.ExecContext(ctx, ss.Dialect.rebind(query), string(run.ID), stepID, key, string(value)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (ss *SQLStorage) StoreFlowOutput(ctx context.Context, runID stepflow.DataflowRunID, stepID string, key string, output *stepflow.FlowOutput) error {
+	value, err := stepflow.MarshalFlowOutput(output)
+	if err != nil {
+		return fmt.Errorf("Output of step %s could not be serialized: %s", stepID, err.Error())
+	}
+	query := ss.Dialect.Upsert("stepflow_outputs", "run_id, step_id, output_key", outputColumns)
+	_, err = ss.DB.ExecContext(ctx, ss.Dialect.rebind(query), string(runID), stepID, key, string(value))
+	return err
+}
+
+func (ss *SQLStorage) RetrieveDataflowRuns(ctx context.Context, keys []stepflow.DataflowRunID) map[stepflow.DataflowRunID]*stepflow.DataflowRun {
+	runs := make(map[stepflow.DataflowRunID]*stepflow.DataflowRun)
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		runs[key] = nil
+		ids[i] = string(key)
+	}
+
+	err := ss.queryData(ctx, "stepflow_runs", ids, func(id string, value []byte) error {
+		run, err := stepflow.UnmarshalDataflowRun(value)
+		if err != nil {
+			return fmt.Errorf("Dataflow run %s could not be read: %s", id, err.Error())
+		}
+		runs[stepflow.DataflowRunID(id)] = run
+		return nil
+	})
+	for _, run := range runs {
+		if err == nil && run != nil {
+			if err = ss.retrieveOutputs(ctx, run); err != nil {
+				err = fmt.Errorf("Outputs of dataflow run %s could not be read: %s", run.ID, err.Error())
+			}
+		}
+	}
+	if err != nil {
+		ss.Logger.Errorf(ctx, "Error retrieving dataflow runs: %s", err.Error())
+	}
+	return runs
+}
+
+// retrieveOutputs sets the outputs of the run, stored apart from it
+func (ss *SQLStorage) retrieveOutputs(ctx context.Context, run *stepflow.DataflowRun) error {
+	run.Outputs = nil
+	query := `SELECT step_id, output_key, data FROM stepflow_outputs WHERE run_id = ?`
+	return ss.queryRows(ctx, query, []interface{}{string(run.ID)}, func(rows *sql.Rows) error {
+		var stepID, key string
+		var value []byte
+		if err := rows.Scan(&stepID, &key, &value); err != nil {
+			return err
+		}
+		output, err := stepflow.UnmarshalFlowOutput(value)
+		if err != nil {
+			return err
+		}
+		if run.Outputs == nil {
+			run.Outputs = make(map[string]map[string]*stepflow.FlowOutput)
+		}
+		if run.Outputs[stepID] == nil {
+			run.Outputs[stepID] = make(map[string]*stepflow.FlowOutput)
+		}
+		run.Outputs[stepID][key] = output
+		return nil
+	})
+}
+
+func (ss *SQLStorage) DeleteDataflowRun(ctx context.Context, key stepflow.DataflowRunID) error {
+	return ss.transact(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, ss.Dialect.rebind(`DELETE FROM stepflow_outputs WHERE run_id = ?`), string(key)); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, ss.Dialect.rebind(`DELETE FROM stepflow_runs WHERE id = ?`), string(key))
+		return err
+	})
+}
+
+func (ss *SQLStorage) ListDataflowRuns(ctx context.Context) []stepflow.DataflowRunID {
+	runIDs := []stepflow.DataflowRunID{}
+	err := ss.queryIDs(ctx, `SELECT id FROM stepflow_runs`, nil, func(id string) {
+		runIDs = append(runIDs, stepflow.DataflowRunID(id))
+	})
+	if err != nil {
+		ss.Logger.Errorf(ctx, "Error listing dataflow runs: %s", err.Error())
+	}
+	return runIDs
+}
+
+func (ss *SQLStorage) StoreFlow(ctx context.Context, flow *stepflow.Flow) error {
+	value, err := stepflow.MarshalFlow(flow)
+	if err != nil {
+		return err
+	}
+	query := ss.Dialect.Upsert("stepflow_flows", "id", []string{"id", "run_id", "data"})
+	_, err = ss.DB.ExecContext(ctx, ss.Dialect.rebind(query), string(flow.ID), string(flow.DataflowRunID), string(value))
+	return err
+}
+
+func (ss *SQLStorage) RetrieveFlows(ctx context.Context, keys []stepflow.FlowID) map[stepflow.FlowID]*stepflow.Flow {
+	flows := make(map[stepflow.FlowID]*stepflow.Flow)
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = string(key)
+	}
+
+	err := ss.queryData(ctx, "stepflow_flows", ids, func(id string, value []byte) error {
+		flow, err := stepflow.UnmarshalFlow(value)
+		if err != nil {
+			return fmt.Errorf("Flow %s could not be read: %s", id, err.Error())
+		}
+		flows[stepflow.FlowID(id)] = flow
+		return nil
+	})
+	if err != nil {
+		ss.Logger.Errorf(ctx, "Error retrieving flows: %s", err.Error())
+	}
+	return flows
+}
+
+func (ss *SQLStorage) DeleteFlow(ctx context.Context, key stepflow.FlowID) error {
+	_, err := ss.DB.ExecContext(ctx, ss.Dialect.rebind(`DELETE FROM stepflow_flows WHERE id = ?`), string(key))
+	return err
+}
+
+func (ss *SQLStorage) ListFlows(ctx context.Context, runID stepflow.DataflowRunID) []stepflow.FlowID {
+	flowIDs := []stepflow.FlowID{}
+	err := ss.queryIDs(ctx, `SELECT id FROM stepflow_flows WHERE run_id = ?`, []interface{}{string(runID)}, func(id string) {
+		flowIDs = append(flowIDs, stepflow.FlowID(id))
+	})
+	if err != nil {
+		ss.Logger.Errorf(ctx, "Error listing flows of run %s: %s", runID, err.Error())
+	}
+	return flowIDs
+}
+
+func (ss *SQLStorage) StoreFlowSplit(ctx context.Context, flowSplit *stepflow.FlowSplit) error {
+	value, err := json.Marshal(flowSplit)
+	if err != nil {
+		return err
+	}
+	query := ss.Dialect.Upsert("stepflow_splits", "id", []string{"id", "run_id", "data"})
+	_, err = ss.DB.ExecContext(ctx, ss.Dialect.rebind(query), string(flowSplit.ID), string(flowSplit.DataflowRunID), string(value))
+	return err
+}
+
+func (ss *SQLStorage) RetrieveFlowSplits(ctx context.Context, keys []stepflow.FlowSplitID) map[stepflow.FlowSplitID]*stepflow.FlowSplit {
+	flowSplits := make(map[stepflow.FlowSplitID]*stepflow.FlowSplit)
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = string(key)
+	}
+
+	err := ss.queryData(ctx, "stepflow_splits", ids, func(id string, value []byte) error {
+		flowSplit := &stepflow.FlowSplit{}
+		if err := json.Unmarshal(value, flowSplit); err != nil {
+			return fmt.Errorf("Flow split %s could not be read: %s", id, err.Error())
+		}
+		flowSplits[stepflow.FlowSplitID(id)] = flowSplit
+		return nil
+	})
+	if err != nil {
+		ss.Logger.Errorf(ctx, "Error retrieving flow splits: %s", err.Error())
+	}
+	return flowSplits
+}
+
+func (ss *SQLStorage) DeleteFlowSplit(ctx context.Context, key stepflow.FlowSplitID) error {
+	_, err := ss.DB.ExecContext(ctx, ss.Dialect.rebind(`DELETE FROM stepflow_splits WHERE id = ?`), string(key))
+	return err
+}
+
+func (ss *SQLStorage) ListFlowSplits(ctx context.Context, runID stepflow.DataflowRunID) []stepflow.FlowSplitID {
+	flowSplitIDs := []stepflow.FlowSplitID{}
+	err := ss.queryIDs(ctx, `SELECT id FROM stepflow_splits WHERE run_id = ?`, []interface{}{string(runID)}, func(id string) {
+		flowSplitIDs = append(flowSplitIDs, stepflow.FlowSplitID(id))
+	})
+	if err != nil {
+		ss.Logger.Errorf(ctx, "Error listing flow splits of run %s: %s", runID, err.Error())
+	}
+	return flowSplitIDs
+}
+
+// Increment sets the counter to the initial value the first time it is
+// called for a key, and increments it on later calls
+func (ss *SQLStorage) Increment(ctx context.Context, key string, initialValue int64, increment int64) (int64, error) {
+	var value int64
+	err := ss.transact(ctx, func(tx *sql.Tx) error {
+		inserted, err := ss.insertCounter(ctx, tx, key, initialValue)
+		if err != nil || inserted {
+			value = initialValue
+			return err
+		}
+
+		if _, err = tx.ExecContext(ctx, ss.Dialect.rebind(`UPDATE stepflow_counters SET total = total + ? WHERE id = ?`), increment, key); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, ss.Dialect.rebind(`SELECT total FROM stepflow_counters WHERE id = ?`), key).Scan(&value)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Counter %s could not be incremented: %s", key, err.Error())
+	}
+	return value, nil
+}
+
+// IncrementWithError increments both the count and the error count of
+// the key, starting from zero, in a single UPDATE
+func (ss *SQLStorage) IncrementWithError(ctx context.Context, key string, increment int64, errIncrement int64) (count int64, errCount int64, err error) {
+	err = ss.transact(ctx, func(tx *sql.Tx) error {
+		if _, err := ss.insertCounter(ctx, tx, key, 0); err != nil {
+			return err
+		}
+
+		update := `UPDATE stepflow_counters SET total = total + ?, error_total = error_total + ? WHERE id = ?`
+		if _, err := tx.ExecContext(ctx, ss.Dialect.rebind(update), increment, errIncrement, key); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, ss.Dialect.rebind(`SELECT total, error_total FROM stepflow_counters WHERE id = ?`), key).Scan(&count, &errCount)
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("Counter %s could not be incremented: %s", key, err.Error())
+	}
+	return count, errCount, nil
+}
+
+func (ss *SQLStorage) DeleteCounter(ctx context.Context, key string) error {
+	_, err := ss.DB.ExecContext(ctx, ss.Dialect.rebind(`DELETE FROM stepflow_counters WHERE id = ?`), key)
+	return err
+}
+
+// insertCounter creates the counter with the given value, and returns
+// false if it already exists
+func (ss *SQLStorage) insertCounter(ctx context.Context, tx *sql.Tx, key string, value int64) (bool, error) {
+	query := ss.Dialect.InsertIgnore("stepflow_counters", "id", []string{"id", "total", "error_total"})
+	result, err := tx.ExecContext(ctx, ss.Dialect.rebind(query), key, value, 0)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
+}
+
+// transact runs the function in a transaction, which is committed if the
+// function returns no error and rolled back otherwise
+func (ss *SQLStorage) transact(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryData calls the function with the data of each row of the table
+// with one of the given IDs. IDs are queried in batches, since databases
+// limit the number of parameters of a query.
+func (ss *SQLStorage) queryData(ctx context.Context, table string, ids []string, fn func(id string, value []byte) error) error {
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > maxQueryIDs {
+			batch = ids[:maxQueryIDs]
+		}
+		ids = ids[len(batch):]
+
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		query := fmt.Sprintf("SELECT id, data FROM %s WHERE id IN (%s)", table, placeholders)
+		if err := ss.queryRows(ctx, query, args, func(rows *sql.Rows) error {
+			var id string
+			var value []byte
+			if err := rows.Scan(&id, &value); err != nil {
+				return err
+			}
+			return fn(id, value)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryIDs calls the function with the ID returned in each row of the query
+func (ss *SQLStorage) queryIDs(ctx context.Context, query string, args []interface{}, fn func(id string)) error {
+	return ss.queryRows(ctx, query, args, func(rows *sql.Rows) error {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		fn(id)
+		return nil
+	})
+}
+
+// queryRows calls the function for each row returned by the query
+func (ss *SQLStorage) queryRows(ctx context.Context, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	rows, err := ss.DB.QueryContext(ctx, ss.Dialect.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,302 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+	"github.com/jcalvarado1965/go-stepflow/inprocess"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testDataflow = `{
+	"id": "TwoConstants",
+	"startAt": "constant-1",
+	"steps": [
+		{"id": "constant-1", "type": "constant", "next": "constant-2", "value": [1, 2, 3]},
+		{"id": "constant-2", "type": "constant", "value": {"aString": "foobar"}}
+	]
+}`
+
+// openTestDB opens a SQLite database in a temporary directory, closed
+// when the test ends
+func openTestDB(t *testing.T) *sql.DB {
+	path := filepath.Join(t.TempDir(), "stepflow.sqlite")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=10000")
+	if err != nil {
+		t.Fatalf("Database could not be opened: %s", err.Error())
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestStorage(t *testing.T, db *sql.DB) *SQLStorage {
+	logger := inprocess.NewLeveledConsoleLogger(inprocess.LevelWarn, ioutil.Discard)
+	ss, err := NewSQLStorage(logger, db, SQLite)
+	if err != nil {
+		t.Fatalf("Storage could not be created: %s", err.Error())
+	}
+	return ss
+}
+
+func newTestRun(t *testing.T) *stepflow.DataflowRun {
+	var df stepflow.Dataflow
+	if err := json.Unmarshal([]byte(testDataflow), &df); err != nil {
+		t.Fatalf("Dataflow could not be read: %s", err.Error())
+	}
+	return stepflow.NewDataflowRun(&df)
+}
+
+func schemaVersions(t *testing.T, db *sql.DB) []int {
+	rows, err := db.Query(`SELECT version FROM stepflow_schema ORDER BY version`)
+	if err != nil {
+		t.Fatalf("Schema versions could not be read: %s", err.Error())
+	}
+	defer rows.Close()
+	versions := []int{}
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			t.Fatalf("Schema version could not be read: %s", err.Error())
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+func TestMigrate(t *testing.T) {
+	db := openTestDB(t)
+	newTestStorage(t, db)
+
+	versions := schemaVersions(t, db)
+	if len(versions) != len(migrations) || versions[len(versions)-1] != len(migrations) {
+		t.Fatalf("Expected schema versions 1 to %d, got %v", len(migrations), versions)
+	}
+
+	// reopening applies no migration twice
+	newTestStorage(t, db)
+	if again := schemaVersions(t, db); len(again) != len(versions) {
+		t.Errorf("Expected %d schema versions after reopening, got %v", len(versions), again)
+	}
+}
+
+func TestDataflowRunRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	ss := newTestStorage(t, openTestDB(t))
+
+	run := newTestRun(t)
+	run.State = stepflow.RunStateActive
+	run.Outputs = map[string]map[string]*stepflow.FlowOutput{
+		"constant-1": {"0": {ContentType: "application/json", Data: json.RawMessage(`[1,2,3]`)}},
+	}
+	if err := ss.StoreDataflowRun(ctx, run); err != nil {
+		t.Fatalf("Run could not be stored: %s", err.Error())
+	}
+	output := &stepflow.FlowOutput{ContentType: "text/plain", Data: "foobar"}
+	if err := ss.StoreFlowOutput(ctx, run.ID, "constant-2", "1", output); err != nil {
+		t.Fatalf("Output could not be stored: %s", err.Error())
+	}
+
+	// storing the run again keeps the outputs stored by flows meanwhile
+	run.State = stepflow.RunStateCompleted
+	if err := ss.StoreDataflowRun(ctx, run); err != nil {
+		t.Fatalf("Run could not be stored: %s", err.Error())
+	}
+
+	stored := ss.RetrieveDataflowRuns(ctx, []stepflow.DataflowRunID{run.ID})[run.ID]
+	if stored == nil {
+		t.Fatalf("Run %s not found", run.ID)
+	}
+	if stored.State != stepflow.RunStateCompleted || stored.Dataflow.ID != "TwoConstants" {
+		t.Errorf("Expected completed run of TwoConstants, got %s run of %s", stored.State, stored.Dataflow.ID)
+	}
+	if data, ok := stored.Outputs["constant-1"]["0"].Data.(json.RawMessage); !ok || string(data) != "[1,2,3]" {
+		t.Errorf("Expected output [1,2,3] of constant-1, got %v", stored.Outputs["constant-1"]["0"])
+	}
+	if data, ok := stored.Outputs["constant-2"]["1"].Data.(string); !ok || data != "foobar" {
+		t.Errorf("Expected output foobar of constant-2, got %v", stored.Outputs["constant-2"]["1"])
+	}
+	if runIDs := ss.ListDataflowRuns(ctx); len(runIDs) != 1 || runIDs[0] != run.ID {
+		t.Errorf("Expected run %s listed, got %v", run.ID, runIDs)
+	}
+
+	if err := ss.DeleteDataflowRun(ctx, run.ID); err != nil {
+		t.Fatalf("Run could not be deleted: %s", err.Error())
+	}
+	if stored := ss.RetrieveDataflowRuns(ctx, []stepflow.DataflowRunID{run.ID})[run.ID]; stored != nil {
+		t.Errorf("Deleted run %s found", run.ID)
+	}
+	var outputs int
+	if err := ss.DB.QueryRow(`SELECT COUNT(*) FROM stepflow_outputs`).Scan(&outputs); err != nil || outputs != 0 {
+		t.Errorf("Expected the outputs of the deleted run deleted, found %d", outputs)
+	}
+}
+
+func TestFlowRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	ss := newTestStorage(t, openTestDB(t))
+
+	flow := &stepflow.Flow{
+		FlowNoData: stepflow.FlowNoData{
+			ID:            "flow-1",
+			DataflowRunID: "run-1",
+			NextStepID:    "constant-2",
+			State:         stepflow.FlowStateActive,
+			ContentType:   "application/json",
+			Splits:        []stepflow.FlowSplitID{"split-1"},
+			SplitIndex:    2,
+		},
+		Data: json.RawMessage(`{"aString":"foobar"}`),
+	}
+	if err := ss.StoreFlow(ctx, flow); err != nil {
+		t.Fatalf("Flow could not be stored: %s", err.Error())
+	}
+	flow.State = stepflow.FlowStateCompleted
+	if err := ss.StoreFlow(ctx, flow); err != nil {
+		t.Fatalf("Flow could not be stored again: %s", err.Error())
+	}
+
+	stored, ok := ss.RetrieveFlows(ctx, []stepflow.FlowID{flow.ID, "missing"})[flow.ID]
+	if !ok {
+		t.Fatalf("Flow %s not found", flow.ID)
+	}
+	if stored.State != stepflow.FlowStateCompleted || stored.SplitIndex != 2 || len(stored.Splits) != 1 {
+		t.Errorf("Expected flow %v, got %v", flow, stored)
+	}
+	if data, ok := stored.Data.(json.RawMessage); !ok || string(data) != `{"aString":"foobar"}` {
+		t.Errorf("Expected JSON data, got %#v", stored.Data)
+	}
+	if flowIDs := ss.ListFlows(ctx, "run-1"); len(flowIDs) != 1 || flowIDs[0] != flow.ID {
+		t.Errorf("Expected flow %s listed, got %v", flow.ID, flowIDs)
+	}
+
+	if err := ss.DeleteFlow(ctx, flow.ID); err != nil {
+		t.Fatalf("Flow could not be deleted: %s", err.Error())
+	}
+	if flowIDs := ss.ListFlows(ctx, "run-1"); len(flowIDs) != 0 {
+		t.Errorf("Expected no flows listed, got %v", flowIDs)
+	}
+}
+
+func TestFlowSplitRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	ss := newTestStorage(t, openTestDB(t))
+
+	split := &stepflow.FlowSplit{
+		ID:            "split-1",
+		DataflowRunID: "run-1",
+		SplitStepID:   "distribute",
+		ParentFlowID:  "flow-1",
+		IndexType:     stepflow.FlowSplitNumericalIndex,
+		FlowIDs:       []stepflow.FlowID{"flow-2", "flow-3"},
+	}
+	if err := ss.StoreFlowSplit(ctx, split); err != nil {
+		t.Fatalf("Split could not be stored: %s", err.Error())
+	}
+
+	stored, ok := ss.RetrieveFlowSplits(ctx, []stepflow.FlowSplitID{split.ID})[split.ID]
+	if !ok {
+		t.Fatalf("Split %s not found", split.ID)
+	}
+	if stored.ParentFlowID != split.ParentFlowID || stored.IndexType != split.IndexType || len(stored.FlowIDs) != 2 {
+		t.Errorf("Expected split %v, got %v", split, stored)
+	}
+	if splitIDs := ss.ListFlowSplits(ctx, "run-1"); len(splitIDs) != 1 || splitIDs[0] != split.ID {
+		t.Errorf("Expected split %s listed, got %v", split.ID, splitIDs)
+	}
+
+	if err := ss.DeleteFlowSplit(ctx, split.ID); err != nil {
+		t.Fatalf("Split could not be deleted: %s", err.Error())
+	}
+	if _, ok := ss.RetrieveFlowSplits(ctx, []stepflow.FlowSplitID{split.ID})[split.ID]; ok {
+		t.Errorf("Deleted split %s found", split.ID)
+	}
+	if splitIDs := ss.ListFlowSplits(ctx, "run-1"); len(splitIDs) != 0 {
+		t.Errorf("Expected no splits listed, got %v", splitIDs)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	ctx := context.Background()
+	ss := newTestStorage(t, openTestDB(t))
+
+	if value, err := ss.Increment(ctx, "key", 5, 2); err != nil || value != 5 {
+		t.Errorf("Expected the initial value 5, got %d", value)
+	}
+	if value, err := ss.Increment(ctx, "key", 5, 2); err != nil || value != 7 {
+		t.Errorf("Expected 7 after incrementing, got %d", value)
+	}
+	if count, errCount, err := ss.IncrementWithError(ctx, "split", 1, 1); err != nil || count != 1 || errCount != 1 {
+		t.Errorf("Expected counts 1 and 1, got %d and %d", count, errCount)
+	}
+	if count, errCount, err := ss.IncrementWithError(ctx, "split", 1, 0); err != nil || count != 2 || errCount != 1 {
+		t.Errorf("Expected counts 2 and 1, got %d and %d", count, errCount)
+	}
+
+	for _, key := range []string{"key", "split"} {
+		if err := ss.DeleteCounter(ctx, key); err != nil {
+			t.Fatalf("Counter %s could not be deleted: %s", key, err.Error())
+		}
+	}
+	if value, err := ss.Increment(ctx, "key", 5, 2); err != nil || value != 5 {
+		t.Errorf("Expected the initial value 5 after deleting, got %d", value)
+	}
+	if count, errCount, err := ss.IncrementWithError(ctx, "split", 1, 0); err != nil || count != 1 || errCount != 0 {
+		t.Errorf("Expected counts 1 and 0 after deleting, got %d and %d", count, errCount)
+	}
+}
+
+func TestConcurrentIncrement(t *testing.T) {
+	ctx := context.Background()
+	ss := newTestStorage(t, openTestDB(t))
+
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	firsts := make(chan int64, workers*increments)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if value, _ := ss.Increment(ctx, "counter", 1, 1); value == 1 {
+					firsts <- value
+				}
+				errIncr := int64(worker % 2)
+				ss.IncrementWithError(ctx, "split", 1, errIncr)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(firsts)
+
+	if len(firsts) != 1 {
+		t.Errorf("Expected the initial value returned once, got it %d times", len(firsts))
+	}
+	if value, err := ss.Increment(ctx, "counter", 1, 0); err != nil || value != workers*increments {
+		t.Errorf("Expected counter %d, got %d", workers*increments, value)
+	}
+	count, errCount, err := ss.IncrementWithError(ctx, "split", 0, 0)
+	if err != nil || count != workers*increments || errCount != workers/2*increments {
+		t.Errorf("Expected counts %d and %d, got %d and %d", workers*increments, workers/2*increments, count, errCount)
+	}
+}
+
+func TestIncrementFailure(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	ss := newTestStorage(t, db)
+	db.Close()
+
+	if _, err := ss.Increment(ctx, "key", 1, 1); err == nil {
+		t.Errorf("Expected an error incrementing on a closed database")
+	}
+	if _, _, err := ss.IncrementWithError(ctx, "split", 1, 0); err == nil {
+		t.Errorf("Expected an error incrementing with error on a closed database")
+	}
+}
@@ -3,22 +3,30 @@ package stepflow
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 )
 
-// StepType is an enum for the known step types
+// StepType identifies the type of a step, see RegisterStepType
 type StepType string
 
-// These are the known step types
+// These are the built-in step types
 const (
-	TypeWebMethod   StepType = "web-method"
-	TypeDistribute  StepType = "distribute"
-	TypeBroadcast   StepType = "broadcast"
-	TypeSelect      StepType = "select"
-	TypeConditional StepType = "conditional"
-	TypeJoin        StepType = "join"
-	TypeRace        StepType = "race"
-	TypeConstant    StepType = "constant"
+	TypeWebMethod     StepType = "web-method"
+	TypeDistribute    StepType = "distribute"
+	TypeBroadcast     StepType = "broadcast"
+	TypeSelect        StepType = "select"
+	TypeConditional   StepType = "conditional"
+	TypeJoin          StepType = "join"
+	TypeRace          StepType = "race"
+	TypeConstant      StepType = "constant"
+	TypeChoice        StepType = "choice"
+	TypeLoop          StepType = "loop"
+	TypeSubflow       StepType = "subflow"
+	TypeWait          StepType = "wait"
+	TypeWaitForSignal StepType = "wait-for-signal"
+	TypeFunction      StepType = "function"
 )
 
 // const StepRunKind = "StepRun"
@@ -26,17 +34,41 @@ const (
 // Step is the interface implemented by all steps
 type Step interface {
 	GetID() string
+	GetType() StepType
 	GetNextID() string
+	GetKeepOutput() bool
+	GetRetry() *RetryPolicy
+	GetTimeout() Duration
+	GetOnErrorID() string
+	GetHandleErrorAs() json.RawMessage
 	PrepareMarshal()
 	ResolveIDs(map[string]Step) error
 	Validate() []error
 }
 
+// BranchingStep is implemented by steps that forward flows to steps other
+// than Next
+type BranchingStep interface {
+	GetBranchIDs() []string
+}
+
+// ExecutorValidatorStep is implemented by steps whose validation depends on
+// the executor, e.g. on the dataflows registered with it
+type ExecutorValidatorStep interface {
+	ValidateWithExecutor(ctx context.Context, exec Executor) []error
+}
+
 // DoerStep is implemented by steps that perform an action
 type DoerStep interface {
 	Do(ctx context.Context, exec Executor, flow *Flow) error
 }
 
+// RouterStep is implemented by steps that choose the next step of the
+// flow. An empty next ID finishes the flow.
+type RouterStep interface {
+	Route(ctx context.Context, exec Executor, flow *Flow) (nextID string, err error)
+}
+
 // SplitterStep is implemented by steps that split flows
 type SplitterStep interface {
 	Split(ctx context.Context, exec Executor, flow *Flow) (outflows []*Flow, split *FlowSplit, err error)
@@ -54,17 +86,33 @@ type JoinerStep interface {
 // requires, if any. ContentType indicates the content type of
 // the output, if any. If KeepOutput is true, the outputs are copied to
 // the workflow run so they are available when the workflow completes.
-// If HandleErrorAs is not nil, then errors do not stop the flow but
-// instead the given JSON is passed to the next task(s)
+// If Timeout is set, the step fails if it does not finish in time.
+// If Retry is not nil, failed steps are retried according to the policy.
+// If OnError is not nil, then errors do not stop the flow but instead
+// the flow is sent to the OnError step, with its data set to a StepError.
+// If HandleErrorAs is not nil, the given JSON is used as the flow data
+// instead, and the flow is sent to the OnError step or, if not set, to
+// the Next step.
 type BaseStep struct {
-	ID          string   `json:"id,omitempty"`
-	Description string   `json:"description,omitempty"`
-	Type        StepType `json:"type,omitempty"`
-	Next        Step     `json:"-"`
-	NextID      string   `json:"next,omitempty"`
-	// not implemented
-	// KeepOutput    bool            `json:"keepOutput,omitempty"`
-	// HandleErrorAs json.RawMessage `json:"handleErrorAs,omitempty"`
+	ID            string          `json:"id,omitempty"`
+	Description   string          `json:"description,omitempty"`
+	Type          StepType        `json:"type,omitempty"`
+	Next          Step            `json:"-"`
+	NextID        string          `json:"next,omitempty"`
+	KeepOutput    bool            `json:"keepOutput,omitempty"`
+	Timeout       Duration        `json:"timeout,omitempty"`
+	Retry         *RetryPolicy    `json:"retry,omitempty"`
+	OnError       Step            `json:"-"`
+	OnErrorID     string          `json:"onError,omitempty"`
+	HandleErrorAs json.RawMessage `json:"handleErrorAs,omitempty"`
+}
+
+// StepError is the flow data passed to the OnError step when a step fails
+// and it does not have HandleErrorAs
+type StepError struct {
+	StepID     string `json:"stepId"`
+	Message    string `json:"message"`
+	StatusCode int    `json:"statusCode,omitempty"`
 }
 
 // GetID for Step impl in BaseStep
@@ -72,21 +120,66 @@ func (s *BaseStep) GetID() string {
 	return s.ID
 }
 
-// GetNextID for Step impl in BaseStep
+// GetType for Step impl in BaseStep. The type is set by PrepareMarshal
+// or when unmarshalling, so the built-in steps override GetType to return
+// their type in dataflows built in code.
+func (s *BaseStep) GetType() StepType {
+	return s.Type
+}
+
+// GetNextID for Step impl in BaseStep. The ID of the Next step is used if
+// set, e.g. in dataflows built in code.
 func (s *BaseStep) GetNextID() string {
+	if s.Next != nil {
+		return s.Next.GetID()
+	}
 	return s.NextID
 }
 
+// GetKeepOutput for Step impl in BaseStep
+func (s *BaseStep) GetKeepOutput() bool {
+	return s.KeepOutput
+}
+
+// GetTimeout for Step impl in BaseStep
+func (s *BaseStep) GetTimeout() Duration {
+	return s.Timeout
+}
+
+// GetRetry for Step impl in BaseStep
+func (s *BaseStep) GetRetry() *RetryPolicy {
+	return s.Retry
+}
+
+// GetOnErrorID for Step impl in BaseStep
+func (s *BaseStep) GetOnErrorID() string {
+	if s.OnError != nil {
+		return s.OnError.GetID()
+	}
+	return s.OnErrorID
+}
+
+// GetHandleErrorAs for Step impl in BaseStep
+func (s *BaseStep) GetHandleErrorAs() json.RawMessage {
+	return s.HandleErrorAs
+}
+
 // PrepareMarshal for Step impl in BaseStep
 func (s *BaseStep) PrepareMarshal() {
-	if s.Next != nil {
-		s.NextID = s.Next.GetID()
-	}
+	s.NextID = s.GetNextID()
+	s.OnErrorID = s.GetOnErrorID()
 }
 
 // Validate for Step impl in BaseStep
 func (s *BaseStep) Validate() []error {
-	return []error{}
+	errs := []error{}
+	if s.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("Timeout cannot be negative in step ID %s", s.ID))
+	}
+	if s.Retry != nil {
+		errs = append(errs, s.Retry.Validate()...)
+	}
+	return errs
 }
 
 // ResolveIDs for Step impl in BaseStep
@@ -98,6 +191,13 @@ func (s *BaseStep) ResolveIDs(stepMap map[string]Step) error {
 			return fmt.Errorf("StepID %s not found in workflow", s.NextID)
 		}
 	}
+	if s.OnErrorID != "" {
+		var ok bool
+		s.OnError, ok = stepMap[s.OnErrorID]
+		if !ok {
+			return fmt.Errorf("StepID %s not found in workflow", s.OnErrorID)
+		}
+	}
 	return nil
 }
 
@@ -110,62 +210,74 @@ func (s *BaseStep) String() string {
 		s.ID, s.Description, s.Type, nextID)
 }
 
+var (
+	stepTypesMu sync.RWMutex
+	stepTypes   = make(map[StepType]func() Step)
+)
+
+func init() {
+	builtins := map[StepType]func() Step{
+		TypeWebMethod:     func() Step { return &WebMethodStep{} },
+		TypeDistribute:    func() Step { return &DistributeStep{} },
+		TypeBroadcast:     func() Step { return &BroadcastStep{} },
+		TypeSelect:        func() Step { return &SelectStep{} },
+		TypeConditional:   func() Step { return &ConditionalStep{} },
+		TypeJoin:          func() Step { return &JoinStep{} },
+		TypeRace:          func() Step { return &RaceStep{} },
+		TypeConstant:      func() Step { return &ConstantStep{} },
+		TypeChoice:        func() Step { return &ChoiceStep{} },
+		TypeLoop:          func() Step { return &LoopStep{} },
+		TypeSubflow:       func() Step { return &SubflowStep{} },
+		TypeWait:          func() Step { return &WaitStep{} },
+		TypeWaitForSignal: func() Step { return &WaitForSignalStep{} },
+		TypeFunction:      func() Step { return &FunctionStep{} },
+	}
+	for stepType, factory := range builtins {
+		if err := RegisterStepType(stepType, factory); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterStepType makes a step type available to UnmarshalStep. The
+// factory returns a new, empty step which the step JSON is unmarshalled
+// into. Steps are executed according to the interfaces they implement
+// (DoerStep, RouterStep, SplitterStep or JoinerStep), and should embed
+// BaseStep. Returns an error if the type is already registered.
+func RegisterStepType(stepType StepType, factory func() Step) error {
+	if stepType == "" {
+		return errors.New("Step type is empty")
+	}
+	if factory == nil {
+		return fmt.Errorf("Step type %s has no factory", stepType)
+	}
+
+	stepTypesMu.Lock()
+	defer stepTypesMu.Unlock()
+	if _, ok := stepTypes[stepType]; ok {
+		return fmt.Errorf("Step type already registered: %s", stepType)
+	}
+	stepTypes[stepType] = factory
+	return nil
+}
+
 // UnmarshalStep returns a specialized step based on the raw JSON
 func UnmarshalStep(raw json.RawMessage) (Step, error) {
 	var base BaseStep
 	if err := json.Unmarshal(raw, &base); err != nil {
 		return nil, err
 	}
-	switch base.Type {
-	case TypeBroadcast:
-		var step BroadcastStep
-		if err := json.Unmarshal(raw, &step); err != nil {
-			return nil, err
-		}
-		return &step, nil
-	case TypeConditional:
-		var step ConditionalStep
-		if err := json.Unmarshal(raw, &step); err != nil {
-			return nil, err
-		}
-		return &step, nil
-	case TypeSelect:
-		var step SelectStep
-		if err := json.Unmarshal(raw, &step); err != nil {
-			return nil, err
-		}
-		return &step, nil
-	case TypeConstant:
-		var step ConstantStep
-		if err := json.Unmarshal(raw, &step); err != nil {
-			return nil, err
-		}
-		return &step, nil
-	case TypeDistribute:
-		var step DistributeStep
-		if err := json.Unmarshal(raw, &step); err != nil {
-			return nil, err
-		}
-		return &step, nil
-	case TypeJoin:
-		var step JoinStep
-		if err := json.Unmarshal(raw, &step); err != nil {
-			return nil, err
-		}
-		return &step, nil
-	case TypeRace:
-		var step RaceStep
-		if err := json.Unmarshal(raw, &step); err != nil {
-			return nil, err
-		}
-		return &step, nil
-	case TypeWebMethod:
-		var step WebMethodStep
-		if err := json.Unmarshal(raw, &step); err != nil {
-			return nil, err
-		}
-		return &step, nil
+
+	stepTypesMu.RLock()
+	factory, ok := stepTypes[base.Type]
+	stepTypesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Step type not recognized: %s", base.Type)
 	}
 
-	return nil, fmt.Errorf("Step type not recognized: %s", base.Type)
+	step := factory()
+	if err := json.Unmarshal(raw, step); err != nil {
+		return nil, err
+	}
+	return step, nil
 }
@@ -15,14 +15,24 @@ type BroadcastStep struct {
 	ForwardToIDs []string `json:"forwardTo,omitempty"`
 }
 
-// PrepareMarshal sets the step type
+// PrepareMarshal sets the step type and the forward IDs
 func (s *BroadcastStep) PrepareMarshal() {
 	s.BaseStep.PrepareMarshal()
 	s.Type = TypeBroadcast
+	s.ForwardToIDs = s.GetBranchIDs()
+}
+
+// GetType returns the step type
+func (s *BroadcastStep) GetType() StepType {
+	return TypeBroadcast
 }
 
 // ResolveIDs resolve the ForwardToIDs
 func (s *BroadcastStep) ResolveIDs(stepMap map[string]Step) error {
+	if err := s.BaseStep.ResolveIDs(stepMap); err != nil {
+		return err
+	}
+
 	s.ForwardTo = []Step{}
 	for _, id := range s.ForwardToIDs {
 		if step, ok := stepMap[id]; ok {
@@ -34,6 +44,19 @@ func (s *BroadcastStep) ResolveIDs(stepMap map[string]Step) error {
 	return nil
 }
 
+// GetBranchIDs implements the branching step interface. The IDs of the
+// ForwardTo steps are used if set, e.g. in dataflows built in code.
+func (s *BroadcastStep) GetBranchIDs() []string {
+	if len(s.ForwardTo) == 0 {
+		return s.ForwardToIDs
+	}
+	ids := []string{}
+	for _, step := range s.ForwardTo {
+		ids = append(ids, step.GetID())
+	}
+	return ids
+}
+
 // Split implements the splitter step interface
 func (s *BroadcastStep) Split(ctx context.Context, exec Executor, flow *Flow) (outflows []*Flow, split *FlowSplit, err error) {
 	split = &FlowSplit{
@@ -46,7 +69,7 @@ func (s *BroadcastStep) Split(ctx context.Context, exec Executor, flow *Flow) (o
 	newSplits := make([]FlowSplitID, len(flow.Splits))
 	copy(newSplits, flow.Splits)
 	newSplits = append(newSplits, split.ID)
-	for i, f := range s.ForwardTo {
+	for _, f := range s.ForwardTo {
 		outflow := &Flow{
 			FlowNoData: FlowNoData{
 				ID:            FlowID(uuid.New().String()),
@@ -54,7 +77,7 @@ func (s *BroadcastStep) Split(ctx context.Context, exec Executor, flow *Flow) (o
 				State:         FlowStateActive,
 				ContentType:   flow.ContentType,
 				Splits:        newSplits,
-				SplitKey:      s.ForwardToIDs[i],
+				SplitKey:      f.GetID(),
 				NextStepID:    f.GetID(),
 			},
 			Data: flow.Data,
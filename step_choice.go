@@ -0,0 +1,139 @@
+package stepflow
+
+import (
+	"context"
+	"fmt"
+)
+
+// ChoiceRule forwards the flow to the Next step if the condition is
+// satisfied
+type ChoiceRule struct {
+	Condition string `json:"condition,omitempty"`
+	Next      Step   `json:"-"`
+	NextID    string `json:"next,omitempty"`
+}
+
+// ChoiceStep forwards the flow to the Next step of the first rule whose
+// condition is satisfied (conditions are the same as in ConditionalStep).
+// If no rule is satisfied, the flow is forwarded to the Default step or,
+// if not set, interrupted. Input must be JSON.
+type ChoiceStep struct {
+	BaseStep
+	Choices   []*ChoiceRule `json:"choices,omitempty"`
+	Default   Step          `json:"-"`
+	DefaultID string        `json:"default,omitempty"`
+}
+
+// PrepareMarshal sets the step type and the choice IDs
+func (s *ChoiceStep) PrepareMarshal() {
+	s.BaseStep.PrepareMarshal()
+	s.Type = TypeChoice
+	for _, choice := range s.Choices {
+		choice.NextID = choice.getNextID()
+	}
+	s.DefaultID = s.getDefaultID()
+}
+
+// GetType returns the step type
+func (s *ChoiceStep) GetType() StepType {
+	return TypeChoice
+}
+
+// ResolveIDs resolves the choice and default IDs
+func (s *ChoiceStep) ResolveIDs(stepMap map[string]Step) error {
+	if err := s.BaseStep.ResolveIDs(stepMap); err != nil {
+		return err
+	}
+
+	for _, choice := range s.Choices {
+		if choice.NextID == "" {
+			// reported by Validate
+			continue
+		}
+		var ok bool
+		if choice.Next, ok = stepMap[choice.NextID]; !ok {
+			return fmt.Errorf("StepID %s not found in workflow", choice.NextID)
+		}
+	}
+	if s.DefaultID != "" {
+		var ok bool
+		if s.Default, ok = stepMap[s.DefaultID]; !ok {
+			return fmt.Errorf("StepID %s not found in workflow", s.DefaultID)
+		}
+	}
+	return nil
+}
+
+// Validate checks there are choices, and each has a next step and a
+// condition that can be compiled
+func (s *ChoiceStep) Validate() []error {
+	errList := s.BaseStep.Validate()
+	if len(s.Choices) == 0 {
+		errList = append(errList, fmt.Errorf("Choice step %s has no choices", s.ID))
+	}
+	if s.GetNextID() != "" {
+		errList = append(errList, fmt.Errorf("Choice step %s cannot have next, use default instead", s.ID))
+	}
+	for i, choice := range s.Choices {
+		if choice.getNextID() == "" {
+			errList = append(errList, fmt.Errorf("Choice %d of step %s has no next step", i, s.ID))
+		}
+		_, _, errs := getExprAndParams(choice.Condition, nil)
+		errList = append(errList, errs...)
+	}
+	return errList
+}
+
+// GetBranchIDs implements the branching step interface
+func (s *ChoiceStep) GetBranchIDs() []string {
+	ids := []string{}
+	for _, choice := range s.Choices {
+		if nextID := choice.getNextID(); nextID != "" {
+			ids = append(ids, nextID)
+		}
+	}
+	if defaultID := s.getDefaultID(); defaultID != "" {
+		ids = append(ids, defaultID)
+	}
+	return ids
+}
+
+// getNextID returns the ID of the Next step if set, or NextID
+func (r *ChoiceRule) getNextID() string {
+	if r.Next != nil {
+		return r.Next.GetID()
+	}
+	return r.NextID
+}
+
+// getDefaultID returns the ID of the Default step if set, or DefaultID
+func (s *ChoiceStep) getDefaultID() string {
+	if s.Default != nil {
+		return s.Default.GetID()
+	}
+	return s.DefaultID
+}
+
+// Route implements the router step interface
+func (s *ChoiceStep) Route(ctx context.Context, exec Executor, flow *Flow) (nextID string, err error) {
+	for _, choice := range s.Choices {
+		truthy, err := evaluateCondition(choice.Condition, flow.Data, nil)
+		if err != nil {
+			return "", err
+		}
+		if truthy {
+			nextID = choice.getNextID()
+			exec.GetLogger().Infof(ctx, "Expression '%s' evaluated to truthey. Forwarding to %s.", choice.Condition, nextID)
+			return nextID, nil
+		}
+	}
+
+	defaultID := s.getDefaultID()
+	if defaultID == "" {
+		exec.GetLogger().Infof(ctx, "No choice satisfied and no default. Interrupting flow.")
+		flow.State = FlowStateInterrupted
+	} else {
+		exec.GetLogger().Infof(ctx, "No choice satisfied. Forwarding to default %s.", defaultID)
+	}
+	return defaultID, nil
+}
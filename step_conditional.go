@@ -23,71 +23,84 @@ func (s *ConditionalStep) PrepareMarshal() {
 	s.Type = TypeConditional
 }
 
+// GetType returns the step type
+func (s *ConditionalStep) GetType() StepType {
+	return TypeConditional
+}
+
 // Validate checks the condition is set and can be compiled
 func (s *ConditionalStep) Validate() []error {
-	_, _, errList := s.getExprAndParams()
+	_, _, errList := getExprAndParams(s.Condition, nil)
 
-	return errList
+	return append(errList, s.BaseStep.Validate()...)
 }
 
 // Do implements DoerStep interface
 func (s *ConditionalStep) Do(ctx context.Context, exec Executor, flow *Flow) error {
+	truthy, err := evaluateCondition(s.Condition, flow.Data, nil)
+	if err != nil {
+		return err
+	}
+
+	if !truthy {
+		exec.GetLogger().Infof(ctx, "Expression '%s' evaluated to falsey. Interrupting flow.", s.Condition)
+		flow.State = FlowStateInterrupted
+	} else {
+		exec.GetLogger().Infof(ctx, "Expression '%s' evaluated to truthey. Flow continues.", s.Condition)
+	}
+
+	return nil
+}
+
+// evaluateCondition applies the condition to the flow data, which must be
+// JSON, and returns false if the value is false, nil, zero or empty string.
+// Variables in the condition are jsonpath selectors on the data, unless
+// they are one of the given variables.
+func evaluateCondition(condition string, flowData interface{}, variables map[string]interface{}) (bool, error) {
 	var jsonData interface{}
 	var err error
-	if jsonData, err = getJSONData(flow.Data); err != nil {
-		return err
+	if jsonData, err = getJSONData(flowData); err != nil {
+		return false, err
 	}
 
-	expr, params, errList := s.getExprAndParams()
+	expr, params, errList := getExprAndParams(condition, variables)
 	if len(errList) > 0 {
 		// should have been caught during validation
-		return errors.New("One or more errors getting expression and parameters")
+		return false, errors.New("One or more errors getting expression and parameters")
 	}
 
 	paramMap := make(map[string]interface{})
+	for name, value := range variables {
+		paramMap[name] = value
+	}
 
 	for _, param := range params {
 		paramVal, err := jsonpath.JsonPathLookup(jsonData, param)
 		if err != nil {
-			return err
+			return false, err
 		}
 		paramMap[param] = paramVal
 	}
 
 	exprVal, err := expr.Evaluate(paramMap)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	// decide whether to interrupt: if value is false, or nil, or zero, or empty string
-	interrupt := false
 	switch val := exprVal.(type) {
 	case string:
-		if val == "" {
-			interrupt = true
-		}
+		return val != "", nil
 	case int:
-		if val == 0 {
-			interrupt = true
-		}
+		return val != 0, nil
+	case float64:
+		// JSON numbers
+		return val != 0, nil
 	case bool:
-		if !val {
-			interrupt = true
-		}
+		return val, nil
 	case interface{}:
-		if val == nil {
-			interrupt = true
-		}
-	}
-
-	if interrupt {
-		exec.GetLogger().Infof(ctx, "Expression '%s' evaluated to falsey. Interrupting flow.", s.Condition)
-		flow.State = FlowStateInterrupted
-	} else {
-		exec.GetLogger().Infof(ctx, "Expression '%s' evaluated to truthey. Flow continues.", s.Condition)
+		return val != nil, nil
 	}
-
-	return nil
+	return false, nil
 }
 
 func getJSONData(flowData interface{}) (jsonData interface{}, err error) {
@@ -98,25 +111,31 @@ func getJSONData(flowData interface{}) (jsonData interface{}, err error) {
 		err = json.Unmarshal([]byte(data), &jsonData)
 	case json.RawMessage:
 		err = json.Unmarshal(data, &jsonData)
-	default:
+	case nil:
 		err = errors.New("Unrecognized data type for conditional")
+	default:
+		// already decoded, e.g. by a select or join step
+		jsonData = data
 	}
 
 	return jsonData, err
 }
 
-func (s *ConditionalStep) getExprAndParams() (expr *govaluate.EvaluableExpression, params []string, errList []error) {
-	if s.Condition == "" {
+func getExprAndParams(condition string, variables map[string]interface{}) (expr *govaluate.EvaluableExpression, params []string, errList []error) {
+	if condition == "" {
 		return nil, nil, []error{errors.New("Condition is empty")}
 	}
 
-	expr, err := govaluate.NewEvaluableExpression(s.Condition)
+	expr, err := govaluate.NewEvaluableExpression(condition)
 	if err != nil {
-		return nil, nil, []error{fmt.Errorf("Error parsing expression '%s': %s", s.Condition, err.Error())}
+		return nil, nil, []error{fmt.Errorf("Error parsing expression '%s': %s", condition, err.Error())}
 	}
 
 	for _, token := range expr.Tokens() {
 		if token.Kind == govaluate.VARIABLE {
+			if _, ok := variables[token.Value.(string)]; ok {
+				continue
+			}
 			_, err = jsonpath.Compile(token.Value.(string))
 			if err != nil {
 				errList = append(errList, fmt.Errorf("Selector '%s' has compilation errors: %s", token.Value, err.Error()))
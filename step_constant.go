@@ -18,13 +18,19 @@ func (s *ConstantStep) PrepareMarshal() {
 	s.Type = TypeConstant
 }
 
+// GetType returns the step type
+func (s *ConstantStep) GetType() StepType {
+	return TypeConstant
+}
+
 // Validate checks that the constant step has a value
 func (s *ConstantStep) Validate() []error {
+	errs := s.BaseStep.Validate()
 	if s.Value == nil {
-		return []error{fmt.Errorf("Missing constant value in step ID %s", s.ID)}
+		errs = append(errs, fmt.Errorf("Missing constant value in step ID %s", s.ID))
 	}
 
-	return []error{}
+	return errs
 }
 
 // Do implements DoerStep interface
@@ -24,6 +24,11 @@ func (s *DistributeStep) PrepareMarshal() {
 	s.Type = TypeDistribute
 }
 
+// GetType returns the step type
+func (s *DistributeStep) GetType() StepType {
+	return TypeDistribute
+}
+
 // Split implements the splitter step interface
 func (s *DistributeStep) Split(ctx context.Context, exec Executor, flow *Flow) (outflows []*Flow, split *FlowSplit, err error) {
 	// make sure flow data can be split: either dictionary or array
@@ -0,0 +1,75 @@
+package stepflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Function is a Go handler executed by function steps. It can change the
+// flow data and content type.
+type Function func(ctx context.Context, flow *Flow) error
+
+// JSONFunction adapts a handler working on decoded JSON data into a
+// Function. The flow data is decoded before calling the handler, and the
+// value it returns becomes the flow data.
+func JSONFunction(fn func(ctx context.Context, data interface{}) (interface{}, error)) Function {
+	return func(ctx context.Context, flow *Flow) error {
+		var data interface{}
+		var err error
+		if flow.Data != nil {
+			if data, err = getJSONData(flow.Data); err != nil {
+				return err
+			}
+		}
+		if flow.Data, err = fn(ctx, data); err != nil {
+			return err
+		}
+		flow.ContentType = "application/json"
+		return nil
+	}
+}
+
+// FunctionStep calls the Go function registered with the executor under
+// the given name (see WithFunctions)
+type FunctionStep struct {
+	BaseStep
+	Function string `json:"function,omitempty"`
+}
+
+// PrepareMarshal sets the step type
+func (s *FunctionStep) PrepareMarshal() {
+	s.BaseStep.PrepareMarshal()
+	s.Type = TypeFunction
+}
+
+// GetType returns the step type
+func (s *FunctionStep) GetType() StepType {
+	return TypeFunction
+}
+
+// Validate checks the function name is set
+func (s *FunctionStep) Validate() []error {
+	errList := s.BaseStep.Validate()
+	if s.Function == "" {
+		errList = append(errList, errors.New("Function name is empty"))
+	}
+	return errList
+}
+
+// ValidateWithExecutor checks the function is registered
+func (s *FunctionStep) ValidateWithExecutor(ctx context.Context, exec Executor) []error {
+	if s.Function != "" && exec.GetFunction(s.Function) == nil {
+		return []error{fmt.Errorf("Function %s of step %s is not registered", s.Function, s.ID)}
+	}
+	return nil
+}
+
+// Do implements DoerStep interface
+func (s *FunctionStep) Do(ctx context.Context, exec Executor, flow *Flow) error {
+	fn := exec.GetFunction(s.Function)
+	if fn == nil {
+		return fmt.Errorf("Function %s is not registered", s.Function)
+	}
+	return fn(ctx, flow)
+}
@@ -12,9 +12,11 @@ import (
 // the steps providing the input, and the values are the inputs. If
 // the input value is not JSON then it is given as a base64-encoded
 // string. If the input is from a step receiving a distribution, the
-// value is an array.
+// value is an array ordered by split index. Interrupted inputs are
+// left out, unless Placeholders is set in which case they are null.
 type JoinStep struct {
 	BaseStep
+	Placeholders bool `json:"placeholders,omitempty"`
 }
 
 // PrepareMarshal sets the step type
@@ -23,6 +25,11 @@ func (s *JoinStep) PrepareMarshal() {
 	s.Type = TypeJoin
 }
 
+// GetType returns the step type
+func (s *JoinStep) GetType() StepType {
+	return TypeJoin
+}
+
 // Join implements Joiner interface for join step
 func (s *JoinStep) Join(ctx context.Context, exec Executor, flow *Flow) (joinedFlow *Flow, err error) {
 	split, err := flow.getLastSplit(ctx, exec)
@@ -30,25 +37,30 @@ func (s *JoinStep) Join(ctx context.Context, exec Executor, flow *Flow) (joinedF
 		return nil, err
 	}
 
-	var errIncr int64
-	if flow.State == FlowStateError {
-		errIncr = 1
+	// the flow is only counted once, in case it is being recovered
+	isFirst, totalFinish, totalError, err := flow.countFinished(ctx, exec, split)
+	if err != nil {
+		return nil, err
 	}
-	totalFinish, totalError := exec.GetStorage().IncrementWithError(ctx, string(split.ID), 1, errIncr)
 
 	if totalFinish < int64(len(split.FlowIDs)) {
 		// not all flows finished
 		return nil, nil
 	}
 
-	// all flows are finished. figure out join state, and compile results
-	flows, _, err := flow.getSiblingFlows(ctx, exec)
-
 	joinedFlow, ok := (exec.GetStorage().RetrieveFlows(ctx, []FlowID{split.ParentFlowID}))[split.ParentFlowID]
 	if !ok {
 		return nil, fmt.Errorf("Could not retrieve parent flow with ID %s", split.ParentFlowID)
 	}
 
+	if !isFirst && joinedFlow.State != FlowStateSplit {
+		// recovered flow, but the join already happened
+		return nil, nil
+	}
+
+	// all flows are finished. figure out join state, and compile results
+	flows, _, err := flow.getSiblingFlows(ctx, exec)
+
 	// if we have all the flows and no errors, treat as successful join
 	// and collect all the data
 	if len(flows) == len(split.FlowIDs) && totalError == 0 {
@@ -58,13 +70,17 @@ func (s *JoinStep) Join(ctx context.Context, exec Executor, flow *Flow) (joinedF
 			for _, flow := range flows {
 				if flow.State != FlowStateInterrupted {
 					dataMap[flow.SplitKey] = flow.Data
+				} else if s.Placeholders {
+					dataMap[flow.SplitKey] = nil
 				}
 			}
-		} else { // it is numerical index
+		} else { // it is numerical index, flows are ordered by it
 			var dataArr []interface{}
 			for _, flow := range flows {
 				if flow.State != FlowStateInterrupted {
 					dataArr = append(dataArr, flow.Data)
+				} else if s.Placeholders {
+					dataArr = append(dataArr, nil)
 				}
 			}
 			joinedFlow.Data = dataArr
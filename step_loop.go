@@ -0,0 +1,106 @@
+package stepflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// LoopIterationVariable is the name of the variable holding the number of
+// completed iterations in loop conditions
+const LoopIterationVariable = "iteration"
+
+// LoopStep forwards the flow to the Body step while the condition is
+// satisfied (conditions are the same as in ConditionalStep, and can also
+// use the iteration variable). The body must forward back to the loop
+// step, which forwards to the Next step once the condition is no longer
+// satisfied. The flow fails if the body would run more than MaxIterations
+// times. Input must be JSON.
+type LoopStep struct {
+	BaseStep
+	Condition     string `json:"condition,omitempty"`
+	Body          Step   `json:"-"`
+	BodyID        string `json:"body,omitempty"`
+	MaxIterations int    `json:"maxIterations,omitempty"`
+}
+
+// PrepareMarshal sets the step type and the body ID
+func (s *LoopStep) PrepareMarshal() {
+	s.BaseStep.PrepareMarshal()
+	s.Type = TypeLoop
+	s.BodyID = s.getBodyID()
+}
+
+// GetType returns the step type
+func (s *LoopStep) GetType() StepType {
+	return TypeLoop
+}
+
+// ResolveIDs resolves the body ID
+func (s *LoopStep) ResolveIDs(stepMap map[string]Step) error {
+	if err := s.BaseStep.ResolveIDs(stepMap); err != nil {
+		return err
+	}
+
+	if s.BodyID != "" {
+		var ok bool
+		if s.Body, ok = stepMap[s.BodyID]; !ok {
+			return fmt.Errorf("StepID %s not found in workflow", s.BodyID)
+		}
+	}
+	return nil
+}
+
+// Validate checks the body and maximum iterations are set, and the
+// condition can be compiled
+func (s *LoopStep) Validate() []error {
+	errList := s.BaseStep.Validate()
+	if s.getBodyID() == "" {
+		errList = append(errList, errors.New("Loop body is empty"))
+	}
+	if s.MaxIterations <= 0 {
+		errList = append(errList, fmt.Errorf("Loop step %s must have a positive maxIterations", s.ID))
+	}
+	_, _, errs := getExprAndParams(s.Condition, map[string]interface{}{LoopIterationVariable: 0})
+	return append(errList, errs...)
+}
+
+// GetBranchIDs implements the branching step interface
+func (s *LoopStep) GetBranchIDs() []string {
+	return []string{s.getBodyID()}
+}
+
+// getBodyID returns the ID of the Body step if set, or BodyID
+func (s *LoopStep) getBodyID() string {
+	if s.Body != nil {
+		return s.Body.GetID()
+	}
+	return s.BodyID
+}
+
+// Route implements the router step interface
+func (s *LoopStep) Route(ctx context.Context, exec Executor, flow *Flow) (nextID string, err error) {
+	iteration := flow.Iterations[s.ID]
+	truthy, err := evaluateCondition(s.Condition, flow.Data,
+		map[string]interface{}{LoopIterationVariable: float64(iteration)})
+	if err != nil {
+		return "", err
+	}
+
+	if !truthy {
+		exec.GetLogger().Infof(ctx, "Expression '%s' evaluated to falsey after %d iterations. Leaving loop.", s.Condition, iteration)
+		delete(flow.Iterations, s.ID)
+		return s.GetNextID(), nil
+	}
+
+	if iteration >= s.MaxIterations {
+		return "", fmt.Errorf("Loop step %s exceeded the maximum of %d iterations", s.ID, s.MaxIterations)
+	}
+
+	if flow.Iterations == nil {
+		flow.Iterations = make(map[string]int)
+	}
+	flow.Iterations[s.ID] = iteration + 1
+	exec.GetLogger().Infof(ctx, "Expression '%s' evaluated to truthey. Starting iteration %d.", s.Condition, iteration+1)
+	return s.getBodyID(), nil
+}
@@ -17,6 +17,11 @@ func (s *RaceStep) PrepareMarshal() {
 	s.Type = TypeRace
 }
 
+// GetType returns the step type
+func (s *RaceStep) GetType() StepType {
+	return TypeRace
+}
+
 // Join implements Joiner interface for race step
 func (s *RaceStep) Join(ctx context.Context, exec Executor, flow *Flow) (joinedFlow *Flow, err error) {
 	split, err := flow.getLastSplit(ctx, exec)
@@ -24,14 +29,38 @@ func (s *RaceStep) Join(ctx context.Context, exec Executor, flow *Flow) (joinedF
 		return nil, err
 	}
 
-	var activeFlowCount int64
-	var incr int64
-	if flow.State == FlowStateActive {
-		incr = 1
+	// the flow is only counted once, in case it is being recovered. The
+	// finished and active flows are counted together, so both counts are
+	// updated or neither is
+	isFirst, err := flow.markFinished(ctx, exec, split.ID)
+	if err != nil {
+		return nil, err
+	}
+	var incr, finishIncr int64
+	if isFirst {
+		finishIncr = 1
+		if flow.State == FlowStateActive {
+			incr = 1
+		}
+	}
+	totalFinish, activeFlowCount, err := exec.GetStorage().IncrementWithError(ctx, s.ID+":"+string(split.ID), finishIncr, incr)
+	if err != nil {
+		if isFirst {
+			flow.unmarkFinished(ctx, exec, split.ID)
+		}
+		return nil, err
 	}
-	activeFlowCount, _ = exec.GetStorage().IncrementWithError(ctx, s.ID+":"+string(split.ID), incr, 0)
 
-	totalFinish, _ := exec.GetStorage().IncrementWithError(ctx, string(split.ID), 1, 0)
+	if !isFirst {
+		// recovered flow: if the race is not over, an active flow can win it
+		joinedFlow, ok := (exec.GetStorage().RetrieveFlows(ctx, []FlowID{split.ParentFlowID}))[split.ParentFlowID]
+		if !ok || joinedFlow.State != FlowStateSplit {
+			return nil, nil
+		}
+		if flow.State == FlowStateActive {
+			activeFlowCount, incr = 1, 1
+		}
+	}
 
 	// let the first active flow through
 	if activeFlowCount == 1 && incr == 1 {
@@ -21,10 +21,16 @@ func (s *SelectStep) PrepareMarshal() {
 	s.Type = TypeSelect
 }
 
+// GetType returns the step type
+func (s *SelectStep) GetType() StepType {
+	return TypeSelect
+}
+
 // Validate checks the selector can be compiled
 func (s *SelectStep) Validate() (errList []error) {
+	errList = s.BaseStep.Validate()
 	if s.Selector == "" {
-		return []error{errors.New("Selector is empty")}
+		return append(errList, errors.New("Selector is empty"))
 	}
 
 	if _, err := jsonpath.Compile(s.Selector); err != nil {
@@ -0,0 +1,35 @@
+package stepflow
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// WaitForSignalStep parks the flow until it is resumed by a call to the
+// executor's Signal method with the flow's SignalToken, e.g. when an
+// outside system or a person approves. The flow then continues to the
+// Next step with the data given in the signal. If Timeout is set and no
+// signal is received in time, the step fails.
+type WaitForSignalStep struct {
+	BaseStep
+}
+
+// PrepareMarshal sets the step type
+func (s *WaitForSignalStep) PrepareMarshal() {
+	s.BaseStep.PrepareMarshal()
+	s.Type = TypeWaitForSignal
+}
+
+// GetType returns the step type
+func (s *WaitForSignalStep) GetType() StepType {
+	return TypeWaitForSignal
+}
+
+// Do implements DoerStep interface
+func (s *WaitForSignalStep) Do(ctx context.Context, exec Executor, flow *Flow) error {
+	flow.State = FlowStateWaiting
+	flow.SignalToken = string(flow.ID) + ":" + uuid.New().String()
+	exec.GetLogger().Infof(ctx, "Flow waiting for signal with token %s", flow.SignalToken)
+	return nil
+}
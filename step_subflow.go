@@ -0,0 +1,70 @@
+package stepflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// SubflowStep starts another dataflow as a child run, with the flow data
+// as input. The dataflow is either given inline or referenced by the ID
+// of a dataflow registered with the executor (see WithDataflows). The
+// flow waits until the child run finishes, then continues with the
+// child's output (see DataflowRun.GetResult) or fails if the child run
+// did not complete.
+type SubflowStep struct {
+	BaseStep
+	Dataflow   *Dataflow `json:"dataflow,omitempty"`
+	DataflowID string    `json:"dataflowId,omitempty"`
+}
+
+// PrepareMarshal sets the step type
+func (s *SubflowStep) PrepareMarshal() {
+	s.BaseStep.PrepareMarshal()
+	s.Type = TypeSubflow
+}
+
+// GetType returns the step type
+func (s *SubflowStep) GetType() StepType {
+	return TypeSubflow
+}
+
+// Validate checks the dataflow is given either inline or by ID
+func (s *SubflowStep) Validate() []error {
+	errList := s.BaseStep.Validate()
+	if s.Dataflow == nil && s.DataflowID == "" {
+		errList = append(errList, errors.New("Subflow step has no dataflow or dataflowId"))
+	} else if s.Dataflow != nil && s.DataflowID != "" {
+		errList = append(errList, fmt.Errorf("Subflow step %s cannot have both dataflow and dataflowId", s.ID))
+	}
+	return errList
+}
+
+// ValidateWithExecutor validates the inline dataflow, or checks the
+// referenced dataflow is registered. Subflow cycles are found by the
+// validation of the parent dataflow.
+func (s *SubflowStep) ValidateWithExecutor(ctx context.Context, exec Executor) []error {
+	if s.Dataflow != nil {
+		return exec.Validate(context.WithValue(ctx, subflowValidationKey{}, true), s.Dataflow)
+	} else if s.DataflowID != "" && exec.GetDataflow(s.DataflowID) == nil {
+		return []error{fmt.Errorf("Dataflow ID %s of subflow step %s is not registered", s.DataflowID, s.ID)}
+	}
+	return nil
+}
+
+// Do implements DoerStep interface
+func (s *SubflowStep) Do(ctx context.Context, exec Executor, flow *Flow) error {
+	dataflow := s.Dataflow
+	if dataflow == nil {
+		if dataflow = exec.GetDataflow(s.DataflowID); dataflow == nil {
+			return fmt.Errorf("Dataflow ID %s is not registered", s.DataflowID)
+		}
+	}
+
+	run, errs := exec.StartSubflow(ctx, dataflow, flow)
+	if len(errs) > 0 {
+		return fmt.Errorf("Error starting subflow: %v", errs)
+	}
+	exec.GetLogger().Infof(ctx, "Started subflow run %s", run.ID)
+	return nil
+}
@@ -0,0 +1,74 @@
+package stepflow_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+// repeatStep is a custom step that repeats the text flow data
+type repeatStep struct {
+	stepflow.BaseStep
+	Times int `json:"times"`
+}
+
+func (s *repeatStep) Do(ctx context.Context, exec stepflow.Executor, flow *stepflow.Flow) error {
+	flow.Data = strings.Repeat(flow.Data.(string), s.Times)
+	return nil
+}
+
+const typeRepeat stepflow.StepType = "test-repeat"
+
+// the registry is global, so the custom type is registered once even when
+// the tests run several times
+var errRegisterRepeat = stepflow.RegisterStepType(typeRepeat, func() stepflow.Step { return &repeatStep{} })
+
+func TestRegisterStepType(t *testing.T) {
+	if errRegisterRepeat != nil {
+		t.Fatalf("Step type could not be registered: %s", errRegisterRepeat.Error())
+	}
+	factory := func() stepflow.Step { return &repeatStep{} }
+	tests := []struct {
+		name     string
+		stepType stepflow.StepType
+		factory  func() stepflow.Step
+	}{
+		{"duplicate type", typeRepeat, factory},
+		{"duplicate built-in type", stepflow.TypeConstant, factory},
+		{"empty type", "", factory},
+		{"nil factory", "test-nil", nil},
+	}
+
+	for _, test := range tests {
+		if err := stepflow.RegisterStepType(test.stepType, test.factory); err == nil {
+			t.Errorf("%s: expected an error registering the step type", test.name)
+		}
+	}
+	if _, err := stepflow.UnmarshalStep([]byte(`{"id": "nil", "type": "test-nil"}`)); err == nil {
+		t.Errorf("Expected the step type with a nil factory not registered")
+	}
+}
+
+func TestCustomStepType(t *testing.T) {
+	ctx := context.Background()
+	te := newTestExecutor(t)
+	df := readDataflow(t, `{
+		"id": "Custom",
+		"startAt": "repeat",
+		"steps": [{"id": "repeat", "type": "test-repeat", "times": 3}]
+	}`)
+	if step, ok := df.GetStep("repeat").(*repeatStep); !ok || step.Times != 3 {
+		t.Fatalf("Expected the custom step unmarshalled, got %#v", df.GetStep("repeat"))
+	}
+
+	run, errs := te.StartWithInput(ctx, df, "ab", "text/plain")
+	if len(errs) > 0 {
+		t.Fatalf("Run could not be started: %v", errs)
+	}
+	run = te.waitForRun(t, run.ID)
+	if data, _ := run.GetResult(); run.State != stepflow.RunStateCompleted || data != "ababab" {
+		t.Errorf("Expected the custom step to repeat the data, got %s run with %v", run.State, data)
+	}
+}
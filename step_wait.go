@@ -0,0 +1,85 @@
+package stepflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oliveagle/jsonpath"
+)
+
+// WaitStep delays the flow before forwarding it to the Next step, either
+// for Duration or until the time selected from the flow data by the Until
+// jsonpath expression. The selected time is either an RFC 3339 string or
+// a number of seconds since the Unix epoch. The flow is enqueued with a
+// delay, so it does not occupy a worker while waiting.
+type WaitStep struct {
+	BaseStep
+	Duration Duration `json:"duration,omitempty"`
+	Until    string   `json:"until,omitempty"`
+}
+
+// PrepareMarshal sets the step type
+func (s *WaitStep) PrepareMarshal() {
+	s.BaseStep.PrepareMarshal()
+	s.Type = TypeWait
+}
+
+// GetType returns the step type
+func (s *WaitStep) GetType() StepType {
+	return TypeWait
+}
+
+// Validate checks either the duration or the until selector is set, and
+// there is a next step, since a flow ending at a wait step would complete
+// without waiting
+func (s *WaitStep) Validate() []error {
+	errList := s.BaseStep.Validate()
+	if s.GetNextID() == "" {
+		errList = append(errList, fmt.Errorf("Wait step %s has no next step", s.ID))
+	}
+	if s.Duration < 0 {
+		errList = append(errList, fmt.Errorf("Duration cannot be negative in step ID %s", s.ID))
+	}
+	if s.Duration == 0 && s.Until == "" {
+		errList = append(errList, errors.New("Wait step has no duration or until"))
+	} else if s.Duration != 0 && s.Until != "" {
+		errList = append(errList, fmt.Errorf("Wait step %s cannot have both duration and until", s.ID))
+	}
+	if s.Until != "" {
+		if _, err := jsonpath.Compile(s.Until); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	return errList
+}
+
+// Do implements DoerStep interface
+func (s *WaitStep) Do(ctx context.Context, exec Executor, flow *Flow) error {
+	notBefore := time.Now().Add(time.Duration(s.Duration))
+	if s.Until != "" {
+		jsonData, err := getJSONData(flow.Data)
+		if err != nil {
+			return err
+		}
+		value, err := jsonpath.JsonPathLookup(jsonData, s.Until)
+		if err != nil {
+			return err
+		}
+		switch until := value.(type) {
+		case string:
+			if notBefore, err = time.Parse(time.RFC3339, until); err != nil {
+				return err
+			}
+		case float64:
+			notBefore = time.Unix(0, int64(until*float64(time.Second)))
+		default:
+			return fmt.Errorf("Value selected by '%s' is not a time: %v", s.Until, value)
+		}
+	}
+
+	exec.GetLogger().Infof(ctx, "Flow waiting until %s", notBefore.Format(time.RFC3339Nano))
+	flow.NotBefore = notBefore
+	return nil
+}
@@ -20,6 +20,17 @@ var validMethods = map[string]struct{}{
 	http.MethodDelete: struct{}{},
 }
 
+// HTTPError is returned by a web method step when the response status is not OK
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
 // WebMethodStep describes a step that makes an HTTP request, and sends
 // the response to the Next step
 type WebMethodStep struct {
@@ -34,9 +45,14 @@ func (s *WebMethodStep) PrepareMarshal() {
 	s.Type = TypeWebMethod
 }
 
+// GetType returns the step type
+func (s *WebMethodStep) GetType() StepType {
+	return TypeWebMethod
+}
+
 // Validate checks the method and URL are OK
 func (s *WebMethodStep) Validate() []error {
-	errs := []error{}
+	errs := s.BaseStep.Validate()
 	if _, ok := validMethods[s.Method]; !ok {
 		errs = append(errs, fmt.Errorf("%s is not a valid method", s.Method))
 	}
@@ -76,6 +92,7 @@ func (s *WebMethodStep) Do(ctx context.Context, exec Executor, flow *Flow) error
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 
 	if flow.ContentType != "" {
 		req.Header.Add("Content-Type", flow.ContentType)
@@ -93,20 +110,14 @@ func (s *WebMethodStep) Do(ctx context.Context, exec Executor, flow *Flow) error
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("%s: %s", resp.Status, string(bodyBytes))
+		return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(bodyBytes)}
 	}
 
 	if flow.ContentType == "" {
 		flow.ContentType = resp.Header.Get("Content-Type")
 	}
 
-	if strings.HasPrefix(strings.ToLower(flow.ContentType), "text/") {
-		flow.Data = string(bodyBytes)
-	} else if flow.ContentType == "application/json" {
-		flow.Data = json.RawMessage(bodyBytes)
-	} else {
-		flow.Data = bodyBytes
-	}
+	flow.Data = FlowDataFromBytes(flow.ContentType, bodyBytes)
 
 	exec.GetLogger().Debugf(ctx, "Got web data %s", flow.Data)
 
@@ -0,0 +1,209 @@
+package stepflow
+
+import (
+	"fmt"
+)
+
+// ValidationRule identifies the rule broken by a dataflow graph
+type ValidationRule string
+
+// These are the rules checked by ValidateGraph
+const (
+	RuleMissingStart  ValidationRule = "missing-start"  // startAt is not set
+	RuleDuplicateStep ValidationRule = "duplicate-step" // step IDs must be unique
+	RuleUnknownStep   ValidationRule = "unknown-step"   // a step references a step not in the dataflow
+	RuleUnreachable   ValidationRule = "unreachable"    // step cannot be reached from startAt
+	RuleCycle         ValidationRule = "cycle"          // step can be reached from itself, other than through a loop
+	RuleUnpairedJoin  ValidationRule = "unpaired-join"  // join or race not preceded by a split
+	RuleReconverge    ValidationRule = "reconverge"     // step reached with different split depths
+)
+
+// ValidationError describes a problem found in the dataflow graph. StepID
+// is empty if the problem is not specific to a step.
+type ValidationError struct {
+	StepID  string
+	Rule    ValidationRule
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.StepID == "" {
+		return fmt.Sprintf("%s: %s", e.Rule, e.Message)
+	}
+	return fmt.Sprintf("%s: step %s: %s", e.Rule, e.StepID, e.Message)
+}
+
+// graphEdge is a transition between steps. Depth is +1 if the flows
+// following the edge are split, -1 if they are joined
+type graphEdge struct {
+	to    string
+	depth int
+}
+
+// getEdges returns the transitions out of a step
+func getEdges(step Step) []graphEdge {
+	depth := 0
+	if _, ok := step.(SplitterStep); ok {
+		depth = 1
+	} else if _, ok := step.(JoinerStep); ok {
+		depth = -1
+	}
+
+	edges := []graphEdge{}
+	if nextID := step.GetNextID(); nextID != "" {
+		edges = append(edges, graphEdge{to: nextID, depth: depth})
+	}
+	if branching, ok := step.(BranchingStep); ok {
+		for _, id := range branching.GetBranchIDs() {
+			edges = append(edges, graphEdge{to: id, depth: depth})
+		}
+	}
+	if onErrorID := step.GetOnErrorID(); onErrorID != "" {
+		// a failed split does not split the flow, but a failed join
+		// continues with the joined flow
+		errDepth := 0
+		if depth < 0 {
+			errDepth = depth
+		}
+		edges = append(edges, graphEdge{to: onErrorID, depth: errDepth})
+	}
+	return edges
+}
+
+// ValidateGraph checks the structure of the dataflow: the start step is
+// set, step IDs are unique and referenced steps exist, all steps are
+// reachable from the start, the only cycles are loop bodies, and joining
+// steps are reached by split flows. Returned errors are of type
+// *ValidationError.
+func ValidateGraph(workflow *Dataflow) []error {
+	errs := []error{}
+
+	stepMap := make(map[string]Step)
+	for _, step := range workflow.Steps {
+		if _, ok := stepMap[step.GetID()]; ok {
+			errs = append(errs, &ValidationError{StepID: step.GetID(), Rule: RuleDuplicateStep,
+				Message: "Step ID is used more than once"})
+		}
+		stepMap[step.GetID()] = step
+	}
+
+	for _, step := range workflow.Steps {
+		// a split flow must not be forwarded to the same step twice
+		_, isSplitter := step.(SplitterStep)
+		seen := make(map[string]bool)
+		for _, edge := range getEdges(step) {
+			if _, ok := stepMap[edge.to]; !ok {
+				errs = append(errs, &ValidationError{StepID: step.GetID(), Rule: RuleUnknownStep,
+					Message: fmt.Sprintf("StepID %s not found in workflow", edge.to)})
+			} else if isSplitter && seen[edge.to] {
+				errs = append(errs, &ValidationError{StepID: step.GetID(), Rule: RuleReconverge,
+					Message: fmt.Sprintf("Step forwards to step %s more than once", edge.to)})
+			}
+			seen[edge.to] = true
+		}
+	}
+
+	if workflow.StartAt == nil {
+		return append(errs, &ValidationError{Rule: RuleMissingStart, Message: "Dataflow has no start step"})
+	}
+	if _, ok := stepMap[workflow.StartAt.GetID()]; !ok {
+		// e.g. a dataflow built in code whose start step is not in its steps
+		return append(errs, &ValidationError{StepID: workflow.StartAt.GetID(), Rule: RuleUnknownStep,
+			Message: "Start step not found in workflow"})
+	}
+
+	// walk the graph breadth-first from the start, keeping track of the
+	// split depth at which each step is reached
+	depths := map[string]int{workflow.StartAt.GetID(): 0}
+	queue := []string{workflow.StartAt.GetID()}
+	reported := make(map[string]bool)
+	for len(queue) > 0 {
+		step := stepMap[queue[0]]
+		queue = queue[1:]
+
+		depth := depths[step.GetID()]
+		if _, ok := step.(JoinerStep); ok && depth == 0 {
+			errs = append(errs, &ValidationError{StepID: step.GetID(), Rule: RuleUnpairedJoin,
+				Message: "Joining step is not preceded by a distribute or broadcast step"})
+			depth = 1
+		}
+
+		for _, edge := range getEdges(step) {
+			if _, ok := stepMap[edge.to]; !ok {
+				continue
+			}
+			nextDepth := depth + edge.depth
+			if prevDepth, ok := depths[edge.to]; !ok {
+				depths[edge.to] = nextDepth
+				queue = append(queue, edge.to)
+			} else if prevDepth != nextDepth && !reported[edge.to] {
+				reported[edge.to] = true
+				errs = append(errs, &ValidationError{StepID: edge.to, Rule: RuleReconverge,
+					Message: fmt.Sprintf("Step is reached by flows split %d and %d times", prevDepth, nextDepth)})
+			}
+		}
+	}
+
+	for _, step := range workflow.Steps {
+		if _, ok := depths[step.GetID()]; !ok {
+			errs = append(errs, &ValidationError{StepID: step.GetID(), Rule: RuleUnreachable,
+				Message: "Step cannot be reached from the start step"})
+		}
+	}
+
+	return append(errs, findCycles(workflow, stepMap)...)
+}
+
+// findCycles does a depth-first search for transitions back to a step
+// being visited. Going back to a loop step is only allowed from inside its
+// body, i.e. when the loop was left through its body transition.
+func findCycles(workflow *Dataflow, stepMap map[string]Step) []error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	errs := []error{}
+	state := make(map[string]int)
+	inBody := make(map[string]bool) // loops whose body is being visited
+
+	var visit func(step Step)
+	visit = func(step Step) {
+		state[step.GetID()] = visiting
+		for _, edge := range getEdges(step) {
+			next, ok := stepMap[edge.to]
+			if !ok {
+				continue
+			}
+			switch state[edge.to] {
+			case visiting:
+				if _, ok := next.(*LoopStep); ok && inBody[edge.to] {
+					// going back to a loop is how its body repeats
+					continue
+				}
+				errs = append(errs, &ValidationError{StepID: step.GetID(), Rule: RuleCycle,
+					Message: fmt.Sprintf("Transition to step %s creates a cycle", edge.to)})
+			case unvisited:
+				loop, isLoop := step.(*LoopStep)
+				isBody := isLoop && edge.to == loop.getBodyID()
+				if isBody {
+					inBody[step.GetID()] = true
+				}
+				visit(next)
+				if isBody {
+					inBody[step.GetID()] = false
+				}
+			}
+		}
+		state[step.GetID()] = visited
+	}
+
+	// start from the start step so loops are entered at the loop step
+	visit(workflow.StartAt)
+	for _, step := range workflow.Steps {
+		if state[step.GetID()] == unvisited {
+			visit(step)
+		}
+	}
+	return errs
+}
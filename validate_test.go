@@ -0,0 +1,101 @@
+package stepflow_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+)
+
+func TestValidateLoopCycles(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   string
+		isCycle bool
+	}{
+		{"body back to loop", `[
+			{"id": "loop", "type": "loop", "body": "body", "next": "done", "maxIterations": 3},
+			{"id": "body", "type": "constant", "next": "loop", "value": 1},
+			{"id": "done", "type": "constant", "value": 2}
+		]`, false},
+		{"next back to loop", `[
+			{"id": "loop", "type": "loop", "body": "body", "next": "done", "maxIterations": 3},
+			{"id": "body", "type": "constant", "next": "loop", "value": 1},
+			{"id": "done", "type": "constant", "next": "loop", "value": 2}
+		]`, true},
+		{"onError back to loop", `[
+			{"id": "loop", "type": "loop", "body": "body", "onError": "handler", "maxIterations": 3},
+			{"id": "body", "type": "constant", "next": "loop", "value": 1},
+			{"id": "handler", "type": "constant", "next": "loop", "value": 2}
+		]`, true},
+	}
+
+	for _, test := range tests {
+		df := readDataflow(t, `{"id": "Loop", "startAt": "loop", "steps": `+test.steps+`}`)
+		isCycle := false
+		for _, err := range stepflow.ValidateGraph(df) {
+			if validationErr, ok := err.(*stepflow.ValidationError); ok && validationErr.Rule == stepflow.RuleCycle {
+				isCycle = true
+			} else {
+				t.Errorf("%s: unexpected validation error %s", test.name, err.Error())
+			}
+		}
+		if isCycle != test.isCycle {
+			t.Errorf("%s: expected cycle %t, got %t", test.name, test.isCycle, isCycle)
+		}
+	}
+}
+
+func TestValidateGraph(t *testing.T) {
+	tests := []struct {
+		name   string
+		json   string
+		rule   stepflow.ValidationRule
+		stepID string
+	}{
+		{"unreachable step", `{"id": "V", "startAt": "start", "steps": [
+			{"id": "start", "type": "constant", "value": 1},
+			{"id": "orphan", "type": "constant", "value": 2}
+		]}`, stepflow.RuleUnreachable, "orphan"},
+		{"missing start", `{"id": "V", "steps": [
+			{"id": "start", "type": "constant", "value": 1}
+		]}`, stepflow.RuleMissingStart, ""},
+		{"unpaired join", `{"id": "V", "startAt": "start", "steps": [
+			{"id": "start", "type": "constant", "value": [1, 2], "next": "join"},
+			{"id": "join", "type": "join"}
+		]}`, stepflow.RuleUnpairedJoin, "join"},
+		{"reconverge without join", `{"id": "V", "startAt": "broadcast", "steps": [
+			{"id": "broadcast", "type": "broadcast", "forwardTo": ["left", "right"]},
+			{"id": "left", "type": "constant", "value": 1, "next": "end"},
+			{"id": "right", "type": "constant", "value": 2, "next": "join"},
+			{"id": "join", "type": "join", "next": "end"},
+			{"id": "end", "type": "constant", "value": 3}
+		]}`, stepflow.RuleReconverge, "end"},
+		{"duplicate step IDs", `{"id": "V", "startAt": "start", "steps": [
+			{"id": "start", "type": "constant", "value": 1, "next": "end"},
+			{"id": "end", "type": "constant", "value": 2},
+			{"id": "end", "type": "constant", "value": 3}
+		]}`, stepflow.RuleDuplicateStep, "end"},
+	}
+
+	for _, test := range tests {
+		errs := stepflow.ValidateGraph(readDataflow(t, test.json))
+		if len(errs) != 1 {
+			t.Errorf("%s: expected 1 validation error, got %v", test.name, errs)
+			continue
+		}
+		validationErr, ok := errs[0].(*stepflow.ValidationError)
+		if !ok || validationErr.Rule != test.rule || validationErr.StepID != test.stepID {
+			t.Errorf("%s: expected rule %s broken by step '%s', got %v", test.name, test.rule, test.stepID, errs[0])
+		}
+	}
+}
+
+func TestUnknownStepType(t *testing.T) {
+	var df stepflow.Dataflow
+	err := json.Unmarshal([]byte(`{"id": "V", "startAt": "start", "steps": [{"id": "start", "type": "unknown"}]}`), &df)
+	if err == nil || !strings.Contains(err.Error(), "Step type not recognized: unknown") {
+		t.Errorf("Expected the unknown step type rejected, got %v", err)
+	}
+}
@@ -3,24 +3,55 @@ package stepflow
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // const DataflowRunKind = "DataflowRun"
 
-// Dataflow defines a workflow
+// Dataflow defines a workflow. If Timeout is set, runs that do not finish
+// within the timeout are stopped with an error.
 type Dataflow struct {
 	ID          string          `json:"id,omitempty"`
 	Description string          `json:"description,omitempty"`
+	Timeout     Duration        `json:"timeout,omitempty"`
 	Steps       []Step          `json:"-"`
 	StartAt     Step            `json:"-"`
 	StepMap     map[string]Step `json:"-"`
+
+	prepared bool // steps are ready to marshal, see prepare
+}
+
+// prepareMu serializes the preparation of dataflows, which changes steps
+// that may be shared between dataflows
+var prepareMu sync.Mutex
+
+// prepare calls PrepareMarshal on the steps and builds the step map, once.
+// The dataflows of runs are prepared when the run starts (or when the
+// dataflow is registered or unmarshalled), so runs can then be marshalled
+// concurrently without changing the steps.
+func (w *Dataflow) prepare() {
+	prepareMu.Lock()
+	defer prepareMu.Unlock()
+	if w.prepared {
+		return
+	}
+
+	stepMap := make(map[string]Step)
+	for _, step := range w.Steps {
+		step.PrepareMarshal()
+		stepMap[step.GetID()] = step
+	}
+	w.StepMap = stepMap
+	w.prepared = true
 }
 
 // GetStep returns the workflow step with the given ID
 func (w *Dataflow) GetStep(ID string) Step {
 	if w.StepMap == nil {
+		w.StepMap = make(map[string]Step)
 		for _, step := range w.Steps {
 			w.StepMap[step.GetID()] = step
 		}
@@ -45,12 +76,15 @@ type DataflowMarshaller struct {
 
 // MarshalJSON implements Marshaller for Dataflow
 func (w Dataflow) MarshalJSON() ([]byte, error) {
+	if !w.prepared {
+		// e.g. a dataflow built in code that was not run
+		w.prepare()
+	}
 	dfNoMar := DataflowMarshaller{DataflowNoFn: DataflowNoFn(w)}
 	// dfNoMar.ID = w.ID
 	// dfNoMar.Description = w.Description
 
 	for _, step := range dfNoMar.Steps {
-		step.PrepareMarshal()
 		stepJSON, err := json.Marshal(step)
 		if err != nil {
 			return nil, err
@@ -99,6 +133,7 @@ func (w *Dataflow) UnmarshalJSON(bytes []byte) error {
 
 	dfNoMar.StepMap = stepMap
 	*w = Dataflow(dfNoMar.DataflowNoFn)
+	w.prepare()
 	return nil
 }
 
@@ -126,11 +161,59 @@ const (
 	RunStateError       = DataflowRunState("Error")
 )
 
-// DataflowRun describes a running workflow
+// FlowOutput is the data of a flow, kept in the workflow run
+type FlowOutput struct {
+	ContentType string
+	Data        interface{}
+}
+
+// DataflowRun describes a running workflow. Outputs holds the data of
+// completed flows and of flows leaving steps marked to keep output. It is
+// keyed by step ID, then by the split keys and/or indexes of the flow
+// joined by "/" (empty for the root flow). Runs started by a subflow
+// step have the parent run and flow set.
 type DataflowRun struct {
-	ID       DataflowRunID
-	Dataflow *Dataflow
-	State    DataflowRunState
+	ID           DataflowRunID
+	Dataflow     *Dataflow
+	State        DataflowRunState
+	Message      string    // if State is Error or Interrupted, this has the explanation
+	Deadline     time.Time // if the dataflow has a timeout, when the run times out
+	Outputs      map[string]map[string]*FlowOutput
+	ParentRunID  DataflowRunID
+	ParentFlowID FlowID
+}
+
+// GetResult returns the data and content type of the only output of the
+// run. If there are several outputs, the data is a JSON object keyed by
+// step ID and then by output key.
+func (r *DataflowRun) GetResult() (data interface{}, contentType string) {
+	if len(r.Outputs) == 1 {
+		for _, stepOutputs := range r.Outputs {
+			if len(stepOutputs) == 1 {
+				for _, output := range stepOutputs {
+					return output.Data, output.ContentType
+				}
+			}
+		}
+	}
+
+	dataMap := make(map[string]map[string]interface{})
+	for stepID, stepOutputs := range r.Outputs {
+		dataMap[stepID] = make(map[string]interface{})
+		for key, output := range stepOutputs {
+			dataMap[stepID][key] = output.Data
+		}
+	}
+	return dataMap, "application/json"
+}
+
+// IsFinished returns true if the run is completed, failed or interrupted
+func (r *DataflowRun) IsFinished() bool {
+	return r.State == RunStateCompleted || r.State == RunStateError || r.State == RunStateInterrupted
+}
+
+func (r *DataflowRun) isPastDeadline() bool {
+	return !r.Deadline.IsZero() && time.Now().After(r.Deadline)
 }
 
 // NewDataflowRun creates a run
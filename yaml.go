@@ -0,0 +1,94 @@
+package stepflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler for Dataflow. The YAML has the
+// same schema as the JSON.
+func (w *Dataflow) UnmarshalYAML(value *yaml.Node) error {
+	var data interface{}
+	if err := value.Decode(&data); err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(yamlToJSON(data))
+	if err != nil {
+		return err
+	}
+	return w.UnmarshalJSON(bytes)
+}
+
+// MarshalYAML implements yaml.Marshaler for Dataflow
+func (w Dataflow) MarshalYAML() (interface{}, error) {
+	bytes, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is YAML, so parse it into a node to keep the order of the keys
+	var node yaml.Node
+	if err := yaml.Unmarshal(bytes, &node); err != nil {
+		return nil, err
+	}
+	clearYAMLStyle(&node)
+	return node.Content[0], nil
+}
+
+// LoadDataflow reads a dataflow from a file. Files with a .yaml or .yml
+// extension are read as YAML, anything else as JSON.
+func LoadDataflow(path string) (*Dataflow, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var workflow Dataflow
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(bytes, &workflow)
+	default:
+		err = json.Unmarshal(bytes, &workflow)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &workflow, nil
+}
+
+// yamlToJSON converts maps with non-string keys, which YAML allows but
+// JSON does not
+func yamlToJSON(data interface{}) interface{} {
+	switch val := data.(type) {
+	case map[string]interface{}:
+		for key, item := range val {
+			val[key] = yamlToJSON(item)
+		}
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{})
+		for key, item := range val {
+			converted[fmt.Sprint(key)] = yamlToJSON(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range val {
+			val[i] = yamlToJSON(item)
+		}
+	}
+	return data
+}
+
+// clearYAMLStyle removes the JSON (flow and quoted) style of parsed nodes
+// so they are marshaled as block YAML
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
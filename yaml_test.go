@@ -0,0 +1,111 @@
+package stepflow_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	stepflow "github.com/jcalvarado1965/go-stepflow"
+
+	"gopkg.in/yaml.v3"
+)
+
+const yamlTestJSON = `{
+	"id": "Formats",
+	"description": "the same dataflow in each format",
+	"startAt": "choice",
+	"timeout": "1m0s",
+	"steps": [
+		{"id": "choice", "type": "choice", "default": "constant",
+			"choices": [{"condition": "[$.age] > 30", "next": "wait"}]},
+		{"id": "wait", "type": "wait", "duration": "10ms", "next": "constant",
+			"retry": {"maxAttempts": 3, "initialInterval": "1s", "retryOnStatus": [502, 503]}},
+		{"id": "constant", "type": "constant", "value": {"nested": [1, "two", {"three": true}]}}
+	]
+}`
+
+const yamlTestYAML = `id: Formats
+description: the same dataflow in each format
+startAt: choice
+timeout: 1m0s
+steps:
+  - id: choice
+    type: choice
+    default: constant
+    choices:
+      - condition: "[$.age] > 30"
+        next: wait
+  - id: wait
+    type: wait
+    duration: 10ms
+    next: constant
+    retry:
+      maxAttempts: 3
+      initialInterval: 1s
+      retryOnStatus: [502, 503]
+  - id: constant
+    type: constant
+    value:
+      nested: [1, two, {three: true}]
+`
+
+func marshalDataflow(t *testing.T, df *stepflow.Dataflow) string {
+	bytes, err := json.Marshal(df)
+	if err != nil {
+		t.Fatalf("Dataflow could not be marshalled: %s", err.Error())
+	}
+	return string(bytes)
+}
+
+func TestLoadDataflow(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"dataflow.json": yamlTestJSON,
+		"dataflow.yaml": yamlTestYAML,
+		"dataflow.YML":  yamlTestYAML,
+		"dataflow":      yamlTestJSON,
+	}
+	expected := marshalDataflow(t, readDataflow(t, yamlTestJSON))
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("File %s could not be written: %s", name, err.Error())
+		}
+		df, err := stepflow.LoadDataflow(path)
+		if err != nil {
+			t.Errorf("%s: dataflow could not be loaded: %s", name, err.Error())
+		} else if loaded := marshalDataflow(t, df); loaded != expected {
+			t.Errorf("%s: expected the same dataflow as the JSON\n%s\ngot\n%s", name, expected, loaded)
+		}
+	}
+
+	// the extension decides the format
+	path := filepath.Join(dir, "yaml.json")
+	os.WriteFile(path, []byte(yamlTestYAML), 0600)
+	if _, err := stepflow.LoadDataflow(path); err == nil {
+		t.Errorf("Expected an error loading YAML from a .json file")
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	df := readDataflow(t, yamlTestJSON)
+	bytes, err := yaml.Marshal(df)
+	if err != nil {
+		t.Fatalf("Dataflow could not be marshalled as YAML: %s", err.Error())
+	}
+	// the keys are in the order of the JSON, and not quoted
+	if !strings.HasPrefix(string(bytes), "id: Formats\ndescription: ") {
+		t.Errorf("Expected the YAML keys in the JSON order, got\n%s", bytes)
+	}
+
+	var decoded stepflow.Dataflow
+	if err := yaml.Unmarshal(bytes, &decoded); err != nil {
+		t.Fatalf("Dataflow could not be read from YAML: %s\n%s", err.Error(), bytes)
+	}
+	if expected, got := marshalDataflow(t, df), marshalDataflow(t, &decoded); got != expected {
+		t.Errorf("Expected the dataflow unchanged by the round trip\n%s\ngot\n%s", expected, got)
+	}
+}